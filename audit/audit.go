@@ -0,0 +1,208 @@
+/*
+ * audit.go - or-ctl-filter control port policy audit log.
+ *
+ * To the extent possible under law, Yawning Angel has waived all copyright and
+ * related or neighboring rights to or-ctl-filter, using the creative commons
+ * "cc0" public domain dedication. See LICENSE or
+ * <http://creativecommons.org/publicdomain/zero/1.0/> for full details.
+ */
+
+// Package audit implements the structured audit log of control port policy
+// decisions.  Records are written as JSON lines, to either a file or a unix
+// domain socket, separately from the (unsanitized) debug log.
+package audit
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/yawning/or-ctl-filter/config"
+)
+
+const (
+	queueLen        = 1024
+	redialInterval  = 5 * time.Second
+	scrubbedValue   = "[scrubbed]"
+	maxRecordedArgs = 16
+)
+
+// Decision is a control port policy decision.
+type Decision string
+
+// The various policy decisions.
+const (
+	// DecisionPass is a command that was passed through to tor.
+	DecisionPass Decision = "pass"
+
+	// DecisionSpoof is a command that was answered by or-ctl-filter.
+	DecisionSpoof Decision = "spoof"
+
+	// DecisionReject is a command that was rejected by or-ctl-filter.
+	DecisionReject Decision = "reject"
+)
+
+// Record is a single audit log entry.
+type Record struct {
+	Time        time.Time `json:"time"`
+	Session     uint64    `json:"session"`
+	Peer        string    `json:"peer"`
+	Workstation string    `json:"workstation,omitempty"`
+	Command     string    `json:"command"`
+	Args        []string  `json:"args,omitempty"`
+	Decision    Decision  `json:"decision"`
+	Rule        string    `json:"rule"`
+	ReplyCode   int       `json:"reply_code,omitempty"`
+}
+
+// Commands where the arguments are considered sensitive in their entirety.
+// Multi-line commands are looked up without the "+" prefix.
+var sensitiveCmds = map[string]bool{
+	"AUTHENTICATE":          true,
+	"AUTHCHALLENGE":         true,
+	"ADD_ONION":             true,
+	"HSPOST":                true,
+	"LOADCONF":              true,
+	"ONION_CLIENT_AUTH_ADD": true,
+	"POSTDESCRIPTOR":        true,
+	"SETCONF":               true,
+	"RESETCONF":             true,
+}
+
+type auditLogger struct {
+	cfg *config.AuditCfg
+
+	w         io.WriteCloser
+	queue     chan *Record
+	nrDropped uint64
+}
+
+var logger *auditLogger
+
+// Init initializes the audit log, if enabled.
+func Init(cfg *config.Config) error {
+	if !cfg.Audit.Enable {
+		return nil
+	}
+
+	l := &auditLogger{
+		cfg:   &cfg.Audit,
+		queue: make(chan *Record, queueLen),
+	}
+	if err := l.open(); err != nil {
+		return err
+	}
+
+	logger = l
+	go l.writeWorker()
+	return nil
+}
+
+// Log normalizes and sanitizes a record, and appends it to the audit log.
+// Records are written asynchronously, and are dropped if the audit log can
+// not keep up, so that auditing never stalls the control port.
+func Log(r *Record) {
+	if logger == nil {
+		return
+	}
+
+	r.Time = time.Now().UTC()
+	r.Command = strings.ToUpper(r.Command)
+	r.Args = sanitizeArgs(r.Command, r.Args)
+
+	select {
+	case logger.queue <- r:
+	default:
+		atomic.AddUint64(&logger.nrDropped, 1)
+	}
+}
+
+// ReplyCode returns the status code of a control port reply, or 0 if the
+// reply is malformed.
+func ReplyCode(resp string) int {
+	if len(resp) < 3 {
+		return 0
+	}
+	code, err := strconv.Atoi(resp[:3])
+	if err != nil {
+		return 0
+	}
+	return code
+}
+
+func sanitizeArgs(cmd string, args []string) []string {
+	if len(args) == 0 {
+		return nil
+	}
+
+	sensitive := sensitiveCmds[strings.TrimPrefix(cmd, "+")]
+	var ret []string
+	for i, v := range args {
+		if i == maxRecordedArgs {
+			ret = append(ret, fmt.Sprintf("[%d more]", len(args)-i))
+			break
+		}
+		if sensitive {
+			// Retain the key of key=value pairs, as it is useful to know
+			// what a client tried to configure.
+			if idx := strings.IndexByte(v, '='); idx > 0 {
+				v = v[:idx+1] + scrubbedValue
+			} else {
+				v = scrubbedValue
+			}
+		}
+		ret = append(ret, v)
+	}
+	return ret
+}
+
+func (l *auditLogger) open() error {
+	if l.cfg.File != "" {
+		f, err := os.OpenFile(l.cfg.File, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+		if err != nil {
+			return fmt.Errorf("Failed to create audit log file: %v", err)
+		}
+		l.w = f
+		return nil
+	}
+
+	sNet, sAddr := l.cfg.SocketNetAddr()
+	conn, err := net.Dial(sNet, sAddr)
+	if err != nil {
+		return fmt.Errorf("Failed to connect to audit log socket: %v", err)
+	}
+	l.w = conn
+	return nil
+}
+
+func (l *auditLogger) writeWorker() {
+	for r := range l.queue {
+		b, err := json.Marshal(r)
+		if err != nil {
+			panic("BUG: failed to serialize audit record: " + err.Error())
+		}
+		b = append(b, '\n')
+
+		for l.w == nil {
+			if err = l.open(); err != nil {
+				log.Printf("ERR/audit: %v", err)
+				time.Sleep(redialInterval)
+			}
+		}
+		if _, err = l.w.Write(b); err != nil {
+			log.Printf("ERR/audit: Failed to write audit record: %v", err)
+			l.w.Close()
+			l.w = nil
+		}
+		if nrDropped := atomic.SwapUint64(&l.nrDropped, 0); nrDropped > 0 {
+			log.Printf("WARN/audit: Dropped %d audit records", nrDropped)
+		}
+	}
+}
@@ -0,0 +1,174 @@
+/*
+ * audit_test.go - or-ctl-filter control port policy audit log tests.
+ *
+ * To the extent possible under law, Yawning Angel has waived all copyright and
+ * related or neighboring rights to or-ctl-filter, using the creative commons
+ * "cc0" public domain dedication. See LICENSE or
+ * <http://creativecommons.org/publicdomain/zero/1.0/> for full details.
+ */
+
+package audit
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/yawning/or-ctl-filter/config"
+)
+
+func TestSanitizeArgs(t *testing.T) {
+	var manyArgs, manyExpected []string
+	for i := 0; i < maxRecordedArgs+4; i++ {
+		manyArgs = append(manyArgs, fmt.Sprintf("key%d", i))
+		if i < maxRecordedArgs {
+			manyExpected = append(manyExpected, manyArgs[i])
+		}
+	}
+	manyExpected = append(manyExpected, "[4 more]")
+
+	for _, tc := range []struct {
+		cmd      string
+		args     []string
+		expected []string
+	}{
+		{"GETINFO", nil, nil},
+		{"GETINFO", []string{"version", "net/listeners/socks"}, []string{"version", "net/listeners/socks"}},
+		{"AUTHENTICATE", []string{"\"hunter2\""}, []string{scrubbedValue}},
+		{"AUTHENTICATE", []string{"0123456789abcdef"}, []string{scrubbedValue}},
+		{"AUTHCHALLENGE", []string{"SAFECOOKIE", "fedcba9876543210"}, []string{scrubbedValue, scrubbedValue}},
+		{"SETCONF", []string{"HashedControlPassword=16:ABCDEF", "SocksPort=0"}, []string{"HashedControlPassword=" + scrubbedValue, "SocksPort=" + scrubbedValue}},
+		{"+LOADCONF", []string{"HashedControlPassword 16:ABCDEF"}, []string{scrubbedValue}},
+		{"ADD_ONION", []string{"ED25519-V3:c2VjcmV0", "Port=80"}, []string{scrubbedValue, "Port=" + scrubbedValue}},
+		{"ONION_CLIENT_AUTH_ADD", []string{"example", "x25519:c2VjcmV0"}, []string{scrubbedValue, scrubbedValue}},
+		{"GETINFO", manyArgs, manyExpected},
+	} {
+		if args := sanitizeArgs(tc.cmd, tc.args); !reflect.DeepEqual(args, tc.expected) {
+			t.Errorf("sanitizeArgs(%s, %v) = %v, expected %v", tc.cmd, tc.args, args, tc.expected)
+		}
+	}
+}
+
+func TestReplyCode(t *testing.T) {
+	for _, tc := range []struct {
+		resp     string
+		expected int
+	}{
+		{"250 OK\r\n", 250},
+		{"552 Unrecognized key \"address\"\r\n", 552},
+		{"650 STATUS_CLIENT NOTICE CIRCUIT_ESTABLISHED\r\n", 650},
+		{"25", 0},
+		{"OK.", 0},
+	} {
+		if code := ReplyCode(tc.resp); code != tc.expected {
+			t.Errorf("ReplyCode('%s') = %d, expected %d", tc.resp, code, tc.expected)
+		}
+	}
+}
+
+func TestLog(t *testing.T) {
+	dir, err := ioutil.TempDir("", "audit_test")
+	if err != nil {
+		t.Fatalf("Failed to create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "audit.log")
+	cfg := &config.Config{Audit: config.AuditCfg{Enable: true, File: path}}
+	if err = Init(cfg); err != nil {
+		t.Fatalf("Init() failed: %v", err)
+	}
+	defer func() {
+		close(logger.queue)
+		logger = nil
+	}()
+
+	const password, cookie = "hunter2", "0123456789abcdef"
+	records := []*Record{
+		{Session: 1, Peer: "127.0.0.1:1234", Command: "authenticate", Args: []string{cookie}, Decision: DecisionSpoof, Rule: "auth", ReplyCode: 250},
+		{Session: 1, Peer: "127.0.0.1:1234", Command: "GETINFO", Args: []string{"version"}, Decision: DecisionPass, Rule: "profile:default", ReplyCode: 250},
+		{Session: 2, Peer: "127.0.0.1:1235", Workstation: "ws0", Command: "SETCONF", Args: []string{"HashedControlPassword=" + password}, Decision: DecisionReject, Rule: "profile:default", ReplyCode: 510},
+	}
+	for _, r := range records {
+		Log(r)
+	}
+
+	// Records are written asynchronously.
+	var b []byte
+	for start := time.Now(); time.Since(start) < 5*time.Second; time.Sleep(10 * time.Millisecond) {
+		if b, err = ioutil.ReadFile(path); err != nil {
+			t.Fatalf("Failed to read audit log: %v", err)
+		}
+		if bytes.Count(b, []byte{'\n'}) == len(records) {
+			break
+		}
+	}
+
+	lines := strings.Split(strings.TrimSuffix(string(b), "\n"), "\n")
+	if len(lines) != len(records) {
+		t.Fatalf("Audit log has %d records, expected %d", len(lines), len(records))
+	}
+	for i, l := range lines {
+		var r Record
+		if err = json.Unmarshal([]byte(l), &r); err != nil {
+			t.Fatalf("Record %d is not JSON: %v", i, err)
+		}
+		if r.Time.IsZero() || r.Session != records[i].Session || r.Decision != records[i].Decision || r.ReplyCode != records[i].ReplyCode {
+			t.Errorf("Record %d = %+v, expected %+v", i, r, records[i])
+		}
+	}
+	if !strings.Contains(lines[0], `"command":"AUTHENTICATE"`) {
+		t.Errorf("Command was not normalized: %s", lines[0])
+	}
+	if !strings.Contains(lines[2], `"workstation":"ws0"`) || strings.Contains(lines[0], "workstation") {
+		t.Errorf("Workstation was not recorded only when set")
+	}
+
+	// Passwords and cookies never reach the output.
+	for _, secret := range []string{password, cookie} {
+		if bytes.Contains(b, []byte(secret)) {
+			t.Errorf("Audit log contains '%s'", secret)
+		}
+	}
+}
+
+func TestLogQueueFull(t *testing.T) {
+	// Without a worker draining the queue, records past the queue length
+	// are dropped instead of blocking.
+	logger = &auditLogger{queue: make(chan *Record, 2)}
+	defer func() {
+		logger = nil
+	}()
+
+	doneChan := make(chan struct{})
+	go func() {
+		defer close(doneChan)
+		for i := 0; i < 5; i++ {
+			Log(&Record{Command: "GETINFO"})
+		}
+	}()
+	select {
+	case <-doneChan:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Log() blocked on a full queue")
+	}
+
+	if len(logger.queue) != 2 {
+		t.Errorf("Queued %d records, expected 2", len(logger.queue))
+	}
+	if nrDropped := atomic.LoadUint64(&logger.nrDropped); nrDropped != 3 {
+		t.Errorf("Dropped %d records, expected 3", nrDropped)
+	}
+
+	// Logging is a no-op when the audit log is disabled.
+	logger = nil
+	Log(&Record{Command: "GETINFO"})
+}
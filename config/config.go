@@ -17,6 +17,7 @@ import (
 	"log"
 	gonet "net"
 	"os"
+	"path/filepath"
 
 	"github.com/BurntSushi/toml"
 	"github.com/yawning/bulb/utils"
@@ -28,15 +29,50 @@ type LoggingCfg struct {
 	File   string
 }
 
+// AuditCfg stores the audit log configuration parameters.
+type AuditCfg struct {
+	Enable bool
+	File   string
+	Socket string
+
+	socketNet, socketAddr string
+}
+
 // TorCfg stores the Tor configuration parameters.
 type TorCfg struct {
 	Enable         bool
 	ControlAddress string
 	SOCKSAddress   string
 	SuppressNewnym bool
+	OptimisticData bool
+
+	// BootstrapGate holds requests via Tor until tor has established a
+	// circuit, for up to BootstrapGateTimeout seconds.
+	BootstrapGate        bool
+	BootstrapGateTimeout int
+
+	Managed  ManagedTorCfg
+	Instance []*TorInstanceCfg
 
 	ctrlNet, ctrlAddr   string
 	socksNet, socksAddr string
+	instances           []*TorInstanceCfg
+}
+
+// ManagedTorCfg stores the managed Tor child process configuration
+// parameters.
+type ManagedTorCfg struct {
+	Enable           bool
+	Binary           string
+	DataDirectory    string
+	TorrcTemplate    string
+	BootstrapTimeout int
+}
+
+// StubCfg stores the stub (Tor disabled) control port backend configuration
+// parameters.
+type StubCfg struct {
+	Scenario string
 }
 
 // I2PCfg stores the I2P configuration parameters.
@@ -48,6 +84,7 @@ type I2PCfg struct {
 	LocalAddress      string
 	HTTPAddress       string
 	HTTPSAddress      string
+	OptimisticData    bool
 
 	mgmtNet, mgmtAddr   string
 	localNet, localAddr string
@@ -55,18 +92,45 @@ type I2PCfg struct {
 	httpsNet, httpsAddr string
 }
 
+// HealthCheckCfg stores the upstream health checker configuration
+// parameters.
+type HealthCheckCfg struct {
+	Enable   bool
+	Interval int
+}
+
 // Config stores the configuration of an or-ctl-filter instance.
 type Config struct {
-	FilteredAddress   string
-	SOCKSAddress      string
-	UnsafeAllowDirect bool
-
-	Logging LoggingCfg
-	Tor     TorCfg
-	I2P     I2PCfg
+	FilteredAddress      string
+	SOCKSAddress         string
+	UnsafeAllowDirect    bool
+	DirectOptimisticData bool
+	ResolvePolicy        string
+	SafeSocks            string
+	SafeSocksWindow      int
+
+	Logging      LoggingCfg
+	Audit        AuditCfg
+	Tor          TorCfg
+	Stub         StubCfg
+	I2P          I2PCfg
+	Onion        OnionCfg
+	Petnames     PetnamesCfg
+	VirtualAddr  VirtualAddrCfg
+	PrivateAddrs PrivateAddrsCfg
+	SOCKSAuth    SOCKSAuthCfg
+	HealthCheck  HealthCheckCfg
+	Gateway      GatewayCfg
+	Profile      map[string]*ControlProfile
+	Upstream     []*UpstreamCfg
+	Route        []*RouteCfg
 
 	fNet, fAddr         string
 	socksNet, socksAddr string
+
+	defaultProfile     *ControlProfile
+	workstationProfile *ControlProfile
+	upstreams          map[string]*UpstreamCfg
 }
 
 // Load loads a TOML format or-ctl-filter configuration from a file.
@@ -104,6 +168,10 @@ func (cfg *Config) validate() (err error) {
 		return err
 	}
 
+	if err = cfg.Audit.validate(); err != nil {
+		return err
+	}
+
 	if cfg.fNet, cfg.fAddr, err = utils.ParseControlPortString(cfg.FilteredAddress); err != nil {
 		return fmt.Errorf("Failed to parse Filtered Control Port Address: %v", err)
 	}
@@ -115,6 +183,17 @@ func (cfg *Config) validate() (err error) {
 	if !cfg.UnsafeAllowDirect && !cfg.Tor.Enable && !cfg.I2P.Enable {
 		return fmt.Errorf("No upstream connection methods configured")
 	}
+	if err = validateResolvePolicy(&cfg.ResolvePolicy, ResolvePolicyIPv4); err != nil {
+		return err
+	}
+	if err = validateSafeSocks(&cfg.SafeSocks, SafeSocksOff); err != nil {
+		return err
+	}
+	if cfg.SafeSocksWindow < 0 {
+		return fmt.Errorf("Invalid SafeSocksWindow: %d", cfg.SafeSocksWindow)
+	} else if cfg.SafeSocksWindow == 0 {
+		cfg.SafeSocksWindow = defaultSafeSocksWindow
+	}
 
 	if err = cfg.Tor.validate(); err != nil {
 		return err
@@ -122,10 +201,78 @@ func (cfg *Config) validate() (err error) {
 	if err = cfg.I2P.validate(); err != nil {
 		return err
 	}
+	if err = cfg.Onion.validate(); err != nil {
+		return err
+	}
+	if err = cfg.Petnames.validate(); err != nil {
+		return err
+	}
+	if err = cfg.VirtualAddr.validate(); err != nil {
+		return err
+	}
+	if err = cfg.PrivateAddrs.validate(); err != nil {
+		return err
+	}
+	if err = cfg.SOCKSAuth.validate(); err != nil {
+		return err
+	}
+	if err = cfg.validateUpstreams(); err != nil {
+		return err
+	}
+	if err = cfg.validateRoutes(); err != nil {
+		return err
+	}
+	if err = cfg.HealthCheck.validate(); err != nil {
+		return err
+	}
+	if err = cfg.validateProfiles(); err != nil {
+		return err
+	}
+	if err = cfg.Gateway.validate(cfg); err != nil {
+		return err
+	}
 
 	return nil
 }
 
+func (cfg *Config) validateProfiles() error {
+	defaultScope := NewnymScopeGlobal
+	if cfg.Tor.SuppressNewnym {
+		defaultScope = NewnymScopeNone
+	}
+	for name, p := range cfg.Profile {
+		if err := p.validate(name, defaultScope); err != nil {
+			return err
+		}
+	}
+
+	// Unless overridden, the default profile allows exactly what
+	// or-ctl-filter has always allowed, and gateway workstations get a copy
+	// with NEWNYM scoped to the workstation.
+	if cfg.defaultProfile = cfg.Profile[DefaultProfileName]; cfg.defaultProfile != nil {
+		cfg.workstationProfile = cfg.defaultProfile
+		return nil
+	}
+	cfg.defaultProfile = &ControlProfile{
+		GetInfo:     []string{"net/listeners/socks"},
+		Signals:     []string{"NEWNYM"},
+		NewnymScope: defaultScope,
+	}
+	wsProfile := *cfg.defaultProfile
+	if !cfg.Tor.SuppressNewnym {
+		wsProfile.NewnymScope = NewnymScopeWorkstation
+	}
+	cfg.workstationProfile = &wsProfile
+
+	return nil
+}
+
+// DefaultControlProfile returns the control port profile used for clients
+// of the filtered control port that are not gateway workstations.
+func (cfg *Config) DefaultControlProfile() *ControlProfile {
+	return cfg.defaultProfile
+}
+
 func (cfg *Config) validateLogCfgAndInit() error {
 	if !cfg.Logging.Enable {
 		log.SetOutput(ioutil.Discard)
@@ -146,19 +293,99 @@ func (cfg *Config) validateLogCfgAndInit() error {
 	return nil
 }
 
+func (aCfg *AuditCfg) validate() (err error) {
+	if !aCfg.Enable {
+		return nil
+	}
+
+	if aCfg.File == "" && aCfg.Socket == "" {
+		return fmt.Errorf("Audit log requires a File or Socket")
+	} else if aCfg.File != "" && aCfg.Socket != "" {
+		return fmt.Errorf("Audit log File and Socket are mutually exclusive")
+	}
+	if aCfg.Socket != "" {
+		if aCfg.socketNet, aCfg.socketAddr, err = parseURIAddress(aCfg.Socket); err != nil {
+			return fmt.Errorf("Failed to parse Audit Socket: %v", err)
+		} else if aCfg.socketNet != "unix" {
+			return fmt.Errorf("Audit Socket must be a unix domain socket")
+		}
+	}
+
+	return nil
+}
+
+// SocketNetAddr returns the network and address of the audit log socket.
+func (aCfg *AuditCfg) SocketNetAddr() (net, addr string) {
+	if aCfg.Enable && aCfg.Socket != "" {
+		return aCfg.socketNet, aCfg.socketAddr
+	}
+	panic("BUG: cfg.Audit.SocketNetAddr() called when the audit socket is disabled.")
+}
+
 func (tCfg *TorCfg) validate() (err error) {
+	const defaultBootstrapGateTimeout = 60
+
 	if !tCfg.Enable {
 		return nil
 	}
 
-	if tCfg.ctrlNet, tCfg.ctrlAddr, err = utils.ParseControlPortString(tCfg.ControlAddress); err != nil {
-		return fmt.Errorf("Failed to parse Tor Control Port Address: %v", err)
-	}
 	if tCfg.socksNet, tCfg.socksAddr, err = parseURIAddress(tCfg.SOCKSAddress); err != nil {
 		return fmt.Errorf("Failed to parse Tor SOCKS Address: %v", err)
 	}
+	if tCfg.Managed.Enable {
+		// The managed instance always uses a private control socket in the
+		// state directory, so ControlAddress is ignored.
+		if err = tCfg.Managed.validate(); err != nil {
+			return err
+		}
+		tCfg.ctrlNet, tCfg.ctrlAddr = "unix", tCfg.Managed.ControlSocketPath()
+	} else if tCfg.ctrlNet, tCfg.ctrlAddr, err = utils.ParseControlPortString(tCfg.ControlAddress); err != nil {
+		return fmt.Errorf("Failed to parse Tor Control Port Address: %v", err)
+	}
 
-	return
+	if tCfg.BootstrapGateTimeout < 0 {
+		return fmt.Errorf("Invalid Tor BootstrapGateTimeout: %d", tCfg.BootstrapGateTimeout)
+	} else if tCfg.BootstrapGateTimeout == 0 {
+		tCfg.BootstrapGateTimeout = defaultBootstrapGateTimeout
+	}
+
+	return tCfg.validateInstances()
+}
+
+func (mCfg *ManagedTorCfg) validate() error {
+	const (
+		defaultBinary           = "tor"
+		defaultBootstrapTimeout = 120
+	)
+
+	if mCfg.DataDirectory == "" {
+		return fmt.Errorf("Managed Tor requires a DataDirectory")
+	}
+	if mCfg.Binary == "" {
+		mCfg.Binary = defaultBinary
+	}
+	if mCfg.BootstrapTimeout < 0 {
+		return fmt.Errorf("Invalid Managed Tor BootstrapTimeout: %d", mCfg.BootstrapTimeout)
+	} else if mCfg.BootstrapTimeout == 0 {
+		mCfg.BootstrapTimeout = defaultBootstrapTimeout
+	}
+
+	return nil
+}
+
+// ControlSocketPath returns the path of the managed Tor's ControlSocket.
+func (mCfg *ManagedTorCfg) ControlSocketPath() string {
+	return filepath.Join(mCfg.DataDirectory, "control")
+}
+
+// CookieAuthFilePath returns the path of the managed Tor's CookieAuthFile.
+func (mCfg *ManagedTorCfg) CookieAuthFilePath() string {
+	return filepath.Join(mCfg.DataDirectory, "control_auth_cookie")
+}
+
+// TorrcPath returns the path of the generated torrc for the managed Tor.
+func (mCfg *ManagedTorCfg) TorrcPath() string {
+	return filepath.Join(mCfg.DataDirectory, "torrc")
 }
 
 // ControlNetAddr returns the network and address of the Tor ControlPort.
@@ -177,6 +404,17 @@ func (tCfg *TorCfg) SOCKSNetAddr() (net, addr string) {
 	panic("BUG: cfg.Tor.SOCKSNetAddr() called when Tor is disabled.")
 }
 
+func (hCfg *HealthCheckCfg) validate() error {
+	const defaultInterval = 15
+
+	if hCfg.Interval == 0 {
+		hCfg.Interval = defaultInterval
+	} else if hCfg.Interval < 0 {
+		return fmt.Errorf("Invalid health check interval: %d", hCfg.Interval)
+	}
+	return nil
+}
+
 func (iCfg *I2PCfg) validate() (err error) {
 	if !iCfg.Enable {
 		return nil
@@ -261,6 +499,66 @@ func (iCfg *I2PCfg) HTTPSNetAddr() (net, addr string) {
 	panic("BUG: cfg.I2P.HTTPSNetAddr() called when I2P is disabled.")
 }
 
+// The RESOLVE answer policies.
+const (
+	// ResolvePolicyIPv4 answers with the first IPv4 address only, for
+	// torsocks compatibility.
+	ResolvePolicyIPv4 = "ipv4"
+
+	// ResolvePolicyIPv6 answers with the first address of either family.
+	ResolvePolicyIPv6 = "ipv6"
+
+	// ResolvePolicyPreferIPv6 answers with the first IPv6 address, falling
+	// back to the first IPv4 address.
+	ResolvePolicyPreferIPv6 = "prefer-ipv6"
+
+	// ResolvePolicyDeterministic answers with the same address for a given
+	// set of records, regardless of the order they were returned in.
+	ResolvePolicyDeterministic = "deterministic"
+)
+
+func validateResolvePolicy(policy *string, defaultPolicy string) error {
+	switch *policy {
+	case "":
+		*policy = defaultPolicy
+	case ResolvePolicyIPv4, ResolvePolicyIPv6, ResolvePolicyPreferIPv6, ResolvePolicyDeterministic:
+	default:
+		return fmt.Errorf("Invalid ResolvePolicy: '%s'", *policy)
+	}
+	return nil
+}
+
+// The SafeSocks modes, for CONNECT requests with IP address destinations,
+// which usually mean that the application resolved the name itself, and
+// leaked the DNS query.
+const (
+	// SafeSocksOff allows IP address destinations.
+	SafeSocksOff = "off"
+
+	// SafeSocksWarn allows IP address destinations, with a warning.
+	SafeSocksWarn = "warn"
+
+	// SafeSocksReject rejects IP address destinations.
+	SafeSocksReject = "reject"
+
+	// SafeSocksResolved only allows IP address destinations that a RESOLVE
+	// request via the filter answered with shortly before.
+	SafeSocksResolved = "resolved"
+
+	defaultSafeSocksWindow = 60
+)
+
+func validateSafeSocks(mode *string, defaultMode string) error {
+	switch *mode {
+	case "":
+		*mode = defaultMode
+	case SafeSocksOff, SafeSocksWarn, SafeSocksReject, SafeSocksResolved:
+	default:
+		return fmt.Errorf("Invalid SafeSocks mode: '%s'", *mode)
+	}
+	return nil
+}
+
 func parseURIAddress(raw string) (network, addr string, err error) {
 	return utils.ParseControlPortString(raw)
 }
@@ -0,0 +1,228 @@
+/*
+ * gateway.go - or-ctl-filter gateway/workstation config handler.
+ *
+ * To the extent possible under law, Yawning Angel has waived all copyright and
+ * related or neighboring rights to or-ctl-filter, using the creative commons
+ * "cc0" public domain dedication. See LICENSE or
+ * <http://creativecommons.org/publicdomain/zero/1.0/> for full details.
+ */
+
+package config
+
+import (
+	"fmt"
+	gonet "net"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	"github.com/yawning/bulb/utils"
+)
+
+// The various NEWNYM scopes.
+const (
+	// NewnymScopeGlobal passes NEWNYM through to tor.
+	NewnymScopeGlobal = "global"
+
+	// NewnymScopeWorkstation only rotates the isolation tag of the workstation
+	// that issued the NEWNYM, leaving tor (and other workstations) untouched.
+	NewnymScopeWorkstation = "workstation"
+
+	// NewnymScopeNone suppresses NEWNYM entirely, while still telling the
+	// client that the signal was successful.
+	NewnymScopeNone = "none"
+)
+
+// DefaultProfileName is the name of the control port profile used when one
+// is not explicitly specified.
+const DefaultProfileName = "default"
+
+// ControlProfile is a filtered control port access profile.
+type ControlProfile struct {
+	GetInfo     []string
+	Signals     []string
+	Events      []string
+	NewnymScope string
+}
+
+// AllowsGetInfo returns true iff the profile allows the GETINFO key.
+func (p *ControlProfile) AllowsGetInfo(key string) bool {
+	return containsString(p.GetInfo, key)
+}
+
+// AllowsSignal returns true iff the profile allows the SIGNAL.
+func (p *ControlProfile) AllowsSignal(sig string) bool {
+	return containsString(p.Signals, sig)
+}
+
+// AllowsEvent returns true iff the profile allows subscribing to the event.
+func (p *ControlProfile) AllowsEvent(ev string) bool {
+	return containsString(p.Events, ev)
+}
+
+func (p *ControlProfile) validate(name string, defaultScope string) error {
+	switch p.NewnymScope {
+	case "":
+		p.NewnymScope = defaultScope
+	case NewnymScopeGlobal, NewnymScopeWorkstation, NewnymScopeNone:
+	default:
+		return fmt.Errorf("Invalid NewnymScope for profile '%s': '%s'", name, p.NewnymScope)
+	}
+	return nil
+}
+
+// GatewayCfg stores the Whonix-style gateway configuration parameters.
+type GatewayCfg struct {
+	Enable          bool
+	FilteredAddress string
+	SOCKSAddress    string
+	ResolvePolicy   string
+	SafeSocks       string
+	Workstation     []*Workstation
+
+	fNet, fAddr         string
+	socksNet, socksAddr string
+}
+
+// Workstation is a gateway client, identified by source address.
+type Workstation struct {
+	Name      string
+	Addresses []string
+	Profile   string
+
+	nets    []*gonet.IPNet
+	profile *ControlProfile
+	epoch   uint64
+}
+
+func (gCfg *GatewayCfg) validate(cfg *Config) (err error) {
+	if !gCfg.Enable {
+		return nil
+	}
+
+	if gCfg.fNet, gCfg.fAddr, err = utils.ParseControlPortString(gCfg.FilteredAddress); err != nil {
+		return fmt.Errorf("Failed to parse Gateway Filtered Control Port Address: %v", err)
+	} else if gCfg.fNet != "tcp" {
+		// Workstations are identified by their IP address.
+		return fmt.Errorf("Gateway Filtered Control Port Address must be a TCP address")
+	}
+	if gCfg.socksNet, gCfg.socksAddr, err = parseURIAddress(gCfg.SOCKSAddress); err != nil {
+		return fmt.Errorf("Failed to parse Gateway Socks Address: %v", err)
+	} else if gCfg.socksNet != "tcp" {
+		return fmt.Errorf("Gateway Socks Address must be a TCP address")
+	}
+	if err = validateResolvePolicy(&gCfg.ResolvePolicy, cfg.ResolvePolicy); err != nil {
+		return fmt.Errorf("Gateway: %v", err)
+	}
+	if err = validateSafeSocks(&gCfg.SafeSocks, cfg.SafeSocks); err != nil {
+		return fmt.Errorf("Gateway: %v", err)
+	}
+	if len(gCfg.Workstation) == 0 {
+		return fmt.Errorf("Gateway mode requires at least one Workstation")
+	}
+
+	names := make(map[string]bool)
+	for _, ws := range gCfg.Workstation {
+		if ws.Name == "" {
+			return fmt.Errorf("Gateway Workstation has no Name")
+		} else if strings.ContainsRune(ws.Name, ':') {
+			// The isolation tag is "<Name>:<epoch>".
+			return fmt.Errorf("Gateway Workstation '%s' Name contains a ':'", ws.Name)
+		} else if names[ws.Name] {
+			return fmt.Errorf("Gateway Workstation '%s' defined multiple times", ws.Name)
+		}
+		names[ws.Name] = true
+
+		if len(ws.Addresses) == 0 {
+			return fmt.Errorf("Gateway Workstation '%s' has no Addresses", ws.Name)
+		}
+		for _, a := range ws.Addresses {
+			n, err := parseCIDROrIP(a)
+			if err != nil {
+				return fmt.Errorf("Gateway Workstation '%s' has invalid Address: %v", ws.Name, err)
+			}
+			ws.nets = append(ws.nets, n)
+		}
+
+		if ws.Profile == "" {
+			ws.profile = cfg.workstationProfile
+		} else if ws.profile = cfg.Profile[ws.Profile]; ws.profile == nil {
+			return fmt.Errorf("Gateway Workstation '%s' has unknown Profile: '%s'", ws.Name, ws.Profile)
+		}
+	}
+
+	return nil
+}
+
+// FilteredNetAddr returns the network and address of the gateway
+// filtered/stub control port.
+func (gCfg *GatewayCfg) FilteredNetAddr() (net, addr string) {
+	if gCfg.Enable {
+		return gCfg.fNet, gCfg.fAddr
+	}
+	panic("BUG: cfg.Gateway.FilteredNetAddr() called when the gateway is disabled.")
+}
+
+// SOCKSNetAddr returns the network and address of the gateway SOCKS server.
+func (gCfg *GatewayCfg) SOCKSNetAddr() (net, addr string) {
+	if gCfg.Enable {
+		return gCfg.socksNet, gCfg.socksAddr
+	}
+	panic("BUG: cfg.Gateway.SOCKSNetAddr() called when the gateway is disabled.")
+}
+
+// Lookup returns the Workstation corresponding to a remote address, or nil
+// if the address does not belong to any configured workstation.
+func (gCfg *GatewayCfg) Lookup(addr gonet.Addr) *Workstation {
+	tAddr, ok := addr.(*gonet.TCPAddr)
+	if !ok {
+		return nil
+	}
+	for _, ws := range gCfg.Workstation {
+		for _, n := range ws.nets {
+			if n.Contains(tAddr.IP) {
+				return ws
+			}
+		}
+	}
+	return nil
+}
+
+// ControlProfile returns the workstation's control port profile.
+func (ws *Workstation) ControlProfile() *ControlProfile {
+	return ws.profile
+}
+
+// IsolationTag returns the workstation's current tor isolation tag.
+func (ws *Workstation) IsolationTag() string {
+	return ws.Name + ":" + strconv.FormatUint(atomic.LoadUint64(&ws.epoch), 10)
+}
+
+// Newnym rotates the workstation's isolation tag, so that new streams will
+// use new circuits.
+func (ws *Workstation) Newnym() {
+	atomic.AddUint64(&ws.epoch, 1)
+}
+
+func parseCIDROrIP(s string) (*gonet.IPNet, error) {
+	if _, n, err := gonet.ParseCIDR(s); err == nil {
+		return n, nil
+	}
+	ip := gonet.ParseIP(s)
+	if ip == nil {
+		return nil, fmt.Errorf("'%s' is not an IP address or CIDR", s)
+	}
+	if v4 := ip.To4(); v4 != nil {
+		return &gonet.IPNet{IP: v4, Mask: gonet.CIDRMask(32, 32)}, nil
+	}
+	return &gonet.IPNet{IP: ip, Mask: gonet.CIDRMask(128, 128)}, nil
+}
+
+func containsString(l []string, s string) bool {
+	for _, v := range l {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,77 @@
+/*
+ * onion.go - or-ctl-filter onion address and special name configuration.
+ *
+ * To the extent possible under law, Yawning Angel has waived all copyright and
+ * related or neighboring rights to or-ctl-filter, using the creative commons
+ * "cc0" public domain dedication. See LICENSE or
+ * <http://creativecommons.org/publicdomain/zero/1.0/> for full details.
+ */
+
+package config
+
+import (
+	"fmt"
+	"strings"
+)
+
+// The onion address subdomain rules.
+const (
+	// OnionSubdomainsKeep passes subdomains through to tor, which ignores
+	// them.
+	OnionSubdomainsKeep = "keep"
+
+	// OnionSubdomainsStrip removes subdomains before dispatch.
+	OnionSubdomainsStrip = "strip"
+
+	// OnionSubdomainsReject rejects onion addresses with subdomains.
+	OnionSubdomainsReject = "reject"
+)
+
+// The special hostname suffixes that tor interprets.
+const (
+	SuffixExit      = "exit"
+	SuffixNoConnect = "noconnect"
+)
+
+// OnionCfg stores the onion address validation configuration parameters.
+type OnionCfg struct {
+	// Subdomains is the subdomain rule (Default: "keep").
+	Subdomains string
+
+	// AllowSpecialSuffixes are the special suffixes (".exit",
+	// ".noconnect") that are passed through instead of rejected.
+	AllowSpecialSuffixes []string
+
+	allowedSuffixes map[string]bool
+}
+
+func (oCfg *OnionCfg) validate() error {
+	switch oCfg.Subdomains {
+	case "":
+		oCfg.Subdomains = OnionSubdomainsKeep
+	case OnionSubdomainsKeep, OnionSubdomainsStrip, OnionSubdomainsReject:
+	default:
+		return fmt.Errorf("Invalid Onion Subdomains rule: '%s'", oCfg.Subdomains)
+	}
+
+	oCfg.allowedSuffixes = make(map[string]bool)
+	for _, s := range oCfg.AllowSpecialSuffixes {
+		suffix := strings.ToLower(strings.TrimPrefix(s, "."))
+		switch suffix {
+		case SuffixExit, SuffixNoConnect:
+			oCfg.allowedSuffixes[suffix] = true
+		default:
+			return fmt.Errorf("Unknown special suffix: '%s'", s)
+		}
+	}
+	return nil
+}
+
+// AllowsSpecialSuffix returns true iff the special suffix (without the
+// leading '.') may be passed through to tor.
+func (oCfg *OnionCfg) AllowsSpecialSuffix(suffix string) bool {
+	if oCfg.allowedSuffixes == nil {
+		panic("BUG: cfg.Onion.AllowsSpecialSuffix() called on an unvalidated config")
+	}
+	return oCfg.allowedSuffixes[suffix]
+}
@@ -0,0 +1,113 @@
+/*
+ * petnames.go - or-ctl-filter petname address book.
+ *
+ * To the extent possible under law, Yawning Angel has waived all copyright and
+ * related or neighboring rights to or-ctl-filter, using the creative commons
+ * "cc0" public domain dedication. See LICENSE or
+ * <http://creativecommons.org/publicdomain/zero/1.0/> for full details.
+ */
+
+package config
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/BurntSushi/toml"
+)
+
+// PetnamesCfg is the petname address book configuration.  The address book
+// file maps friendly names to onion or I2P destinations, one per line:
+//
+//	"wiki.internal" = "<56 characters>.onion"
+type PetnamesCfg struct {
+	Enable bool
+	File   string
+
+	// Suffixes are domain suffixes reserved for petnames.  Names under a
+	// reserved suffix that are not in the address book are rejected,
+	// instead of being dispatched (and resolved) as clearnet names.
+	Suffixes []string
+
+	sync.RWMutex
+	book map[string]string
+}
+
+func (pCfg *PetnamesCfg) validate() error {
+	if !pCfg.Enable {
+		return nil
+	}
+	if pCfg.File == "" {
+		return fmt.Errorf("Petnames enabled with no address book file")
+	}
+	for i, s := range pCfg.Suffixes {
+		pCfg.Suffixes[i] = normalizeName(s)
+		if pCfg.Suffixes[i] == "" {
+			return fmt.Errorf("Invalid petname suffix: '%s'", s)
+		}
+	}
+	return pCfg.Reload()
+}
+
+// Reload re-reads the address book file.  If the file is invalid, the
+// current address book is left as is.
+func (pCfg *PetnamesCfg) Reload() error {
+	var raw map[string]string
+	if _, err := toml.DecodeFile(pCfg.File, &raw); err != nil {
+		return fmt.Errorf("Failed to parse petname address book: %v", err)
+	}
+
+	book := make(map[string]string)
+	for name, dst := range raw {
+		n, d := normalizeName(name), normalizeName(dst)
+		if n == "" || isOverlayName(n) {
+			return fmt.Errorf("Invalid petname: '%s'", name)
+		} else if !isOverlayName(d) {
+			return fmt.Errorf("Petname '%s' destination is not an onion or I2P address: '%s'", name, dst)
+		} else if _, ok := book[n]; ok {
+			return fmt.Errorf("Duplicate petname: '%s'", name)
+		}
+		book[n] = d
+	}
+
+	pCfg.Lock()
+	defer pCfg.Unlock()
+	pCfg.book = book
+	return nil
+}
+
+// Lookup returns the destination of the petname, if name is one.
+func (pCfg *PetnamesCfg) Lookup(name string) (string, bool) {
+	if !pCfg.Enable {
+		return "", false
+	}
+
+	pCfg.RLock()
+	defer pCfg.RUnlock()
+	dst, ok := pCfg.book[normalizeName(name)]
+	return dst, ok
+}
+
+// IsReserved returns true iff name is under a suffix reserved for petnames.
+func (pCfg *PetnamesCfg) IsReserved(name string) bool {
+	if !pCfg.Enable {
+		return false
+	}
+
+	name = normalizeName(name)
+	for _, s := range pCfg.Suffixes {
+		if name == s || strings.HasSuffix(name, "."+s) {
+			return true
+		}
+	}
+	return false
+}
+
+func normalizeName(name string) string {
+	return strings.ToLower(strings.Trim(name, "."))
+}
+
+func isOverlayName(name string) bool {
+	return strings.HasSuffix(name, ".onion") || strings.HasSuffix(name, ".i2p")
+}
@@ -0,0 +1,82 @@
+/*
+ * private.go - or-ctl-filter private destination address configuration.
+ *
+ * To the extent possible under law, Yawning Angel has waived all copyright and
+ * related or neighboring rights to or-ctl-filter, using the creative commons
+ * "cc0" public domain dedication. See LICENSE or
+ * <http://creativecommons.org/publicdomain/zero/1.0/> for full details.
+ */
+
+package config
+
+import (
+	"fmt"
+	"net"
+)
+
+// privateNets are the destination networks that are forbidden unless
+// explicitly allowed.
+var privateNets = mustParseCIDRs(
+	"0.0.0.0/8",      // "This" network (0.0.0.0 reaches localhost).
+	"10.0.0.0/8",     // RFC 1918.
+	"127.0.0.0/8",    // Loopback.
+	"169.254.0.0/16", // Link-local.
+	"172.16.0.0/12",  // RFC 1918.
+	"192.168.0.0/16", // RFC 1918.
+	"::/128",         // Unspecified.
+	"::1/128",        // Loopback.
+	"fc00::/7",       // Unique local (ULA).
+	"fe80::/10",      // Link-local.
+)
+
+// PrivateAddrsCfg is the private destination address configuration.
+// Loopback, RFC 1918, link-local, and ULA destinations are rejected on every
+// upstream, unless allowed.
+type PrivateAddrsCfg struct {
+	// Allow are the private addresses or CIDRs that may be connected to.
+	Allow []string
+
+	allow []*net.IPNet
+}
+
+func (pCfg *PrivateAddrsCfg) validate() error {
+	for _, s := range pCfg.Allow {
+		n, err := parseCIDROrIP(s)
+		if err != nil {
+			return fmt.Errorf("Invalid PrivateAddrs Allow entry: %v", err)
+		}
+		pCfg.allow = append(pCfg.allow, n)
+	}
+	return nil
+}
+
+// IsForbidden returns true iff ip is a private address that is not allowed.
+func (pCfg *PrivateAddrsCfg) IsForbidden(ip net.IP) bool {
+	if v4 := ip.To4(); v4 != nil {
+		// IPv4-mapped IPv6 addresses are treated as IPv4.
+		ip = v4
+	}
+	for _, n := range pCfg.allow {
+		if n.Contains(ip) {
+			return false
+		}
+	}
+	for _, n := range privateNets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func mustParseCIDRs(cidrs ...string) []*net.IPNet {
+	var ret []*net.IPNet
+	for _, s := range cidrs {
+		_, n, err := net.ParseCIDR(s)
+		if err != nil {
+			panic("BUG: invalid CIDR: " + s)
+		}
+		ret = append(ret, n)
+	}
+	return ret
+}
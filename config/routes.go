@@ -0,0 +1,287 @@
+/*
+ * routes.go - or-ctl-filter SOCKS routing table.
+ *
+ * To the extent possible under law, Yawning Angel has waived all copyright and
+ * related or neighboring rights to or-ctl-filter, using the creative commons
+ * "cc0" public domain dedication. See LICENSE or
+ * <http://creativecommons.org/publicdomain/zero/1.0/> for full details.
+ */
+
+package config
+
+import (
+	"fmt"
+	"net"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/yawning/or-ctl-filter/socks5"
+)
+
+// The routing table rule actions.
+const (
+	RouteActionTor    = "tor"
+	RouteActionI2P    = "i2p"
+	RouteActionDirect = "direct"
+	RouteActionReject = "reject"
+)
+
+var replyCodes = map[string]socks5.ReplyCode{
+	"general-failure":        socks5.ReplyGeneralFailure,
+	"connection-not-allowed": socks5.ReplyConnectionNotAllowed,
+	"network-unreachable":    socks5.ReplyNetworkUnreachable,
+	"host-unreachable":       socks5.ReplyHostUnreachable,
+	"connection-refused":     socks5.ReplyConnectionRefused,
+	"ttl-expired":            socks5.ReplyTTLExpired,
+	"address-not-supported":  socks5.ReplyAddressNotSupported,
+}
+
+// RouteCfg is a SOCKS routing table rule.  A rule matches a destination if
+// every criteria that is specified matches, and a criteria matches if any of
+// its entries match.
+type RouteCfg struct {
+	// Domains are domain name suffixes, where "example.com" matches
+	// "example.com" and all of its subdomains.
+	Domains []string
+
+	// Globs are domain name glob patterns (eg: "*.example.com").
+	Globs []string
+
+	// Regexps are domain name regular expressions.
+	Regexps []string
+
+	// CIDRs are the IP address ranges, matched against IP address
+	// destinations only (no DNS resolution is done).
+	CIDRs []string
+
+	// Ports are destination ports or port ranges (eg: "80", "8000-8080").
+	Ports []string
+
+	// Users are SOCKS usernames (or SOCKS 4 USERIDs).
+	Users []string
+
+	// Action is "tor", "i2p", "direct", "reject", or the name of an
+	// upstream.
+	Action string
+
+	// Reply is the reply sent for "reject" (Default:
+	// "connection-not-allowed").
+	Reply string
+
+	regexps  []*regexp.Regexp
+	nets     []*net.IPNet
+	ports    []portRange
+	reply    socks5.ReplyCode
+	upstream *UpstreamCfg
+}
+
+type portRange struct {
+	lo, hi uint16
+}
+
+// defaultRoutes are the rules that are always appended to the routing table,
+// so that onion and I2P names never fall through to an upstream that can not
+// reach them.  Anything that does not match is dispatched via Tor if
+// possible, and direct otherwise.
+func defaultRoutes() []*RouteCfg {
+	return []*RouteCfg{
+		{Domains: []string{"onion"}, Action: RouteActionTor},
+		{Domains: []string{"i2p"}, Action: RouteActionI2P},
+	}
+}
+
+func (cfg *Config) validateRoutes() error {
+	cfg.Route = append(cfg.Route, defaultRoutes()...)
+	for i, r := range cfg.Route {
+		if err := r.validate(cfg); err != nil {
+			return fmt.Errorf("Route %d: %v", i+1, err)
+		}
+	}
+	return nil
+}
+
+func (r *RouteCfg) validate(cfg *Config) error {
+	if r.Reply != "" && r.Action != RouteActionReject {
+		return fmt.Errorf("Reply is only valid for '%s'", RouteActionReject)
+	}
+
+	switch r.Action {
+	case RouteActionTor, RouteActionI2P, RouteActionDirect:
+	case RouteActionReject:
+		if r.Reply == "" {
+			r.Reply = "connection-not-allowed"
+		}
+		code, ok := replyCodes[r.Reply]
+		if !ok {
+			return fmt.Errorf("Unknown reply: '%s'", r.Reply)
+		}
+		r.reply = code
+	case "":
+		return fmt.Errorf("No action specified")
+	default:
+		if r.upstream = cfg.upstreams[r.Action]; r.upstream == nil {
+			return fmt.Errorf("Unknown action or upstream: '%s'", r.Action)
+		}
+	}
+
+	for i, d := range r.Domains {
+		r.Domains[i] = strings.ToLower(strings.Trim(d, "."))
+	}
+	for i, g := range r.Globs {
+		r.Globs[i] = strings.ToLower(g)
+		if _, err := path.Match(r.Globs[i], ""); err != nil {
+			return fmt.Errorf("Invalid glob '%s': %v", g, err)
+		}
+	}
+	for _, s := range r.Regexps {
+		re, err := regexp.Compile(s)
+		if err != nil {
+			return fmt.Errorf("Invalid regexp '%s': %v", s, err)
+		}
+		r.regexps = append(r.regexps, re)
+	}
+	for _, s := range r.CIDRs {
+		_, ipNet, err := net.ParseCIDR(s)
+		if err != nil {
+			return fmt.Errorf("Invalid CIDR '%s': %v", s, err)
+		}
+		r.nets = append(r.nets, ipNet)
+	}
+	for _, s := range r.Ports {
+		pr, err := parsePortRange(s)
+		if err != nil {
+			return err
+		}
+		r.ports = append(r.ports, pr)
+	}
+	return nil
+}
+
+func parsePortRange(s string) (portRange, error) {
+	loStr, hiStr := s, s
+	if idx := strings.IndexByte(s, '-'); idx != -1 {
+		loStr, hiStr = s[:idx], s[idx+1:]
+	}
+	lo, err := strconv.ParseUint(loStr, 10, 16)
+	if err != nil {
+		return portRange{}, fmt.Errorf("Invalid port range: '%s'", s)
+	}
+	hi, err := strconv.ParseUint(hiStr, 10, 16)
+	if err != nil || hi < lo {
+		return portRange{}, fmt.Errorf("Invalid port range: '%s'", s)
+	}
+	return portRange{uint16(lo), uint16(hi)}, nil
+}
+
+// ReplyCode returns the reply code for a "reject" rule.
+func (r *RouteCfg) ReplyCode() socks5.ReplyCode {
+	if r.Action != RouteActionReject {
+		panic("BUG: r.ReplyCode() called for a non-reject rule")
+	}
+	return r.reply
+}
+
+// Upstream returns the named upstream for the rule, or nil if the action is
+// not a named upstream.
+func (r *RouteCfg) Upstream() *UpstreamCfg {
+	return r.upstream
+}
+
+func (r *RouteCfg) matches(host string, ip net.IP, port uint16, uname string) bool {
+	hasName := len(r.Domains) > 0 || len(r.Globs) > 0 || len(r.Regexps) > 0
+	if hasName && (ip != nil || !r.matchesName(host)) {
+		return false
+	}
+	if len(r.nets) > 0 && (ip == nil || !r.matchesIP(ip)) {
+		return false
+	}
+	if len(r.ports) > 0 && !r.matchesPort(port) {
+		return false
+	}
+	if len(r.Users) > 0 && !r.matchesUser(uname) {
+		return false
+	}
+	return true
+}
+
+func (r *RouteCfg) matchesName(host string) bool {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	for _, d := range r.Domains {
+		if host == d || strings.HasSuffix(host, "."+d) {
+			return true
+		}
+	}
+	for _, g := range r.Globs {
+		if ok, _ := path.Match(g, host); ok {
+			return true
+		}
+	}
+	for _, re := range r.regexps {
+		if re.MatchString(host) {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *RouteCfg) matchesIP(ip net.IP) bool {
+	for _, ipNet := range r.nets {
+		if ipNet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *RouteCfg) matchesPort(port uint16) bool {
+	for _, pr := range r.ports {
+		if port >= pr.lo && port <= pr.hi {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *RouteCfg) matchesUser(uname string) bool {
+	for _, u := range r.Users {
+		if uname == u {
+			return true
+		}
+	}
+	return false
+}
+
+// MatchRoute returns the first routing table rule that matches the
+// destination host and port, and the SOCKS username, or nil if no rule
+// matches.  IPv6 addresses may be bracketed.  Onion and I2P names only match
+// rules that reject them or send them to their own network, so that a rule
+// that matches on something other than the name (eg: a port) can never send
+// them anywhere else.
+func (cfg *Config) MatchRoute(host string, port uint16, uname string) *RouteCfg {
+	ip := net.ParseIP(strings.Trim(host, "[]"))
+	overlayAction := overlayRouteAction(host)
+	for _, r := range cfg.Route {
+		if overlayAction != "" && r.Action != overlayAction && r.Action != RouteActionReject {
+			continue
+		}
+		if r.matches(host, ip, port, uname) {
+			return r
+		}
+	}
+	return nil
+}
+
+// overlayRouteAction returns the only action (other than "reject") that is
+// valid for an onion or I2P name, or "" for other destinations.
+func overlayRouteAction(host string) string {
+	name := strings.ToLower(strings.TrimSuffix(host, "."))
+	switch {
+	case strings.HasSuffix(name, ".onion"):
+		return RouteActionTor
+	case strings.HasSuffix(name, ".i2p"):
+		return RouteActionI2P
+	}
+	return ""
+}
@@ -0,0 +1,76 @@
+/*
+ * routes_test.go - or-ctl-filter SOCKS routing table tests.
+ *
+ * To the extent possible under law, Yawning Angel has waived all copyright and
+ * related or neighboring rights to or-ctl-filter, using the creative commons
+ * "cc0" public domain dedication. See LICENSE or
+ * <http://creativecommons.org/publicdomain/zero/1.0/> for full details.
+ */
+
+package config
+
+import "testing"
+
+func TestMatchRoute(t *testing.T) {
+	cfg := &Config{
+		Route: []*RouteCfg{
+			{CIDRs: []string{"fd00::/8"}, Action: RouteActionDirect},
+			{CIDRs: []string{"192.0.2.0/24"}, Ports: []string{"8000-8080"}, Action: RouteActionDirect},
+			{Domains: []string{"example.com"}, Action: RouteActionTor},
+			{Globs: []string{"*.example.net"}, Action: RouteActionDirect},
+			{Regexps: []string{`^mail[0-9]+\.`}, Action: RouteActionTor},
+			{Ports: []string{"25"}, Action: RouteActionReject},
+			{Users: []string{"alice"}, Action: RouteActionDirect},
+		},
+	}
+	if err := cfg.validateRoutes(); err != nil {
+		t.Fatalf("validateRoutes() failed: %v", err)
+	}
+	if len(cfg.Route) != 9 || cfg.Route[7].Action != RouteActionTor || cfg.Route[8].Action != RouteActionI2P {
+		t.Fatalf("validateRoutes() did not append the default rules")
+	}
+
+	for _, tc := range []struct {
+		host     string
+		port     uint16
+		uname    string
+		expected int // Index into cfg.Route, -1 for no match.
+	}{
+		{"[fd00::1]", 443, "", 0},
+		{"fd00::1", 443, "", 0},
+		{"[fe80::1]", 443, "", -1},
+		{"192.0.2.1", 8080, "", 1},
+		{"192.0.2.1", 443, "", -1},
+		{"example.com", 443, "", 2},
+		{"WWW.Example.COM.", 443, "", 2},
+		{"badexample.com", 443, "", -1},
+		{"www.example.net", 443, "", 3},
+		{"example.net", 443, "", -1},
+		{"mail1.example.org", 443, "", 4},
+		{"mail.example.org", 25, "", 5},
+		{"[2001:db8::1]", 25, "", 5},
+		{"example.org", 443, "alice", 6},
+		{"example.org", 443, "bob", -1},
+		{"www.example.onion", 443, "", 7},
+		{"www.example.i2p", 443, "", 8},
+
+		// Onion and I2P names only match rules that reject them, or send
+		// them to their own network.
+		{"mail1.example.i2p", 443, "", 8},
+		{"mail1.example.onion", 443, "", 4},
+		{"www.example.onion", 25, "", 5},
+		{"www.example.i2p", 443, "alice", 8},
+		{"www.example.onion.", 443, "alice", 7},
+	} {
+		r := cfg.MatchRoute(tc.host, tc.port, tc.uname)
+		idx := -1
+		for i, rr := range cfg.Route {
+			if r == rr {
+				idx = i
+			}
+		}
+		if idx != tc.expected {
+			t.Errorf("MatchRoute(%s, %d, '%s') = rule %d, expected %d", tc.host, tc.port, tc.uname, idx, tc.expected)
+		}
+	}
+}
@@ -0,0 +1,170 @@
+/*
+ * tor_instances.go - or-ctl-filter multiple tor instance support.
+ *
+ * To the extent possible under law, Yawning Angel has waived all copyright and
+ * related or neighboring rights to or-ctl-filter, using the creative commons
+ * "cc0" public domain dedication. See LICENSE or
+ * <http://creativecommons.org/publicdomain/zero/1.0/> for full details.
+ */
+
+package config
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"sort"
+	"sync/atomic"
+	"time"
+
+	"github.com/yawning/bulb/utils"
+)
+
+// torInstanceDownTime is how long an instance that failed is avoided for.
+const torInstanceDownTime = 30 * time.Second
+
+// TorInstanceCfg is a tor instance.  The instance described by TorCfg itself
+// is always the first instance.
+type TorInstanceCfg struct {
+	ControlAddress string
+	SOCKSAddress   string
+
+	ctrlNet, ctrlAddr   string
+	socksNet, socksAddr string
+
+	// downUntil is when a failed instance may be used again, in Unix
+	// nanoseconds.
+	downUntil int64
+
+	// unhealthy is set by the health checker (0/1).
+	unhealthy int32
+}
+
+// ControlNetAddr returns the network and address of the instance's control
+// port.
+func (inst *TorInstanceCfg) ControlNetAddr() (net, addr string) {
+	return inst.ctrlNet, inst.ctrlAddr
+}
+
+// SOCKSNetAddr returns the network and address of the instance's SOCKS port.
+func (inst *TorInstanceCfg) SOCKSNetAddr() (net, addr string) {
+	return inst.socksNet, inst.socksAddr
+}
+
+// String returns the instance's SOCKS address, for logging purposes.
+func (inst *TorInstanceCfg) String() string {
+	return inst.socksNet + "://" + inst.socksAddr
+}
+
+// MarkDown marks the instance as failed, so that streams fail over to the
+// other instances for a while.
+func (inst *TorInstanceCfg) MarkDown() {
+	atomic.StoreInt64(&inst.downUntil, time.Now().Add(torInstanceDownTime).UnixNano())
+}
+
+// MarkUp marks the instance as working.
+func (inst *TorInstanceCfg) MarkUp() {
+	atomic.StoreInt64(&inst.downUntil, 0)
+}
+
+// SetHealthy sets the instance's health, as determined by the health
+// checker.
+func (inst *TorInstanceCfg) SetHealthy(healthy bool) {
+	var v int32
+	if !healthy {
+		v = 1
+	}
+	atomic.StoreInt32(&inst.unhealthy, v)
+}
+
+// IsHealthy returns false iff the health checker considers the instance
+// unusable.
+func (inst *TorInstanceCfg) IsHealthy() bool {
+	return atomic.LoadInt32(&inst.unhealthy) == 0
+}
+
+// IsUp returns false iff the instance is unhealthy, or recently failed.
+func (inst *TorInstanceCfg) IsUp() bool {
+	return inst.IsHealthy() && time.Now().UnixNano() >= atomic.LoadInt64(&inst.downUntil)
+}
+
+func (inst *TorInstanceCfg) validate() (err error) {
+	if inst.ctrlNet, inst.ctrlAddr, err = utils.ParseControlPortString(inst.ControlAddress); err != nil {
+		return fmt.Errorf("Failed to parse Tor Instance Control Port Address: %v", err)
+	}
+	if inst.socksNet, inst.socksAddr, err = parseURIAddress(inst.SOCKSAddress); err != nil {
+		return fmt.Errorf("Failed to parse Tor Instance SOCKS Address: %v", err)
+	}
+	return nil
+}
+
+func (tCfg *TorCfg) validateInstances() error {
+	primary := &TorInstanceCfg{
+		ctrlNet:   tCfg.ctrlNet,
+		ctrlAddr:  tCfg.ctrlAddr,
+		socksNet:  tCfg.socksNet,
+		socksAddr: tCfg.socksAddr,
+	}
+	tCfg.instances = []*TorInstanceCfg{primary}
+
+	seen := map[string]bool{primary.String(): true}
+	for _, inst := range tCfg.Instance {
+		if err := inst.validate(); err != nil {
+			return err
+		}
+		if seen[inst.String()] {
+			return fmt.Errorf("Duplicate Tor Instance SOCKS Address: '%s'", inst.SOCKSAddress)
+		}
+		seen[inst.String()] = true
+		tCfg.instances = append(tCfg.instances, inst)
+	}
+	return nil
+}
+
+// Instances returns all of the tor instances, starting with the primary
+// instance.
+func (tCfg *TorCfg) Instances() []*TorInstanceCfg {
+	if tCfg.instances == nil {
+		panic("BUG: cfg.Tor.Instances() called when Tor is disabled.")
+	}
+	return tCfg.instances
+}
+
+// PickInstances returns the tor instances in the order that they should be
+// tried for a stream with the isolation key.  The order is determined by
+// rendezvous hashing, so that streams with the same key always use the same
+// instance, and only the streams of a failed instance move elsewhere.
+// Instances that recently failed are tried last.
+func (tCfg *TorCfg) PickInstances(key []byte) []*TorInstanceCfg {
+	instances := tCfg.Instances()
+	if len(instances) == 1 {
+		return instances
+	}
+
+	type scoredInstance struct {
+		inst  *TorInstanceCfg
+		up    bool
+		score uint64
+	}
+	scored := make([]scoredInstance, 0, len(instances))
+	for _, inst := range instances {
+		h := sha256.New()
+		h.Write([]byte(inst.String()))
+		h.Write([]byte{0})
+		h.Write(key)
+		score := binary.BigEndian.Uint64(h.Sum(nil))
+		scored = append(scored, scoredInstance{inst, inst.IsUp(), score})
+	}
+	sort.Slice(scored, func(i, j int) bool {
+		if scored[i].up != scored[j].up {
+			return scored[i].up
+		}
+		return scored[i].score > scored[j].score
+	})
+
+	ret := make([]*TorInstanceCfg, 0, len(scored))
+	for _, si := range scored {
+		ret = append(ret, si.inst)
+	}
+	return ret
+}
@@ -0,0 +1,114 @@
+/*
+ * upstreams.go - or-ctl-filter named upstream proxies.
+ *
+ * To the extent possible under law, Yawning Angel has waived all copyright and
+ * related or neighboring rights to or-ctl-filter, using the creative commons
+ * "cc0" public domain dedication. See LICENSE or
+ * <http://creativecommons.org/publicdomain/zero/1.0/> for full details.
+ */
+
+package config
+
+import "fmt"
+
+// The named upstream proxy types.
+const (
+	UpstreamTypeSOCKS5      = "socks5"
+	UpstreamTypeHTTPConnect = "http-connect"
+)
+
+// UpstreamViaTor is the Via value for upstreams that are connected to via
+// Tor.
+const UpstreamViaTor = "tor"
+
+// UpstreamCfg is a named upstream proxy, that the routing table can dispatch
+// connections to.
+type UpstreamCfg struct {
+	Name     string
+	Type     string
+	Address  string
+	Username string
+	Password string
+
+	// Via is the upstream used to connect to the proxy, either "tor", the
+	// name of another upstream, or empty to connect directly.
+	Via string
+
+	OptimisticData bool
+
+	net, addr string
+	via       *UpstreamCfg
+}
+
+// NetAddr returns the network and address of the upstream proxy.
+func (u *UpstreamCfg) NetAddr() (net, addr string) {
+	if u.net == "" {
+		panic("BUG: u.NetAddr() called on an unvalidated upstream")
+	}
+	return u.net, u.addr
+}
+
+// ViaUpstream returns the upstream used to connect to the proxy, or nil if
+// the proxy is connected to via Tor, or directly.
+func (u *UpstreamCfg) ViaUpstream() *UpstreamCfg {
+	return u.via
+}
+
+func (cfg *Config) validateUpstreams() (err error) {
+	cfg.upstreams = make(map[string]*UpstreamCfg)
+	for _, u := range cfg.Upstream {
+		switch u.Name {
+		case "":
+			return fmt.Errorf("Upstream has no name")
+		case RouteActionTor, RouteActionI2P, RouteActionDirect, RouteActionReject:
+			return fmt.Errorf("Upstream name is reserved: '%s'", u.Name)
+		}
+		if _, ok := cfg.upstreams[u.Name]; ok {
+			return fmt.Errorf("Duplicate upstream: '%s'", u.Name)
+		}
+
+		switch u.Type {
+		case UpstreamTypeSOCKS5:
+			if len(u.Username) > 255 || len(u.Password) > 255 {
+				return fmt.Errorf("Upstream '%s' credentials are too long", u.Name)
+			} else if (u.Username == "") != (u.Password == "") {
+				return fmt.Errorf("Upstream '%s' must have both a Username and Password", u.Name)
+			}
+		case UpstreamTypeHTTPConnect:
+		default:
+			return fmt.Errorf("Upstream '%s' has an unknown type: '%s'", u.Name, u.Type)
+		}
+		if u.net, u.addr, err = parseURIAddress(u.Address); err != nil {
+			return fmt.Errorf("Failed to parse Upstream '%s' Address: %v", u.Name, err)
+		} else if u.Via != "" && u.net != "tcp" {
+			return fmt.Errorf("Upstream '%s' Address must be a TCP address to use Via", u.Name)
+		}
+		cfg.upstreams[u.Name] = u
+	}
+
+	// Resolve the Via chains, once all the names are known.
+	for _, u := range cfg.Upstream {
+		switch u.Via {
+		case "":
+		case UpstreamViaTor:
+			if !cfg.Tor.Enable {
+				return fmt.Errorf("Upstream '%s' is via Tor, but Tor is not enabled", u.Name)
+			}
+		default:
+			if u.via = cfg.upstreams[u.Via]; u.via == nil {
+				return fmt.Errorf("Upstream '%s' is via an unknown upstream: '%s'", u.Name, u.Via)
+			}
+		}
+	}
+	for _, u := range cfg.Upstream {
+		seen := make(map[*UpstreamCfg]bool)
+		for v := u; v != nil; v = v.via {
+			if seen[v] {
+				return fmt.Errorf("Upstream '%s' has a Via loop", u.Name)
+			}
+			seen[v] = true
+		}
+	}
+
+	return nil
+}
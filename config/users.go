@@ -0,0 +1,246 @@
+/*
+ * users.go - or-ctl-filter SOCKS user database.
+ *
+ * To the extent possible under law, Yawning Angel has waived all copyright and
+ * related or neighboring rights to or-ctl-filter, using the creative commons
+ * "cc0" public domain dedication. See LICENSE or
+ * <http://creativecommons.org/publicdomain/zero/1.0/> for full details.
+ */
+
+package config
+
+import (
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/BurntSushi/toml"
+)
+
+const (
+	passwordHashScheme = "pbkdf2-sha256"
+	passwordHashIters  = 100000
+	passwordSaltLen    = 16
+	passwordKeyLen     = 32
+
+	maxAuthCacheEntries = 1024
+)
+
+var (
+	// ErrAuthFailed is the error returned when SOCKS authentication fails.
+	ErrAuthFailed = errors.New("SOCKS authentication failed")
+
+	passwdEncoding = base64.RawStdEncoding
+)
+
+// SOCKSAuthCfg is the SOCKS authentication configuration.
+type SOCKSAuthCfg struct {
+	Enable    bool
+	UsersFile string
+
+	users *userDB
+}
+
+// RoutingProfile is the set of upstreams a SOCKS user may use, and the user's
+// RESOLVE policy and SafeSocks mode (which override the listener's if set).
+type RoutingProfile struct {
+	Tor           bool
+	I2P           bool
+	Direct        bool
+	ResolvePolicy string
+	SafeSocks     string
+}
+
+// User is a SOCKS user, identified either by name and password, or by a
+// username prefix.
+type User struct {
+	Name     string
+	Prefix   string
+	Password string
+	Profile  string
+
+	profile *RoutingProfile
+	iters   int
+	salt    []byte
+	key     []byte
+}
+
+// RoutingProfile returns the routing profile of the user.
+func (u *User) RoutingProfile() *RoutingProfile {
+	if u.profile == nil {
+		panic("BUG: u.profile == nil")
+	}
+	return u.profile
+}
+
+// String returns the name (or prefix) of the user, for logging purposes.
+func (u *User) String() string {
+	if u.Name != "" {
+		return u.Name
+	}
+	return u.Prefix + "*"
+}
+
+type userDB struct {
+	User    []*User
+	Profile map[string]*RoutingProfile
+
+	names    map[string]*User
+	prefixes []*User
+
+	cacheLock sync.Mutex
+	cache     map[[sha256.Size]byte]*User
+}
+
+func (sCfg *SOCKSAuthCfg) validate() error {
+	if !sCfg.Enable {
+		return nil
+	}
+	if sCfg.UsersFile == "" {
+		return fmt.Errorf("SOCKS authentication enabled with no users file")
+	}
+
+	db := new(userDB)
+	if _, err := toml.DecodeFile(sCfg.UsersFile, db); err != nil {
+		return fmt.Errorf("Failed to parse SOCKS users file: %v", err)
+	}
+	if err := db.validate(); err != nil {
+		return err
+	}
+	sCfg.users = db
+	return nil
+}
+
+func (db *userDB) validate() error {
+	db.names = make(map[string]*User)
+	db.cache = make(map[[sha256.Size]byte]*User)
+	for name, p := range db.Profile {
+		if err := validateResolvePolicy(&p.ResolvePolicy, ""); err != nil {
+			return fmt.Errorf("SOCKS profile '%s': %v", name, err)
+		}
+		if err := validateSafeSocks(&p.SafeSocks, ""); err != nil {
+			return fmt.Errorf("SOCKS profile '%s': %v", name, err)
+		}
+	}
+	for _, u := range db.User {
+		if (u.Name == "") == (u.Prefix == "") {
+			return fmt.Errorf("SOCKS user must have exactly one of Name or Prefix")
+		}
+		if u.profile = db.Profile[u.Profile]; u.profile == nil {
+			return fmt.Errorf("SOCKS user '%s' has an unknown profile: '%s'", u, u.Profile)
+		}
+
+		if u.Prefix != "" {
+			if u.Password != "" {
+				return fmt.Errorf("SOCKS user prefix '%s' can not have a password", u.Prefix)
+			}
+			db.prefixes = append(db.prefixes, u)
+			continue
+		}
+		if _, ok := db.names[u.Name]; ok {
+			return fmt.Errorf("Duplicate SOCKS user: '%s'", u.Name)
+		}
+		var err error
+		if u.iters, u.salt, u.key, err = parsePasswordHash(u.Password); err != nil {
+			return fmt.Errorf("SOCKS user '%s' has an invalid password: %v", u.Name, err)
+		}
+		db.names[u.Name] = u
+	}
+	return nil
+}
+
+// authenticate returns the user corresponding to the credentials, or
+// ErrAuthFailed.
+func (db *userDB) authenticate(uname, passwd []byte) (*User, error) {
+	if u, ok := db.names[string(uname)]; ok {
+		// PBKDF2 is intentionally expensive, and clients tend to open many
+		// connections with the same credentials, so successful logins are
+		// cached.
+		h := sha256.New()
+		h.Write([]byte{byte(len(uname))})
+		h.Write(uname)
+		h.Write(passwd)
+		var cacheKey [sha256.Size]byte
+		copy(cacheKey[:], h.Sum(nil))
+
+		db.cacheLock.Lock()
+		cached := db.cache[cacheKey]
+		db.cacheLock.Unlock()
+		if cached == u {
+			return u, nil
+		}
+
+		key, err := pbkdf2.Key(sha256.New, string(passwd), u.salt, u.iters, len(u.key))
+		if err != nil || subtle.ConstantTimeCompare(key, u.key) != 1 {
+			return nil, ErrAuthFailed
+		}
+
+		db.cacheLock.Lock()
+		if len(db.cache) >= maxAuthCacheEntries {
+			db.cache = make(map[[sha256.Size]byte]*User)
+		}
+		db.cache[cacheKey] = u
+		db.cacheLock.Unlock()
+		return u, nil
+	}
+
+	// Fall back to the longest matching prefix.
+	var match *User
+	for _, u := range db.prefixes {
+		if strings.HasPrefix(string(uname), u.Prefix) && (match == nil || len(u.Prefix) > len(match.Prefix)) {
+			match = u
+		}
+	}
+	if match == nil {
+		return nil, ErrAuthFailed
+	}
+	return match, nil
+}
+
+// Authenticate validates SOCKS credentials against the users file, and
+// returns the corresponding user.
+func (sCfg *SOCKSAuthCfg) Authenticate(uname, passwd []byte) (*User, error) {
+	if sCfg.users == nil {
+		panic("BUG: sCfg.users == nil")
+	}
+	return sCfg.users.authenticate(uname, passwd)
+}
+
+// HashPassword hashes a password in the format used by the users file.
+func HashPassword(passwd string) (string, error) {
+	salt := make([]byte, passwordSaltLen)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	key, err := pbkdf2.Key(sha256.New, passwd, salt, passwordHashIters, passwordKeyLen)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%s$%d$%s$%s", passwordHashScheme, passwordHashIters, passwdEncoding.EncodeToString(salt), passwdEncoding.EncodeToString(key)), nil
+}
+
+func parsePasswordHash(s string) (iters int, salt, key []byte, err error) {
+	// The hash looks like: "pbkdf2-sha256$<iterations>$<salt>$<key>", with
+	// the salt and key base64 encoded (no padding).
+	parts := strings.Split(s, "$")
+	if len(parts) != 4 || parts[0] != passwordHashScheme {
+		return 0, nil, nil, fmt.Errorf("unsupported password hash format")
+	}
+	if iters, err = strconv.Atoi(parts[1]); err != nil || iters < 1 {
+		return 0, nil, nil, fmt.Errorf("invalid iteration count: '%s'", parts[1])
+	}
+	if salt, err = passwdEncoding.DecodeString(parts[2]); err != nil {
+		return 0, nil, nil, fmt.Errorf("invalid salt: %v", err)
+	}
+	if key, err = passwdEncoding.DecodeString(parts[3]); err != nil || len(key) == 0 {
+		return 0, nil, nil, fmt.Errorf("invalid key")
+	}
+	return iters, salt, key, nil
+}
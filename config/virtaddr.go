@@ -0,0 +1,86 @@
+/*
+ * virtaddr.go - or-ctl-filter virtual address configuration.
+ *
+ * To the extent possible under law, Yawning Angel has waived all copyright and
+ * related or neighboring rights to or-ctl-filter, using the creative commons
+ * "cc0" public domain dedication. See LICENSE or
+ * <http://creativecommons.org/publicdomain/zero/1.0/> for full details.
+ */
+
+package config
+
+import (
+	"fmt"
+	"net"
+)
+
+// VirtualAddrCfg is the virtual address automapping configuration.  RESOLVE
+// requests for names that can not be resolved via DNS (onion and I2P
+// addresses, and names routed to I2P or a named upstream) are answered with
+// an address from the virtual network, that is mapped back to the name when
+// it is connected to.
+type VirtualAddrCfg struct {
+	Enable bool
+
+	// Network is the virtual address network (Default: "127.192.0.0/10",
+	// the same as tor's VirtualAddrNetworkIPv4).
+	Network string
+
+	// MaxEntries is the maximum number of mappings kept per isolation
+	// scope, with the least recently used mapping being evicted first
+	// (Default: 16384).
+	MaxEntries int
+
+	// TTL is how long a mapping is kept after it was last used, in seconds
+	// (Default: 1800).
+	TTL int
+
+	network *net.IPNet
+}
+
+func (vCfg *VirtualAddrCfg) validate() (err error) {
+	const (
+		defaultNetwork    = "127.192.0.0/10"
+		defaultMaxEntries = 16384
+		defaultTTL        = 1800
+
+		minHostBits = 8
+	)
+
+	if !vCfg.Enable {
+		return nil
+	}
+
+	if vCfg.Network == "" {
+		vCfg.Network = defaultNetwork
+	}
+	if _, vCfg.network, err = net.ParseCIDR(vCfg.Network); err != nil {
+		return fmt.Errorf("Invalid VirtualAddr Network: %v", err)
+	}
+	if ones, bits := vCfg.network.Mask.Size(); bits-ones < minHostBits {
+		return fmt.Errorf("VirtualAddr Network is too small: '%s'", vCfg.Network)
+	}
+	if v4 := vCfg.network.IP.To4(); v4 != nil {
+		vCfg.network.IP = v4
+	}
+
+	if vCfg.MaxEntries < 0 {
+		return fmt.Errorf("Invalid VirtualAddr MaxEntries: %d", vCfg.MaxEntries)
+	} else if vCfg.MaxEntries == 0 {
+		vCfg.MaxEntries = defaultMaxEntries
+	}
+	if vCfg.TTL < 0 {
+		return fmt.Errorf("Invalid VirtualAddr TTL: %d", vCfg.TTL)
+	} else if vCfg.TTL == 0 {
+		vCfg.TTL = defaultTTL
+	}
+	return nil
+}
+
+// VirtualNetwork returns the virtual address network.
+func (vCfg *VirtualAddrCfg) VirtualNetwork() *net.IPNet {
+	if vCfg.network == nil {
+		panic("BUG: cfg.VirtualAddr.VirtualNetwork() called when virtual addresses are disabled.")
+	}
+	return vCfg.network
+}
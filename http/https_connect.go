@@ -15,6 +15,8 @@ package http
 
 import (
 	"bufio"
+	"context"
+	"encoding/base64"
 	"fmt"
 	"net"
 	"net/http"
@@ -23,12 +25,61 @@ import (
 	"time"
 )
 
+// StatusError is the error returned by Dial when the proxy responds to the
+// CONNECT request with a status other than 200.
+type StatusError struct {
+	StatusCode int
+	Status     string
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("proxy error: %s", e.Status)
+}
+
+// Dialer is a HTTP CONNECT proxy client.
+type Dialer struct {
+	// ProxyNetwork and ProxyAddress specify the HTTP CONNECT proxy.
+	ProxyNetwork string
+	ProxyAddress string
+
+	// Username and Password are the optional Basic authentication
+	// credentials.
+	Username string
+	Password string
+
+	// ProxyDial, if set, is used to connect to the proxy instead of
+	// net.Dialer.
+	ProxyDial func(ctx context.Context, network, addr string) (net.Conn, error)
+}
+
 // Dial dials the requested destination via the provided HTTP CONNECT proxy.
 func Dial(proxyNet, proxyAddr, targetAddr string) (net.Conn, error) {
-	c, err := net.Dial(proxyNet, proxyAddr)
+	d := &Dialer{ProxyNetwork: proxyNet, ProxyAddress: proxyAddr}
+	return d.DialContext(context.Background(), "tcp", targetAddr)
+}
+
+// DialContext dials the requested destination via the proxy, using the
+// provided context.  Only TCP is supported.
+func (d *Dialer) DialContext(ctx context.Context, network, targetAddr string) (net.Conn, error) {
+	switch network {
+	case "tcp", "tcp4", "tcp6":
+	default:
+		return nil, &net.OpError{Op: "dial", Net: network, Err: fmt.Errorf("unsupported network: %s", network)}
+	}
+
+	proxyDial := d.ProxyDial
+	if proxyDial == nil {
+		var nd net.Dialer
+		proxyDial = nd.DialContext
+	}
+	c, err := proxyDial(ctx, d.ProxyNetwork, d.ProxyAddress)
 	if err != nil {
 		return nil, err
 	}
+	if deadline, ok := ctx.Deadline(); ok {
+		c.SetDeadline(deadline)
+		defer c.SetDeadline(time.Time{})
+	}
 
 	conn := new(httpConn)
 	conn.httpConn = httputil.NewClientConn(c, nil)
@@ -49,15 +100,22 @@ func Dial(proxyNet, proxyAddr, targetAddr string) (net.Conn, error) {
 	}
 	hReq.Close = false
 	hReq.Header.Set("User-Agent", "")
+	if d.Username != "" || d.Password != "" {
+		cred := base64.StdEncoding.EncodeToString([]byte(d.Username + ":" + d.Password))
+		hReq.Header.Set("Proxy-Authorization", "Basic "+cred)
+	}
 
 	resp, err := conn.httpConn.Do(hReq)
 	if err != nil && err != httputil.ErrPersistEOF {
 		conn.httpConn.Close()
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
 		return nil, err
 	}
 	if resp.StatusCode != 200 {
 		conn.httpConn.Close()
-		return nil, fmt.Errorf("proxy error: %s", resp.Status)
+		return nil, &StatusError{StatusCode: resp.StatusCode, Status: resp.Status}
 	}
 
 	conn.hijackedConn, conn.staleReader = conn.httpConn.Hijack()
@@ -14,10 +14,19 @@
 package main
 
 import (
+	"bufio"
 	"flag"
+	"fmt"
+	"io"
 	"log"
+	"os"
+	"os/signal"
+	"strings"
 	"sync"
+	"syscall"
+	"time"
 
+	"github.com/yawning/or-ctl-filter/audit"
 	"github.com/yawning/or-ctl-filter/config"
 	"github.com/yawning/or-ctl-filter/proxy"
 	"github.com/yawning/or-ctl-filter/tor"
@@ -27,13 +36,52 @@ const defaultConfigFile = "or-ctl-filter.toml"
 
 func main() {
 	cfgFile := flag.String("config", defaultConfigFile, "config file")
+	hashPasswd := flag.Bool("hash-password", false, "hash a SOCKS password read from stdin, and exit")
 	flag.Parse()
 
+	if *hashPasswd {
+		passwd, err := bufio.NewReader(os.Stdin).ReadString('\n')
+		if err != nil && err != io.EOF {
+			log.Fatalf("Failed to read password: %v", err)
+		}
+		h, err := config.HashPassword(strings.TrimRight(passwd, "\r\n"))
+		if err != nil {
+			log.Fatalf("Failed to hash password: %v", err)
+		}
+		fmt.Println(h)
+		return
+	}
+
 	cfg, err := config.Load(*cfgFile)
 	if err != nil {
 		log.Fatalf("%v", err)
 	}
 
+	if err = audit.Init(cfg); err != nil {
+		log.Fatalf("%v", err)
+	}
+
+	// Launch the managed tor instance if configured to do so.
+	if cfg.Tor.Enable && cfg.Tor.Managed.Enable {
+		if err = tor.InitManagedTor(cfg); err != nil {
+			log.Fatalf("%v", err)
+		}
+	}
+
+	// Start checking the health of the upstreams.
+	proxy.InitHealthChecker(cfg)
+
+	// Hold requests via tor until it has bootstrapped, if configured to.
+	proxy.InitBootstrapGate(cfg)
+
+	// Log the health of the upstreams, and the SafeSocks counters on SIGUSR1.
+	go logStats()
+
+	// Reload the petname address book on SIGHUP.
+	if cfg.Petnames.Enable {
+		go reloadPetnames(cfg)
+	}
+
 	// Initialize the various listeners.
 	var wg sync.WaitGroup
 	tor.InitCtlListener(cfg, &wg)
@@ -41,3 +89,31 @@ func main() {
 
 	wg.Wait()
 }
+
+func reloadPetnames(cfg *config.Config) {
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, syscall.SIGHUP)
+	for range sigChan {
+		if err := cfg.Petnames.Reload(); err != nil {
+			log.Printf("ERR/socks: Failed to reload petnames, keeping the old address book: %v", err)
+			continue
+		}
+		log.Printf("INFO/socks: Reloaded petnames")
+	}
+}
+
+func logStats() {
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, syscall.SIGUSR1)
+	for range sigChan {
+		ss := proxy.SafeSocksStats()
+		log.Printf("INFO/socks: SafeSocks: %d warned, %d rejected, %d allowed (Resolved)", ss.Warned, ss.Rejected, ss.AllowedResolved)
+		for _, st := range proxy.UpstreamStatuses() {
+			if st.Healthy {
+				log.Printf("INFO/socks: Upstream '%s' is healthy (Last check: %s)", st.Name, st.LastCheck.Format(time.RFC3339))
+			} else {
+				log.Printf("WARN/socks: Upstream '%s' is unhealthy (Last check: %s): %v", st.Name, st.LastCheck.Format(time.RFC3339), st.Err)
+			}
+		}
+	}
+}
@@ -0,0 +1,196 @@
+/*
+ * bootstrap.go - or-ctl-filter tor bootstrap gate.
+ *
+ * To the extent possible under law, Yawning Angel has waived all copyright and
+ * related or neighboring rights to or-ctl-filter, using the creative commons
+ * "cc0" public domain dedication. See LICENSE or
+ * <http://creativecommons.org/publicdomain/zero/1.0/> for full details.
+ */
+
+package proxy
+
+import (
+	"context"
+	"errors"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/yawning/bulb"
+	"github.com/yawning/or-ctl-filter/config"
+)
+
+// bootstrapPollInterval is how often the tor instances are polled while the
+// bootstrap gate is closed.
+const bootstrapPollInterval = time.Second
+
+var errBootstrapTimedOut = errors.New("timed out waiting for tor to bootstrap")
+
+// bootstrapGate holds requests that are bound for tor until tor has
+// established a circuit.  Once open, the gate stays open, and the health
+// checker takes over dealing with tor becoming unusable.
+type bootstrapGate struct {
+	sync.Mutex
+	open    bool
+	waiters []chan struct{}
+
+	timeout time.Duration
+}
+
+// torGate is the bootstrap gate, or nil if the gate is disabled.
+var torGate *bootstrapGate
+
+// InitBootstrapGate starts watching the tor instances for bootstrap progress,
+// if the bootstrap gate is enabled.
+func InitBootstrapGate(cfg *config.Config) {
+	if !cfg.Tor.Enable || !cfg.Tor.BootstrapGate {
+		return
+	}
+
+	torGate = &bootstrapGate{
+		timeout: time.Duration(cfg.Tor.BootstrapGateTimeout) * time.Second,
+	}
+	go torGate.watch(cfg)
+}
+
+// waitForTor holds a request that is bound for tor until tor has
+// bootstrapped, and fails it immediately if tor is unhealthy.  Every path
+// that dials tor's SOCKS port on behalf of a client goes through here.
+func (s *session) waitForTor() error {
+	if torGate != nil {
+		if err := torGate.wait(s.ctx); err != nil {
+			log.Printf("ERR/socks: Tor has not bootstrapped: %v", err)
+			return err
+		}
+	}
+	if !torIsHealthy(s.cfg) {
+		log.Printf("ERR/socks: Tor is unhealthy")
+		return errUnhealthy
+	}
+	return nil
+}
+
+// wait blocks until the gate is open, the gate timeout expires, or ctx is
+// done.  Once the gate opens, the waiters are woken one at a time, each
+// waking the next, so that requests are released in the order they arrived.
+func (g *bootstrapGate) wait(ctx context.Context) error {
+	g.Lock()
+	if g.open && len(g.waiters) == 0 {
+		g.Unlock()
+		return nil
+	}
+	ch := make(chan struct{})
+	g.waiters = append(g.waiters, ch)
+	g.Unlock()
+
+	timer := time.NewTimer(g.timeout)
+	defer timer.Stop()
+
+	var err error
+	select {
+	case <-ch:
+	case <-timer.C:
+		err = errBootstrapTimedOut
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+
+	g.Lock()
+	defer g.Unlock()
+	for i, w := range g.waiters {
+		if w == ch {
+			g.waiters = append(g.waiters[:i], g.waiters[i+1:]...)
+			if i == 0 && g.open && len(g.waiters) > 0 {
+				close(g.waiters[0])
+			}
+			break
+		}
+	}
+	if g.open {
+		// Released, even if the timeout raced the release.
+		return nil
+	}
+	return err
+}
+
+func (g *bootstrapGate) release() {
+	g.Lock()
+	defer g.Unlock()
+
+	g.open = true
+	if len(g.waiters) > 0 {
+		close(g.waiters[0])
+	}
+}
+
+func (g *bootstrapGate) watch(cfg *config.Config) {
+	log.Printf("INFO/socks: Holding Tor requests until tor has bootstrapped")
+
+	lastPhase := make(map[*config.TorInstanceCfg]string)
+	for {
+		for _, inst := range cfg.Tor.Instances() {
+			var phase string
+			ctx, cancel := context.WithTimeout(context.Background(), healthCheckTimeout)
+			err := runProbe(ctx, func(ctx context.Context) (err error) {
+				phase, err = probeBootstrap(ctx, inst)
+				return
+			})
+			cancel()
+
+			if err == errHealthCheckTimedOut {
+				// The probe may still be running, so phase is off limits.
+				continue
+			}
+			if phase != "" && phase != lastPhase[inst] {
+				log.Printf("INFO/socks: Tor instance %v: %s", inst, phase)
+				lastPhase[inst] = phase
+			}
+			if err == nil {
+				log.Printf("INFO/socks: Tor instance %v has bootstrapped, releasing held requests", inst)
+				reportHealth(torHealthName(inst), nil)
+				g.release()
+				return
+			}
+		}
+		time.Sleep(bootstrapPollInterval)
+	}
+}
+
+// probeBootstrap queries the instance's bootstrap phase, and returns nil iff
+// the instance has established a circuit.
+func probeBootstrap(ctx context.Context, inst *config.TorInstanceCfg) (string, error) {
+	const (
+		keyBootstrapPhase     = "status/bootstrap-phase"
+		keyCircuitEstablished = "status/circuit-established"
+	)
+
+	conn, err := bulb.Dial(inst.ControlNetAddr())
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+	go func() {
+		<-ctx.Done()
+		conn.Close()
+	}()
+
+	if err = conn.Authenticate(""); err != nil {
+		return "", err
+	}
+	resp, err := conn.Request("GETINFO " + keyBootstrapPhase + " " + keyCircuitEstablished)
+	if err != nil {
+		return "", err
+	}
+
+	var phase string
+	err = errCircuitsNotBuilt
+	for _, line := range resp.Data {
+		if strings.HasPrefix(line, keyBootstrapPhase+"=") {
+			phase = strings.TrimPrefix(line, keyBootstrapPhase+"=")
+		} else if line == keyCircuitEstablished+"=1" {
+			err = nil
+		}
+	}
+	return phase, err
+}
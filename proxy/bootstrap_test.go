@@ -0,0 +1,182 @@
+/*
+ * bootstrap_test.go - or-ctl-filter tor bootstrap gate tests.
+ *
+ * To the extent possible under law, Yawning Angel has waived all copyright and
+ * related or neighboring rights to or-ctl-filter, using the creative commons
+ * "cc0" public domain dedication. See LICENSE or
+ * <http://creativecommons.org/publicdomain/zero/1.0/> for full details.
+ */
+
+package proxy
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/yawning/or-ctl-filter/socks5"
+)
+
+const testTorConfig = `[Tor]
+Enable = true
+SOCKSAddress = "tcp://127.0.0.1:9050"
+`
+
+type waitResult struct {
+	id  int
+	err error
+}
+
+// startWaiter calls g.wait in the background, once the previous waiters are
+// queued, and sends id and the result on doneChan when it returns.
+func startWaiter(t *testing.T, g *bootstrapGate, ctx context.Context, id int, doneChan chan<- waitResult) {
+	g.Lock()
+	nrWaiters := len(g.waiters)
+	g.Unlock()
+
+	go func() {
+		err := g.wait(ctx)
+		doneChan <- waitResult{id, err}
+	}()
+
+	// Wait for the waiter to be queued, so that the arrival order is known.
+	for start := time.Now(); time.Since(start) < 5*time.Second; time.Sleep(time.Millisecond) {
+		g.Lock()
+		n := len(g.waiters)
+		g.Unlock()
+		if n > nrWaiters {
+			return
+		}
+	}
+	t.Fatalf("Waiter %d was not queued", id)
+}
+
+func isClosed(ch chan struct{}) bool {
+	select {
+	case <-ch:
+		return true
+	default:
+		return false
+	}
+}
+
+func TestBootstrapGateFIFO(t *testing.T) {
+	const nrWaiters = 8
+
+	g := &bootstrapGate{timeout: time.Minute}
+	doneChan := make(chan waitResult, nrWaiters+1)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// Waiters are queued in the order they arrived, and a canceled waiter
+	// leaves the queue.
+	canceledCtx, cancelWaiter := context.WithCancel(context.Background())
+	startWaiter(t, g, ctx, 0, doneChan)
+	startWaiter(t, g, canceledCtx, -1, doneChan)
+	for i := 1; i < nrWaiters; i++ {
+		startWaiter(t, g, ctx, i, doneChan)
+	}
+	g.Lock()
+	queued := append([]chan struct{}{}, g.waiters...)
+	g.Unlock()
+	cancelWaiter()
+	if r := <-doneChan; r.id != -1 || r.err != context.Canceled {
+		t.Fatalf("Canceled waiter = %+v, expected -1 with context.Canceled", r)
+	}
+	queued = append(queued[:1], queued[2:]...)
+	g.Lock()
+	for i, ch := range g.waiters {
+		if ch != queued[i] {
+			t.Errorf("Waiter %d is out of order", i)
+		}
+	}
+	g.Unlock()
+
+	// Nothing is released until the gate opens.
+	select {
+	case r := <-doneChan:
+		t.Fatalf("Waiter %d released before the gate opened", r.id)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	// Opening the gate only wakes the oldest waiter, which wakes the next
+	// one once it has left the queue, and so on.
+	q := &bootstrapGate{timeout: time.Minute, waiters: []chan struct{}{make(chan struct{}), make(chan struct{})}}
+	q.release()
+	if !isClosed(q.waiters[0]) || isClosed(q.waiters[1]) {
+		t.Errorf("release() did not wake only the oldest waiter")
+	}
+	q = &bootstrapGate{timeout: time.Minute}
+	qDoneChan := make(chan waitResult, 1)
+	startWaiter(t, q, ctx, 0, qDoneChan)
+	next := make(chan struct{})
+	q.Lock()
+	q.waiters = append(q.waiters, next)
+	q.Unlock()
+	q.release()
+	if r := <-qDoneChan; r.err != nil || !isClosed(next) {
+		t.Errorf("Released waiter = %v, did not wake the next waiter", r.err)
+	}
+
+	g.release()
+	for i := 0; i < nrWaiters; i++ {
+		select {
+		case r := <-doneChan:
+			if r.err != nil {
+				t.Errorf("Waiter %d = %v, expected no error", r.id, r.err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Only %d of %d waiters were released", i, nrWaiters)
+		}
+	}
+
+	// The gate stays open.
+	if err := g.wait(ctx); err != nil {
+		t.Errorf("wait() on an open gate = %v", err)
+	}
+	g.Lock()
+	defer g.Unlock()
+	if len(g.waiters) != 0 {
+		t.Errorf("%d waiters left in the queue", len(g.waiters))
+	}
+}
+
+func TestBootstrapGateTimeout(t *testing.T) {
+	g := &bootstrapGate{timeout: 50 * time.Millisecond}
+	start := time.Now()
+	if err := g.wait(context.Background()); err != errBootstrapTimedOut {
+		t.Errorf("wait() = %v, expected errBootstrapTimedOut", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("wait() timed out after %v, expected 50ms", elapsed)
+	}
+	if len(g.waiters) != 0 {
+		t.Errorf("Timed out waiter was left in the queue")
+	}
+
+	for _, tc := range []struct {
+		err      error
+		expected socks5.ReplyCode
+	}{
+		{errBootstrapTimedOut, socks5.ReplyTTLExpired},
+		{errUnhealthy, socks5.ReplyNetworkUnreachable},
+	} {
+		if code := errorToReplyCode(tc.err); code != tc.expected {
+			t.Errorf("errorToReplyCode(%v) = %d, expected %d", tc.err, code, tc.expected)
+		}
+	}
+
+	// Requests bound for tor are failed with TTL expired if tor does not
+	// bootstrap in time.
+	torGate = g
+	defer func() {
+		torGate = nil
+	}()
+	s, conn := newTestSession(t, loadTestConfig(t, testTorConfig), "127.0.0.1:40000", "example.com:443")
+	if err := s.dispatchTorSOCKS(); err != errBootstrapTimedOut {
+		t.Errorf("dispatchTorSOCKS() = %v, expected errBootstrapTimedOut", err)
+	}
+	if conn.replyCode() != int(socks5.ReplyTTLExpired) {
+		t.Errorf("dispatchTorSOCKS() reply = %d, expected ReplyTTLExpired", conn.replyCode())
+	}
+}
@@ -0,0 +1,181 @@
+/*
+ * dns.go - Minimal DNS message parsing/synthesis.
+ *
+ * To the extent possible under law, Yawning Angel has waived all copyright and
+ * related or neighboring rights to or-ctl-filter, using the creative commons
+ * "cc0" public domain dedication. See LICENSE or
+ * <http://creativecommons.org/publicdomain/zero/1.0/> for full details.
+ */
+
+package proxy
+
+import (
+	"errors"
+	"net"
+	"strconv"
+	"strings"
+)
+
+const (
+	dnsHeaderLen = 12
+
+	dnsTypeA    = 1
+	dnsTypePTR  = 12
+	dnsTypeAAAA = 28
+	dnsClassIN  = 1
+
+	dnsRcodeNoError  = 0
+	dnsRcodeServFail = 2
+	dnsRcodeNXDomain = 3
+	dnsRcodeNotImp   = 4
+	dnsRcodeRefused  = 5
+
+	dnsAnswerTTL = 60
+
+	// Flags.
+	dnsFlagQR = 1 << 15
+	dnsFlagRD = 1 << 8
+	dnsFlagRA = 1 << 7
+
+	dnsOpcodeMask = 0xf << 11
+)
+
+var errDNSMalformed = errors.New("malformed DNS query")
+
+// dnsQuery is a parsed single-question DNS query.
+type dnsQuery struct {
+	id       uint16
+	flags    uint16
+	name     string
+	qtype    uint16
+	qclass   uint16
+	question []byte
+}
+
+func parseDNSQuery(b []byte) (*dnsQuery, error) {
+	if len(b) < dnsHeaderLen {
+		return nil, errDNSMalformed
+	}
+
+	q := new(dnsQuery)
+	q.id = uint16(b[0])<<8 | uint16(b[1])
+	q.flags = uint16(b[2])<<8 | uint16(b[3])
+	qdCount := uint16(b[4])<<8 | uint16(b[5])
+	if q.flags&dnsFlagQR != 0 || q.flags&dnsOpcodeMask != 0 || qdCount != 1 {
+		return nil, errDNSMalformed
+	}
+
+	// Parse the QNAME, which is a sequence of labels.  Compression is not
+	// allowed (or needed) in a single question query.
+	var labels []string
+	off := dnsHeaderLen
+	for {
+		if off >= len(b) {
+			return nil, errDNSMalformed
+		}
+		l := int(b[off])
+		off++
+		if l == 0 {
+			break
+		} else if l > 63 || off+l > len(b) {
+			return nil, errDNSMalformed
+		}
+		labels = append(labels, string(b[off:off+l]))
+		off += l
+	}
+	if off+4 > len(b) {
+		return nil, errDNSMalformed
+	}
+	q.qtype = uint16(b[off])<<8 | uint16(b[off+1])
+	q.qclass = uint16(b[off+2])<<8 | uint16(b[off+3])
+	q.question = b[dnsHeaderLen : off+4]
+	q.name = strings.Join(labels, ".")
+	if len(q.name) > 253 {
+		return nil, errDNSMalformed
+	}
+
+	return q, nil
+}
+
+// response synthesizes a response to the query, with the provided answers.
+// Answers must be net.IPs for A/AAAA queries, and names for PTR queries.
+func (q *dnsQuery) response(rcode int, ips []net.IP, names []string) []byte {
+	flags := dnsFlagQR | dnsFlagRA | (q.flags & dnsFlagRD) | uint16(rcode)
+
+	var answers [][]byte
+	for _, ip := range ips {
+		answers = append(answers, ip)
+	}
+	for _, n := range names {
+		answers = append(answers, encodeDNSName(n))
+	}
+
+	b := make([]byte, dnsHeaderLen, 512)
+	b[0], b[1] = byte(q.id>>8), byte(q.id)
+	b[2], b[3] = byte(flags>>8), byte(flags)
+	b[5] = 1
+	b[6], b[7] = byte(len(answers)>>8), byte(len(answers))
+	b = append(b, q.question...)
+	for _, rdata := range answers {
+		// The name is a pointer to the question name at offset 12.
+		b = append(b, 0xc0, dnsHeaderLen)
+		b = append(b, byte(q.qtype>>8), byte(q.qtype), byte(dnsClassIN>>8), byte(dnsClassIN))
+		b = append(b, 0, 0, byte(dnsAnswerTTL>>8), byte(dnsAnswerTTL))
+		b = append(b, byte(len(rdata)>>8), byte(len(rdata)))
+		b = append(b, rdata...)
+	}
+	return b
+}
+
+func encodeDNSName(name string) []byte {
+	var b []byte
+	for _, l := range strings.Split(strings.TrimSuffix(name, "."), ".") {
+		if l == "" || len(l) > 63 {
+			continue
+		}
+		b = append(b, byte(len(l)))
+		b = append(b, l...)
+	}
+	return append(b, 0)
+}
+
+// ptrNameToIP converts a "in-addr.arpa"/"ip6.arpa" PTR query name to an IP
+// address.
+func ptrNameToIP(name string) net.IP {
+	const (
+		suffixV4 = ".in-addr.arpa"
+		suffixV6 = ".ip6.arpa"
+	)
+
+	name = strings.ToLower(strings.TrimSuffix(name, "."))
+	if strings.HasSuffix(name, suffixV4) {
+		parts := strings.Split(strings.TrimSuffix(name, suffixV4), ".")
+		if len(parts) != net.IPv4len {
+			return nil
+		}
+		for i, j := 0, len(parts)-1; i < j; i, j = i+1, j-1 {
+			parts[i], parts[j] = parts[j], parts[i]
+		}
+		return net.ParseIP(strings.Join(parts, ".")).To4()
+	} else if strings.HasSuffix(name, suffixV6) {
+		nibbles := strings.Split(strings.TrimSuffix(name, suffixV6), ".")
+		if len(nibbles) != 2*net.IPv6len {
+			return nil
+		}
+		ip := make(net.IP, net.IPv6len)
+		for i, n := range nibbles {
+			v, err := strconv.ParseUint(n, 16, 4)
+			if err != nil {
+				return nil
+			}
+			idx := net.IPv6len - 1 - i/2
+			if i%2 == 0 {
+				ip[idx] |= byte(v)
+			} else {
+				ip[idx] |= byte(v) << 4
+			}
+		}
+		return ip
+	}
+	return nil
+}
@@ -0,0 +1,146 @@
+/*
+ * dns_test.go - Minimal DNS message parsing/synthesis tests.
+ *
+ * To the extent possible under law, Yawning Angel has waived all copyright and
+ * related or neighboring rights to or-ctl-filter, using the creative commons
+ * "cc0" public domain dedication. See LICENSE or
+ * <http://creativecommons.org/publicdomain/zero/1.0/> for full details.
+ */
+
+package proxy
+
+import (
+	"bytes"
+	"net"
+	"strings"
+	"testing"
+)
+
+// testDNSQuery builds a single question recursive query for name.
+func testDNSQuery(id uint16, name string, qtype uint16) []byte {
+	b := []byte{byte(id >> 8), byte(id), 0x01, 0x00, 0, 1, 0, 0, 0, 0, 0, 0}
+	b = append(b, encodeDNSName(name)...)
+	return append(b, byte(qtype>>8), byte(qtype), 0, dnsClassIN)
+}
+
+func TestParseDNSQuery(t *testing.T) {
+	b := testDNSQuery(0x1234, "www.example.com", dnsTypeAAAA)
+	q, err := parseDNSQuery(b)
+	if err != nil {
+		t.Fatalf("parseDNSQuery() failed: %v", err)
+	}
+	if q.id != 0x1234 || q.name != "www.example.com" || q.qtype != dnsTypeAAAA || q.qclass != dnsClassIN || q.flags&dnsFlagRD == 0 {
+		t.Errorf("parseDNSQuery() = %+v", q)
+	}
+	if !bytes.Equal(q.question, b[dnsHeaderLen:]) {
+		t.Errorf("parseDNSQuery().question = %v, expected %v", q.question, b[dnsHeaderLen:])
+	}
+
+	// The root name is a valid query.
+	if q, err = parseDNSQuery(testDNSQuery(1, ".", dnsTypeA)); err != nil || q.name != "" {
+		t.Errorf("parseDNSQuery(.) = %+v, %v", q, err)
+	}
+
+	longLabel := append(append([]byte{}, b[:dnsHeaderLen]...), 64)
+	longLabel = append(longLabel, strings.Repeat("a", 64)...)
+	longLabel = append(longLabel, 0, 0, dnsTypeA, 0, dnsClassIN)
+	longName := strings.Repeat(strings.Repeat("a", 63)+".", 4)
+	for _, tc := range []struct {
+		descr string
+		b     []byte
+	}{
+		{"short header", b[:dnsHeaderLen-1]},
+		{"response", append([]byte{0, 1, 0x81, 0x00}, b[4:]...)},
+		{"opcode", append([]byte{0, 1, 0x09, 0x00}, b[4:]...)},
+		{"two questions", append(append([]byte{}, b[:5]...), append([]byte{2}, b[6:]...)...)},
+		{"no questions", append(append([]byte{}, b[:5]...), append([]byte{0}, b[6:]...)...)},
+		{"long label", longLabel},
+		{"long name", testDNSQuery(1, longName, dnsTypeA)},
+		{"truncated name", b[:dnsHeaderLen+5]},
+		{"unterminated name", b[:dnsHeaderLen+17]},
+		{"truncated type", b[:len(b)-1]},
+		{"compression", append(append([]byte{}, b[:dnsHeaderLen]...), 0xc0, dnsHeaderLen, 0, dnsTypeA, 0, dnsClassIN)},
+	} {
+		if _, err = parseDNSQuery(tc.b); err != errDNSMalformed {
+			t.Errorf("parseDNSQuery() with a %s = %v, expected errDNSMalformed", tc.descr, err)
+		}
+	}
+}
+
+func TestDNSQueryResponse(t *testing.T) {
+	b := testDNSQuery(0xbeef, "example.com", dnsTypeA)
+	q, err := parseDNSQuery(b)
+	if err != nil {
+		t.Fatalf("parseDNSQuery() failed: %v", err)
+	}
+
+	// Every answer is encoded, with the name pointing at the question.
+	ips := []net.IP{net.ParseIP("192.0.2.1").To4(), net.ParseIP("192.0.2.2").To4()}
+	resp := q.response(dnsRcodeNoError, ips, nil)
+	expected := []byte{0xbe, 0xef, 0x81, 0x80, 0, 1, 0, 2, 0, 0, 0, 0}
+	expected = append(expected, b[dnsHeaderLen:]...)
+	for _, ip := range ips {
+		expected = append(expected, 0xc0, dnsHeaderLen, 0, dnsTypeA, 0, dnsClassIN, 0, 0, 0, dnsAnswerTTL, 0, 4)
+		expected = append(expected, ip...)
+	}
+	if !bytes.Equal(resp, expected) {
+		t.Errorf("response(A) = %v, expected %v", resp, expected)
+	}
+
+	// Errors have no answers, and carry the rcode.
+	resp = q.response(dnsRcodeNXDomain, nil, nil)
+	if len(resp) != len(b) || resp[3] != 0x80|dnsRcodeNXDomain || resp[6] != 0 || resp[7] != 0 {
+		t.Errorf("response(NXDOMAIN) = %v", resp)
+	}
+
+	// Queries that do not ask for recursion do not get RD set.
+	b[2] = 0
+	if q, err = parseDNSQuery(b); err != nil {
+		t.Fatalf("parseDNSQuery() failed: %v", err)
+	}
+	if resp = q.response(dnsRcodeRefused, nil, nil); resp[2] != 0x80 || resp[3] != 0x80|dnsRcodeRefused {
+		t.Errorf("response() without RD = %v", resp)
+	}
+
+	// PTR answers are encoded names.
+	b = testDNSQuery(1, "1.2.0.192.in-addr.arpa", dnsTypePTR)
+	if q, err = parseDNSQuery(b); err != nil {
+		t.Fatalf("parseDNSQuery() failed: %v", err)
+	}
+	resp = q.response(dnsRcodeNoError, nil, []string{"host.example."})
+	rdata := []byte{4, 'h', 'o', 's', 't', 7, 'e', 'x', 'a', 'm', 'p', 'l', 'e', 0}
+	if !bytes.HasSuffix(resp, append([]byte{0, byte(len(rdata))}, rdata...)) || resp[7] != 1 {
+		t.Errorf("response(PTR) = %v", resp)
+	}
+}
+
+func TestPtrNameToIP(t *testing.T) {
+	v6Name := "1.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.8.b.d.0.1.0.0.2.ip6.arpa"
+	for _, tc := range []struct {
+		name     string
+		expected string
+	}{
+		{"1.2.0.192.in-addr.arpa", "192.0.2.1"},
+		{"1.2.0.192.IN-ADDR.ARPA.", "192.0.2.1"},
+		{v6Name, "2001:db8::1"},
+		{strings.ToUpper(v6Name) + ".", "2001:db8::1"},
+
+		// Malformed names.
+		{"2.0.192.in-addr.arpa", ""},
+		{"1.1.2.0.192.in-addr.arpa", ""},
+		{"256.2.0.192.in-addr.arpa", ""},
+		{"0." + v6Name, ""},
+		{"10.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.8.b.d.0.1.0.0.2.ip6.arpa", ""},
+		{"g.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.8.b.d.0.1.0.0.2.ip6.arpa", ""},
+		{"example.com", ""},
+	} {
+		ip := ptrNameToIP(tc.name)
+		if tc.expected == "" {
+			if ip != nil {
+				t.Errorf("ptrNameToIP('%s') = %v, expected nil", tc.name, ip)
+			}
+		} else if !ip.Equal(net.ParseIP(tc.expected)) {
+			t.Errorf("ptrNameToIP('%s') = %v, expected %s", tc.name, ip, tc.expected)
+		}
+	}
+}
@@ -0,0 +1,275 @@
+/*
+ * health.go - or-ctl-filter upstream health checking.
+ *
+ * To the extent possible under law, Yawning Angel has waived all copyright and
+ * related or neighboring rights to or-ctl-filter, using the creative commons
+ * "cc0" public domain dedication. See LICENSE or
+ * <http://creativecommons.org/publicdomain/zero/1.0/> for full details.
+ */
+
+package proxy
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/yawning/bulb"
+	"github.com/yawning/or-ctl-filter/config"
+	"github.com/yawning/or-ctl-filter/socks5"
+)
+
+// healthCheckTimeout bounds how long a single health check may take.
+const healthCheckTimeout = 10 * time.Second
+
+const (
+	healthNameI2PHTTP  = "i2p-http"
+	healthNameI2PHTTPS = "i2p-https"
+)
+
+var (
+	errUnhealthy           = errors.New("upstream is unhealthy")
+	errCircuitsNotBuilt    = errors.New("tor has not established a circuit")
+	errHealthCheckTimedOut = errors.New("health check timed out")
+)
+
+// UpstreamStatus is the health of an upstream, as of the most recent check.
+type UpstreamStatus struct {
+	Name      string
+	Healthy   bool
+	LastCheck time.Time
+	Err       error
+}
+
+type healthCheck struct {
+	probe    func(ctx context.Context) error
+	onResult func(healthy bool)
+
+	status UpstreamStatus
+}
+
+var healthChecks struct {
+	sync.Mutex
+	checks map[string]*healthCheck
+}
+
+// InitHealthChecker starts the background health checks of each upstream,
+// if enabled.
+func InitHealthChecker(cfg *config.Config) {
+	if !cfg.HealthCheck.Enable {
+		return
+	}
+
+	checks := make(map[string]*healthCheck)
+	add := func(name string, probe func(context.Context) error, onResult func(bool)) {
+		checks[name] = &healthCheck{
+			probe:    probe,
+			onResult: onResult,
+			status:   UpstreamStatus{Name: name, Healthy: true},
+		}
+	}
+	if cfg.Tor.Enable {
+		for _, inst := range cfg.Tor.Instances() {
+			inst := inst
+			add(torHealthName(inst), func(ctx context.Context) error {
+				return probeTor(ctx, inst)
+			}, func(healthy bool) {
+				inst.SetHealthy(healthy)
+				if healthy {
+					inst.MarkUp()
+				}
+			})
+		}
+	}
+	if cfg.I2P.Enable {
+		add(healthNameI2PHTTP, func(ctx context.Context) error {
+			pNet, pAddr := cfg.I2P.HTTPNetAddr()
+			return probeTCP(ctx, pNet, pAddr)
+		}, nil)
+		add(healthNameI2PHTTPS, func(ctx context.Context) error {
+			pNet, pAddr := cfg.I2P.HTTPSNetAddr()
+			return probeTCP(ctx, pNet, pAddr)
+		}, nil)
+	}
+	for _, u := range cfg.Upstream {
+		u := u
+		add(upstreamHealthName(u), func(ctx context.Context) error {
+			return probeUpstream(ctx, cfg, u)
+		}, nil)
+	}
+
+	healthChecks.Lock()
+	healthChecks.checks = checks
+	healthChecks.Unlock()
+
+	interval := time.Duration(cfg.HealthCheck.Interval) * time.Second
+	for name, hc := range checks {
+		go hc.run(name, interval)
+	}
+}
+
+func (hc *healthCheck) run(name string, interval time.Duration) {
+	for {
+		ctx, cancel := context.WithTimeout(context.Background(), healthCheckTimeout)
+		err := runProbe(ctx, hc.probe)
+		cancel()
+
+		hc.update(name, err)
+		time.Sleep(interval)
+	}
+}
+
+func (hc *healthCheck) update(name string, err error) {
+	healthChecks.Lock()
+	wasHealthy := hc.status.Healthy
+	hc.status.Healthy = err == nil
+	hc.status.LastCheck = time.Now()
+	hc.status.Err = err
+	healthChecks.Unlock()
+
+	if hc.onResult != nil {
+		hc.onResult(err == nil)
+	}
+	if err != nil && wasHealthy {
+		log.Printf("WARN/socks: Upstream '%s' is unhealthy: %v", name, err)
+	} else if err == nil && !wasHealthy {
+		log.Printf("INFO/socks: Upstream '%s' is healthy", name)
+	}
+}
+
+// reportHealth records the result of a check of the named upstream that was
+// done outside of the health checker.
+func reportHealth(name string, err error) {
+	healthChecks.Lock()
+	hc, ok := healthChecks.checks[name]
+	healthChecks.Unlock()
+	if ok {
+		hc.update(name, err)
+	}
+}
+
+// runProbe runs probe, giving up when ctx is done, even if the probe does
+// not honor the context.
+func runProbe(ctx context.Context, probe func(context.Context) error) error {
+	errChan := make(chan error, 1)
+	go func() {
+		errChan <- probe(ctx)
+	}()
+	select {
+	case err := <-errChan:
+		return err
+	case <-ctx.Done():
+		return errHealthCheckTimedOut
+	}
+}
+
+// isHealthy returns false iff the named upstream failed its most recent
+// health check.  Upstreams that are not checked are always healthy.
+func isHealthy(name string) bool {
+	healthChecks.Lock()
+	defer healthChecks.Unlock()
+
+	if hc, ok := healthChecks.checks[name]; ok {
+		return hc.status.Healthy
+	}
+	return true
+}
+
+// UpstreamStatuses returns the health of each upstream, sorted by name.  If
+// health checking is disabled, nil is returned.
+func UpstreamStatuses() []UpstreamStatus {
+	healthChecks.Lock()
+	defer healthChecks.Unlock()
+
+	var ret []UpstreamStatus
+	for _, hc := range healthChecks.checks {
+		ret = append(ret, hc.status)
+	}
+	sort.Slice(ret, func(i, j int) bool { return ret[i].Name < ret[j].Name })
+	return ret
+}
+
+// torIsHealthy returns false iff every tor instance failed its most recent
+// health check.
+func torIsHealthy(cfg *config.Config) bool {
+	for _, inst := range cfg.Tor.Instances() {
+		if inst.IsHealthy() {
+			return true
+		}
+	}
+	return false
+}
+
+func torHealthName(inst *config.TorInstanceCfg) string {
+	return "tor:" + inst.String()
+}
+
+func upstreamHealthName(u *config.UpstreamCfg) string {
+	return "upstream:" + u.Name
+}
+
+func probeTor(ctx context.Context, inst *config.TorInstanceCfg) error {
+	const keyCircuitEstablished = "status/circuit-established"
+
+	conn, err := bulb.Dial(inst.ControlNetAddr())
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	go func() {
+		// bulb has no way to bound a request, so close the connection to
+		// abort the check if it takes too long.
+		<-ctx.Done()
+		conn.Close()
+	}()
+
+	if err = conn.Authenticate(""); err != nil {
+		return err
+	}
+	resp, err := conn.Request("GETINFO " + keyCircuitEstablished)
+	if err != nil {
+		return err
+	}
+	for _, line := range resp.Data {
+		if line == keyCircuitEstablished+"=1" {
+			return nil
+		}
+	}
+	return errCircuitsNotBuilt
+}
+
+func probeTCP(ctx context.Context, network, addr string) error {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, network, addr)
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
+
+// probeUpstream checks a named upstream, by completing the SOCKS5 handshake,
+// or connecting to the HTTP CONNECT proxy, via the upstream's chain.
+func probeUpstream(ctx context.Context, cfg *config.Config, u *config.UpstreamCfg) error {
+	var torDial dialFunc
+	if rootUpstream(u).Via == config.UpstreamViaTor {
+		inst := cfg.Tor.PickInstances(nil)[0]
+		pNet, pAddr := inst.SOCKSNetAddr()
+		d := &socks5.Dialer{ProxyNetwork: pNet, ProxyAddress: pAddr}
+		torDial = d.DialContext
+	}
+
+	proxyDial := upstreamProxyDial(u, torDial)
+	if u.Type == config.UpstreamTypeSOCKS5 {
+		return upstreamSOCKSDialer(u, proxyDial).Probe(ctx)
+	}
+	pNet, pAddr := u.NetAddr()
+	conn, err := proxyDial(ctx, pNet, pAddr)
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
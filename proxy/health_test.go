@@ -0,0 +1,248 @@
+/*
+ * health_test.go - or-ctl-filter upstream health checking tests.
+ *
+ * To the extent possible under law, Yawning Angel has waived all copyright and
+ * related or neighboring rights to or-ctl-filter, using the creative commons
+ * "cc0" public domain dedication. See LICENSE or
+ * <http://creativecommons.org/publicdomain/zero/1.0/> for full details.
+ */
+
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/yawning/or-ctl-filter/socks5"
+)
+
+func resetHealthChecks() {
+	healthChecks.Lock()
+	defer healthChecks.Unlock()
+
+	healthChecks.checks = nil
+}
+
+// closedAddr returns the address of a TCP port that nothing listens on.
+func closedAddr(t *testing.T) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+	return addr
+}
+
+// nullHandler is a socks5.Handler that rejects every request.
+type nullHandler struct{}
+
+func (h *nullHandler) Connect(ctx context.Context, conn net.Conn, req *socks5.Request) {
+	req.Reply(socks5.ReplyConnectionNotAllowed)
+}
+
+func (h *nullHandler) Resolve(ctx context.Context, conn net.Conn, req *socks5.Request) {
+	req.Reply(socks5.ReplyConnectionNotAllowed)
+}
+
+func TestHealthCheckUpdate(t *testing.T) {
+	resetHealthChecks()
+	defer resetHealthChecks()
+
+	var results []bool
+	const name = "upstream:test"
+	hc := &healthCheck{
+		onResult: func(healthy bool) { results = append(results, healthy) },
+		status:   UpstreamStatus{Name: name, Healthy: true},
+	}
+	healthChecks.checks = map[string]*healthCheck{
+		name:            hc,
+		"i2p-http":      {status: UpstreamStatus{Name: "i2p-http", Healthy: true}},
+		"tor:127.0.0.1": {status: UpstreamStatus{Name: "tor:127.0.0.1", Healthy: true}},
+	}
+
+	// Upstreams that are not checked are always healthy.
+	if !isHealthy("upstream:unchecked") {
+		t.Errorf("isHealthy() for an unchecked upstream = false")
+	}
+	reportHealth("upstream:unchecked", errors.New("failed"))
+
+	checkErr := errors.New("connection refused")
+	for i, tc := range []struct {
+		err      error
+		reported bool
+	}{
+		{checkErr, false},
+		{checkErr, true},
+		{nil, false},
+		{nil, true},
+		{checkErr, true},
+	} {
+		before := time.Now()
+		if tc.reported {
+			reportHealth(name, tc.err)
+		} else {
+			hc.update(name, tc.err)
+		}
+		if isHealthy(name) != (tc.err == nil) {
+			t.Errorf("Check %d: isHealthy() = %v, expected %v", i, !(tc.err == nil), tc.err == nil)
+		}
+		if hc.status.Err != tc.err || hc.status.LastCheck.Before(before) {
+			t.Errorf("Check %d: status = %+v", i, hc.status)
+		}
+	}
+	if fmt.Sprint(results) != "[false false true true false]" {
+		t.Errorf("onResult() was called with %v", results)
+	}
+
+	statuses := UpstreamStatuses()
+	if len(statuses) != 3 || statuses[0].Name != "i2p-http" || statuses[1].Name != "tor:127.0.0.1" || statuses[2].Name != name {
+		t.Errorf("UpstreamStatuses() = %+v, not sorted by name", statuses)
+	}
+	if statuses[2].Healthy || statuses[2].Err != checkErr {
+		t.Errorf("UpstreamStatuses() = %+v, expected '%s' to be unhealthy", statuses[2], name)
+	}
+
+	resetHealthChecks()
+	if UpstreamStatuses() != nil {
+		t.Errorf("UpstreamStatuses() with health checking disabled is not nil")
+	}
+}
+
+func TestTorIsHealthy(t *testing.T) {
+	cfg := loadTestConfig(t, testTorConfig+"\n[[Tor.Instance]]\nSOCKSAddress = \"tcp://127.0.0.1:9052\"\n")
+	insts := cfg.Tor.Instances()
+	if len(insts) != 2 {
+		t.Fatalf("Config has %d tor instances, expected 2", len(insts))
+	}
+
+	// Tor is healthy as long as one instance is.
+	if !torIsHealthy(cfg) {
+		t.Errorf("torIsHealthy() = false, with every instance healthy")
+	}
+	insts[0].SetHealthy(false)
+	if !torIsHealthy(cfg) {
+		t.Errorf("torIsHealthy() = false, with one instance healthy")
+	}
+	insts[1].SetHealthy(false)
+	if torIsHealthy(cfg) {
+		t.Errorf("torIsHealthy() = true, with every instance unhealthy")
+	}
+	s, conn := newTestSession(t, cfg, "127.0.0.1:40000", "example.com:443")
+	if err := s.dispatchTorSOCKS(); err != errUnhealthy {
+		t.Errorf("dispatchTorSOCKS() = %v, expected errUnhealthy", err)
+	}
+	if conn.replyCode() != int(socks5.ReplyNetworkUnreachable) {
+		t.Errorf("dispatchTorSOCKS() reply = %d, expected ReplyNetworkUnreachable", conn.replyCode())
+	}
+}
+
+func TestRunProbe(t *testing.T) {
+	probeErr := errors.New("probe failed")
+	stuck := make(chan struct{})
+	defer close(stuck)
+	for _, tc := range []struct {
+		probe    func(context.Context) error
+		expected error
+	}{
+		{func(context.Context) error { return nil }, nil},
+		{func(context.Context) error { return probeErr }, probeErr},
+
+		// Probes that do not honor the context are abandoned.
+		{func(context.Context) error { <-stuck; return nil }, errHealthCheckTimedOut},
+	} {
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		if err := runProbe(ctx, tc.probe); err != tc.expected {
+			t.Errorf("runProbe() = %v, expected %v", err, tc.expected)
+		}
+		cancel()
+	}
+}
+
+func TestProbeUpstream(t *testing.T) {
+	// A SOCKS5 upstream that requires authentication, an HTTP CONNECT
+	// upstream that just needs to accept connections, and one that is down.
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	srv := socks5.NewServer(&nullHandler{}, &socks5.ServerConfig{RequireAuth: true})
+	go srv.Serve(context.Background(), ln)
+	defer srv.Close()
+
+	cfg := loadTestConfig(t, fmt.Sprintf(`[[Upstream]]
+Name = "socks"
+Type = "socks5"
+Address = "tcp://%s"
+Username = "user"
+Password = "pass"
+
+[[Upstream]]
+Name = "noauth"
+Type = "socks5"
+Address = "tcp://%s"
+
+[[Upstream]]
+Name = "http"
+Type = "http-connect"
+Address = "tcp://%s"
+
+[[Upstream]]
+Name = "down"
+Type = "socks5"
+Address = "tcp://%s"
+`, ln.Addr(), ln.Addr(), ln.Addr(), closedAddr(t)))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	for i, expected := range []bool{true, false, true, false} {
+		u := cfg.Upstream[i]
+		if err = probeUpstream(ctx, cfg, u); (err == nil) != expected {
+			t.Errorf("probeUpstream(%s) = %v, expected healthy = %v", u.Name, err, expected)
+		}
+	}
+}
+
+func TestHealthChecker(t *testing.T) {
+	resetHealthChecks()
+	defer resetHealthChecks()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer ln.Close()
+
+	// The I2P HTTP proxy is up, and the HTTPS proxy is down.
+	cfg := loadTestConfig(t, fmt.Sprintf(`[HealthCheck]
+Enable = true
+Interval = 3600
+
+[I2P]
+Enable = true
+HTTPAddress = "tcp://%s"
+HTTPSAddress = "tcp://%s"
+`, ln.Addr(), closedAddr(t)))
+	InitHealthChecker(cfg)
+
+	var statuses []UpstreamStatus
+	for start := time.Now(); time.Since(start) < 5*time.Second; time.Sleep(10 * time.Millisecond) {
+		statuses = UpstreamStatuses()
+		if len(statuses) == 2 && !statuses[0].LastCheck.IsZero() && !statuses[1].LastCheck.IsZero() {
+			break
+		}
+	}
+	if len(statuses) != 2 || statuses[0].Name != healthNameI2PHTTP || statuses[1].Name != healthNameI2PHTTPS {
+		t.Fatalf("UpstreamStatuses() = %+v", statuses)
+	}
+	if !statuses[0].Healthy || statuses[1].Healthy || statuses[1].Err == nil {
+		t.Errorf("UpstreamStatuses() = %+v, expected only '%s' to be healthy", statuses, healthNameI2PHTTP)
+	}
+	if !isHealthy(healthNameI2PHTTP) || isHealthy(healthNameI2PHTTPS) {
+		t.Errorf("isHealthy() does not match the check results")
+	}
+}
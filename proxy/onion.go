@@ -0,0 +1,145 @@
+/*
+ * onion.go - or-ctl-filter onion address validation.
+ *
+ * To the extent possible under law, Yawning Angel has waived all copyright and
+ * related or neighboring rights to or-ctl-filter, using the creative commons
+ * "cc0" public domain dedication. See LICENSE or
+ * <http://creativecommons.org/publicdomain/zero/1.0/> for full details.
+ */
+
+package proxy
+
+import (
+	"bytes"
+	"crypto/sha3"
+	"encoding/base32"
+	"errors"
+	"log"
+	"net"
+	"strings"
+
+	"github.com/yawning/or-ctl-filter/config"
+	"github.com/yawning/or-ctl-filter/socks5"
+)
+
+const (
+	onionV2Len = 16
+	onionV3Len = 56
+
+	onionV3Version     = 0x03
+	onionChecksumConst = ".onion checksum"
+)
+
+var (
+	errOnionInvalid   = errors.New("invalid onion address")
+	errOnionV2        = errors.New("v2 onion addresses are no longer supported")
+	errOnionChecksum  = errors.New("invalid onion address checksum")
+	errOnionVersion   = errors.New("unsupported onion address version")
+	errOnionSubdomain = errors.New("onion address subdomains are not allowed")
+
+	onionEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+)
+
+// checkTorName validates and normalizes onion addresses, and rejects tor's
+// special hostname suffixes unless they are allowed, before the request is
+// dispatched anywhere.  On failure, the request is replied to.
+func (s *session) checkTorName() error {
+	host, port := s.req.Addr.HostPort()
+	normalized, err := s.normalizeTorName(host)
+	if err == errDstForbidden {
+		log.Printf("ERR/socks: Rejecting address: '%s' (Special suffix not allowed)", s.req.Addr.String())
+		s.req.Reply(socks5.ReplyConnectionNotAllowed)
+		return err
+	} else if err != nil {
+		log.Printf("ERR/socks: Rejecting onion address: '%s' (%v)", s.req.Addr.String(), err)
+		s.req.Reply(socks5.ReplyOnionInvalidAddress)
+		return err
+	}
+	if normalized != host {
+		if err = s.req.Addr.FromString(net.JoinHostPort(normalized, port)); err != nil {
+			// Should *NEVER* happen, the name only got shorter.
+			panic("BUG: failed to rewrite onion address: " + err.Error())
+		}
+	}
+	return nil
+}
+
+// normalizeTorName returns the normalized form of an onion address, and
+// errDstForbidden for names with one of tor's special suffixes that is not
+// allowed.  Other names are returned as is.
+func (s *session) normalizeTorName(host string) (string, error) {
+	name := strings.ToLower(strings.TrimSuffix(host, "."))
+	switch tld := name[strings.LastIndexByte(name, '.')+1:]; tld {
+	case config.SuffixExit, config.SuffixNoConnect:
+		if !s.cfg.Onion.AllowsSpecialSuffix(tld) {
+			return "", errDstForbidden
+		}
+		return host, nil
+	case "onion":
+		return normalizeOnion(name, s.cfg.Onion.Subdomains)
+	default:
+		return host, nil
+	}
+}
+
+// normalizeOnion validates a lowercased ".onion" name, and returns it with
+// the subdomain rule applied.
+func normalizeOnion(name, subdomainRule string) (string, error) {
+	labels := strings.Split(name, ".")
+	if len(labels) < 2 {
+		return "", errOnionInvalid
+	}
+	for _, l := range labels {
+		if l == "" {
+			return "", errOnionInvalid
+		}
+	}
+	addr, subdomains := labels[len(labels)-2], labels[:len(labels)-2]
+
+	switch len(addr) {
+	case onionV3Len:
+		if err := validateOnionV3(addr); err != nil {
+			return "", err
+		}
+	case onionV2Len:
+		if _, err := onionEncoding.DecodeString(strings.ToUpper(addr)); err == nil {
+			return "", errOnionV2
+		}
+		return "", errOnionInvalid
+	default:
+		return "", errOnionInvalid
+	}
+
+	if len(subdomains) > 0 {
+		switch subdomainRule {
+		case config.OnionSubdomainsStrip:
+			return addr + ".onion", nil
+		case config.OnionSubdomainsReject:
+			return "", errOnionSubdomain
+		}
+	}
+	return name, nil
+}
+
+// validateOnionV3 checks the version byte and checksum of a v3 onion address
+// (rend-spec-v3 6.): base32(PUBKEY | CHECKSUM | VERSION), where CHECKSUM is
+// the first 2 bytes of SHA3-256(".onion checksum" | PUBKEY | VERSION).
+func validateOnionV3(addr string) error {
+	raw, err := onionEncoding.DecodeString(strings.ToUpper(addr))
+	if err != nil || len(raw) != 35 {
+		return errOnionInvalid
+	}
+	pubKey, checksum, version := raw[:32], raw[32:34], raw[34]
+	if version != onionV3Version {
+		return errOnionVersion
+	}
+
+	h := sha3.New256()
+	h.Write([]byte(onionChecksumConst))
+	h.Write(pubKey)
+	h.Write([]byte{version})
+	if !bytes.Equal(h.Sum(nil)[:2], checksum) {
+		return errOnionChecksum
+	}
+	return nil
+}
@@ -0,0 +1,136 @@
+/*
+ * onion_test.go - or-ctl-filter onion address validation tests.
+ *
+ * To the extent possible under law, Yawning Angel has waived all copyright and
+ * related or neighboring rights to or-ctl-filter, using the creative commons
+ * "cc0" public domain dedication. See LICENSE or
+ * <http://creativecommons.org/publicdomain/zero/1.0/> for full details.
+ */
+
+package proxy
+
+import (
+	"crypto/sha3"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/yawning/or-ctl-filter/config"
+)
+
+const testConfigBase = `FilteredAddress = "tcp://127.0.0.1:0"
+SOCKSAddress = "tcp://127.0.0.1:0"
+UnsafeAllowDirect = true
+`
+
+// loadTestConfig loads a configuration consisting of testConfigBase and
+// extra.
+func loadTestConfig(t *testing.T, extra string) *config.Config {
+	dir, err := ioutil.TempDir("", "proxy_test")
+	if err != nil {
+		t.Fatalf("Failed to create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "config.toml")
+	if err = ioutil.WriteFile(path, []byte(testConfigBase+extra), 0600); err != nil {
+		t.Fatalf("Failed to write config: %v", err)
+	}
+	cfg, err := config.Load(path)
+	if err != nil {
+		t.Fatalf("Failed to load config: %v", err)
+	}
+	return cfg
+}
+
+// testOnionV3 encodes a v3 onion address for pubKey, with the provided
+// version byte, and a correct checksum.
+func testOnionV3(pubKey []byte, version byte) string {
+	h := sha3.New256()
+	h.Write([]byte(onionChecksumConst))
+	h.Write(pubKey)
+	h.Write([]byte{version})
+
+	raw := append(append([]byte{}, pubKey...), h.Sum(nil)[:2]...)
+	raw = append(raw, version)
+	return strings.ToLower(onionEncoding.EncodeToString(raw))
+}
+
+func TestNormalizeOnion(t *testing.T) {
+	pubKey := make([]byte, 32)
+	for i := range pubKey {
+		pubKey[i] = byte(i)
+	}
+	v3 := testOnionV3(pubKey, onionV3Version)
+
+	// Change the public key, so that the checksum no longer matches.
+	badChecksum := "b" + v3[1:]
+	if v3[0] == 'b' {
+		badChecksum = "c" + v3[1:]
+	}
+
+	for _, tc := range []struct {
+		name     string
+		rule     string
+		expected string
+		err      error
+	}{
+		{"duckduckgogg42xjoc72x3sjasowoarfbgcmvfimaftt6twagswzczad.onion", config.OnionSubdomainsKeep, "duckduckgogg42xjoc72x3sjasowoarfbgcmvfimaftt6twagswzczad.onion", nil},
+		{v3 + ".onion", config.OnionSubdomainsReject, v3 + ".onion", nil},
+
+		// Subdomain rules.
+		{"www." + v3 + ".onion", config.OnionSubdomainsKeep, "www." + v3 + ".onion", nil},
+		{"a.www." + v3 + ".onion", config.OnionSubdomainsStrip, v3 + ".onion", nil},
+		{"www." + v3 + ".onion", config.OnionSubdomainsReject, "", errOnionSubdomain},
+
+		// Malformed addresses.
+		{testOnionV3(pubKey, 0x02) + ".onion", config.OnionSubdomainsKeep, "", errOnionVersion},
+		{badChecksum + ".onion", config.OnionSubdomainsKeep, "", errOnionChecksum},
+		{"expyuzz4wqqyqhjn.onion", config.OnionSubdomainsKeep, "", errOnionV2},
+		{"expyuzz4wqqyqhj1.onion", config.OnionSubdomainsKeep, "", errOnionInvalid},
+		{v3[:55] + "1.onion", config.OnionSubdomainsKeep, "", errOnionInvalid},
+		{v3[1:] + ".onion", config.OnionSubdomainsKeep, "", errOnionInvalid},
+		{"www.." + v3 + ".onion", config.OnionSubdomainsKeep, "", errOnionInvalid},
+		{"onion", config.OnionSubdomainsKeep, "", errOnionInvalid},
+		{".onion", config.OnionSubdomainsKeep, "", errOnionInvalid},
+	} {
+		normalized, err := normalizeOnion(tc.name, tc.rule)
+		if err != tc.err || normalized != tc.expected {
+			t.Errorf("normalizeOnion('%s', %s) = '%s', %v, expected '%s', %v", tc.name, tc.rule, normalized, err, tc.expected, tc.err)
+		}
+	}
+}
+
+func TestNormalizeTorName(t *testing.T) {
+	v3 := "duckduckgogg42xjoc72x3sjasowoarfbgcmvfimaftt6twagswzczad"
+
+	for _, tc := range []struct {
+		extra    string
+		name     string
+		expected string
+		err      error
+	}{
+		// Onion addresses are normalized, everything else is left as is.
+		{"", "WWW." + strings.ToUpper(v3) + ".ONION.", "www." + v3 + ".onion", nil},
+		{"[Onion]\nSubdomains = \"strip\"\n", "www." + v3 + ".onion", v3 + ".onion", nil},
+		{"", "WWW.Example.COM.", "WWW.Example.COM.", nil},
+		{"", "192.0.2.1", "192.0.2.1", nil},
+		{"", "bad.onion", "", errOnionInvalid},
+
+		// Special suffixes are rejected unless allowed.
+		{"", "www.example.com.$ABCD.exit", "", errDstForbidden},
+		{"", "www.example.com.noconnect", "", errDstForbidden},
+		{"", "www.example.com.EXIT.", "", errDstForbidden},
+		{"[Onion]\nAllowSpecialSuffixes = [\".exit\"]\n", "www.example.com.exit", "www.example.com.exit", nil},
+		{"[Onion]\nAllowSpecialSuffixes = [\".exit\"]\n", "www.example.com.noconnect", "", errDstForbidden},
+		{"[Onion]\nAllowSpecialSuffixes = [\"exit\", \"noconnect\"]\n", "www.example.com.noconnect", "www.example.com.noconnect", nil},
+	} {
+		s := &session{cfg: loadTestConfig(t, tc.extra)}
+		normalized, err := s.normalizeTorName(tc.name)
+		if err != tc.err || normalized != tc.expected {
+			t.Errorf("normalizeTorName('%s') = '%s', %v, expected '%s', %v", tc.name, normalized, err, tc.expected, tc.err)
+		}
+	}
+}
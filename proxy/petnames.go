@@ -0,0 +1,43 @@
+/*
+ * petnames.go - or-ctl-filter petname address book.
+ *
+ * To the extent possible under law, Yawning Angel has waived all copyright and
+ * related or neighboring rights to or-ctl-filter, using the creative commons
+ * "cc0" public domain dedication. See LICENSE or
+ * <http://creativecommons.org/publicdomain/zero/1.0/> for full details.
+ */
+
+package proxy
+
+import (
+	"log"
+	"net"
+
+	"github.com/yawning/or-ctl-filter/socks5"
+)
+
+// resolvePetname rewrites the destination to the petname's destination, if
+// the destination is a petname, and returns true if it was rewritten.  Names
+// under a reserved petname suffix that are not in the address book are
+// rejected, so that they never leak to clearnet DNS.  On failure, the
+// request is replied to.
+func (s *session) resolvePetname() (bool, error) {
+	host, port := s.req.Addr.HostPort()
+	dst, ok := s.cfg.Petnames.Lookup(host)
+	if !ok {
+		if s.cfg.Petnames.IsReserved(host) {
+			log.Printf("ERR/socks: Rejecting address: '%s' (Unknown petname)", s.req.Addr.String())
+			s.req.Reply(socks5.ReplyHostUnreachable)
+			return false, errDstForbidden
+		}
+		return false, nil
+	}
+
+	if err := s.req.Addr.FromString(net.JoinHostPort(dst, port)); err != nil {
+		log.Printf("ERR/socks: Failed to rewrite petname '%s': %v", host, err)
+		s.req.Reply(socks5.ReplyGeneralFailure)
+		return false, err
+	}
+	log.Printf("INFO/socks: Petname '%s' is '%s'", host, dst)
+	return true, nil
+}
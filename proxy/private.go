@@ -0,0 +1,62 @@
+/*
+ * private.go - or-ctl-filter private destination address checks.
+ *
+ * To the extent possible under law, Yawning Angel has waived all copyright and
+ * related or neighboring rights to or-ctl-filter, using the creative commons
+ * "cc0" public domain dedication. See LICENSE or
+ * <http://creativecommons.org/publicdomain/zero/1.0/> for full details.
+ */
+
+package proxy
+
+import (
+	"errors"
+	"log"
+	"net"
+	"strings"
+	"syscall"
+
+	"github.com/yawning/or-ctl-filter/socks5"
+)
+
+var errPrivateAddr = errors.New("private destination address")
+
+// isI2PRouterAddr returns true iff the destination is one of the I2P router
+// services, which are hosted on localhost, and are protected separately.
+func (s *session) isI2PRouterAddr() bool {
+	targetStr := s.req.Addr.String()
+	return s.cfg.I2P.IsManagementAddr(targetStr) || s.cfg.I2P.IsLocalAddr(targetStr)
+}
+
+// checkPrivateAddr rejects IP address destinations that are private, and not
+// allowed, regardless of the upstream.  On failure, the request is replied
+// to.
+func (s *session) checkPrivateAddr() error {
+	host, _ := s.req.Addr.HostPort()
+	ip := net.ParseIP(strings.Trim(host, "[]"))
+	if ip == nil || s.isI2PRouterAddr() || !s.cfg.PrivateAddrs.IsForbidden(ip) {
+		return nil
+	}
+
+	log.Printf("ERR/socks: Rejecting address: '%s' (Private address)", s.req.Addr.String())
+	s.req.Reply(socks5.ReplyConnectionNotAllowed)
+	return errDstForbidden
+}
+
+// controlPrivateDial is the net.Dialer Control function for direct
+// connections, which checks the address actually being connected to, after
+// name resolution, so that names that resolve to private addresses (DNS
+// rebinding) are rejected too.
+func (s *session) controlPrivateDial(network, address string, c syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || s.isI2PRouterAddr() || !s.cfg.PrivateAddrs.IsForbidden(ip) {
+		return nil
+	}
+
+	log.Printf("ERR/socks: Rejecting address: '%s' (Resolved to private address '%s')", s.req.Addr.String(), ip)
+	return errPrivateAddr
+}
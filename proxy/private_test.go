@@ -0,0 +1,128 @@
+/*
+ * private_test.go - or-ctl-filter private destination address tests.
+ *
+ * To the extent possible under law, Yawning Angel has waived all copyright and
+ * related or neighboring rights to or-ctl-filter, using the creative commons
+ * "cc0" public domain dedication. See LICENSE or
+ * <http://creativecommons.org/publicdomain/zero/1.0/> for full details.
+ */
+
+package proxy
+
+import (
+	"errors"
+	"net"
+	"testing"
+
+	"github.com/yawning/or-ctl-filter/socks5"
+)
+
+const testAllowConfig = `[PrivateAddrs]
+Allow = [ "192.168.1.10", "10.152.152.0/24", "127.0.0.1", "::1" ]
+`
+
+func TestCheckPrivateAddr(t *testing.T) {
+	for _, tc := range []struct {
+		extra string
+		dst   string
+		ok    bool
+	}{
+		{"", "192.0.2.1:443", true},
+		{"", "[2001:db8::1]:443", true},
+		{"", "example.com:443", true},
+		{"", "localhost:443", true},
+
+		{"", "127.0.0.1:9050", false},
+		{"", "10.0.0.1:80", false},
+		{"", "172.16.0.1:80", false},
+		{"", "192.168.1.10:80", false},
+		{"", "169.254.169.254:80", false},
+		{"", "0.0.0.0:80", false},
+		{"", "[::1]:80", false},
+		{"", "[fe80::1]:80", false},
+		{"", "[fd00::1]:80", false},
+		{"", "[::ffff:127.0.0.1]:80", false},
+
+		// Allowed addresses and CIDRs.
+		{testAllowConfig, "192.168.1.10:80", true},
+		{testAllowConfig, "192.168.1.11:80", false},
+		{testAllowConfig, "10.152.152.10:80", true},
+		{testAllowConfig, "10.152.153.10:80", false},
+
+		// The I2P router services are exempt.
+		{testI2PConfig, "127.0.0.1:7657", true},
+		{testI2PConfig, "127.0.0.1:7658", false},
+	} {
+		s, conn := newTestSession(t, loadTestConfig(t, tc.extra), "127.0.0.1:40000", tc.dst)
+		err := s.checkPrivateAddr()
+		if tc.ok {
+			if err != nil || conn.replyCode() != -1 {
+				t.Errorf("checkPrivateAddr(%s) = %v, reply %d, expected success", tc.dst, err, conn.replyCode())
+			}
+		} else if err != errDstForbidden || conn.replyCode() != int(socks5.ReplyConnectionNotAllowed) {
+			t.Errorf("checkPrivateAddr(%s) = %v, reply %d, expected errDstForbidden", tc.dst, err, conn.replyCode())
+		}
+	}
+}
+
+func TestControlPrivateDial(t *testing.T) {
+	s, _ := newTestSession(t, loadTestConfig(t, ""), "127.0.0.1:40000", "rebind.example:80")
+	for _, tc := range []struct {
+		address  string
+		expected error
+	}{
+		{"192.0.2.1:80", nil},
+		{"[2001:db8::1]:80", nil},
+		{"127.0.0.1:80", errPrivateAddr},
+		{"[::1]:80", errPrivateAddr},
+		{"10.1.2.3:80", errPrivateAddr},
+	} {
+		if err := s.controlPrivateDial("tcp", tc.address, nil); err != tc.expected {
+			t.Errorf("controlPrivateDial(%s) = %v, expected %v", tc.address, err, tc.expected)
+		}
+	}
+	if err := s.controlPrivateDial("tcp", "127.0.0.1", nil); err == nil {
+		t.Errorf("controlPrivateDial() without a port succeeded")
+	}
+}
+
+func TestDispatchDirectPrivate(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+	_, port, _ := net.SplitHostPort(ln.Addr().String())
+
+	// A name passes checkPrivateAddr, but the address it resolves to is
+	// checked before connecting.
+	s, conn := newTestSession(t, loadTestConfig(t, ""), "127.0.0.1:40000", "localhost:"+port)
+	if err = s.checkPrivateAddr(); err != nil {
+		t.Fatalf("checkPrivateAddr(localhost) = %v", err)
+	}
+	if err = s.dispatchDirect(); !errors.Is(err, errPrivateAddr) {
+		t.Errorf("dispatchDirect(localhost) = %v, expected errPrivateAddr", err)
+	}
+	if conn.replyCode() != int(socks5.ReplyConnectionNotAllowed) {
+		t.Errorf("dispatchDirect(localhost) reply = %d, expected ReplyConnectionNotAllowed", conn.replyCode())
+	}
+
+	// Unless the address is allowed.
+	s, conn = newTestSession(t, loadTestConfig(t, testAllowConfig), "127.0.0.1:40000", "localhost:"+port)
+	if err = s.dispatchDirect(); err != nil {
+		t.Fatalf("dispatchDirect(localhost) with loopback allowed = %v", err)
+	}
+	s.upstreamConn.Close()
+	if conn.replyCode() != -1 {
+		t.Errorf("dispatchDirect(localhost) replied %d on success", conn.replyCode())
+	}
+}
@@ -0,0 +1,81 @@
+/*
+ * resolve.go - or-ctl-filter RESOLVE answer policy.
+ *
+ * To the extent possible under law, Yawning Angel has waived all copyright and
+ * related or neighboring rights to or-ctl-filter, using the creative commons
+ * "cc0" public domain dedication. See LICENSE or
+ * <http://creativecommons.org/publicdomain/zero/1.0/> for full details.
+ */
+
+package proxy
+
+import (
+	"bytes"
+	"net"
+	"sort"
+
+	"github.com/yawning/or-ctl-filter/config"
+)
+
+// resolvePolicy returns the RESOLVE answer policy for the session.
+func (s *session) resolvePolicy() string {
+	// SOCKS 4 can only represent IPv4 addresses.
+	if s.req.IsSOCKS4() {
+		return config.ResolvePolicyIPv4
+	}
+	if s.user != nil && s.user.RoutingProfile().ResolvePolicy != "" {
+		return s.user.RoutingProfile().ResolvePolicy
+	} else if s.ws != nil {
+		return s.cfg.Gateway.ResolvePolicy
+	}
+	return s.cfg.ResolvePolicy
+}
+
+// selectAddress picks the address to answer a RESOLVE request with from ips,
+// according to policy, or returns nil if there is no suitable address.
+func selectAddress(policy string, ips []net.IP) net.IP {
+	if selected := selectAddresses(policy, ips); len(selected) > 0 {
+		return selected[0]
+	}
+	return nil
+}
+
+// selectAddresses returns every address in ips that policy allows, most
+// preferred first, for answers that can hold multiple records.
+func selectAddresses(policy string, ips []net.IP) []net.IP {
+	var all, v4s, v6s []net.IP
+	for _, ip := range ips {
+		if v4 := ip.To4(); v4 != nil {
+			ip = v4
+			v4s = append(v4s, ip)
+		} else {
+			v6s = append(v6s, ip)
+		}
+		all = append(all, ip)
+	}
+
+	switch policy {
+	case config.ResolvePolicyIPv6:
+		return all
+	case config.ResolvePolicyPreferIPv6:
+		return append(v6s, v4s...)
+	case config.ResolvePolicyDeterministic:
+		sort.SliceStable(all, func(i, j int) bool {
+			return compareIPs(all[i], all[j]) < 0
+		})
+		return all
+	default:
+		// torsocks (at least 2.1.0) totally flips out if a non-IPv4
+		// address is returned, so only return IPv4 addresses.
+		return v4s
+	}
+}
+
+// compareIPs orders IPv4 addresses before IPv6 addresses, and addresses of
+// the same family by value.
+func compareIPs(a, b net.IP) int {
+	if len(a) != len(b) {
+		return len(a) - len(b)
+	}
+	return bytes.Compare(a, b)
+}
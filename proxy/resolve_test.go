@@ -0,0 +1,132 @@
+/*
+ * resolve_test.go - or-ctl-filter RESOLVE answer policy tests.
+ *
+ * To the extent possible under law, Yawning Angel has waived all copyright and
+ * related or neighboring rights to or-ctl-filter, using the creative commons
+ * "cc0" public domain dedication. See LICENSE or
+ * <http://creativecommons.org/publicdomain/zero/1.0/> for full details.
+ */
+
+package proxy
+
+import (
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/yawning/or-ctl-filter/config"
+	"github.com/yawning/or-ctl-filter/socks5"
+)
+
+func parseIPs(s string) []net.IP {
+	var ips []net.IP
+	for _, v := range strings.Fields(s) {
+		ip := net.ParseIP(v)
+		if v4 := ip.To4(); v4 != nil {
+			ip = v4
+		}
+		ips = append(ips, ip)
+	}
+	return ips
+}
+
+func TestSelectAddresses(t *testing.T) {
+	const answer = "2001:db8::2 192.0.2.2 2001:db8::1 ::ffff:192.0.2.1"
+	for _, tc := range []struct {
+		policy   string
+		ips      string
+		expected string
+	}{
+		{config.ResolvePolicyIPv4, answer, "192.0.2.2 192.0.2.1"},
+		{config.ResolvePolicyIPv6, answer, "2001:db8::2 192.0.2.2 2001:db8::1 192.0.2.1"},
+		{config.ResolvePolicyPreferIPv6, answer, "2001:db8::2 2001:db8::1 192.0.2.2 192.0.2.1"},
+		{config.ResolvePolicyDeterministic, answer, "192.0.2.1 192.0.2.2 2001:db8::1 2001:db8::2"},
+
+		// Answers with only one family.
+		{config.ResolvePolicyIPv4, "2001:db8::1", ""},
+		{config.ResolvePolicyIPv6, "2001:db8::1", "2001:db8::1"},
+		{config.ResolvePolicyPreferIPv6, "192.0.2.1", "192.0.2.1"},
+		{config.ResolvePolicyDeterministic, "2001:db8::2 2001:db8::1", "2001:db8::1 2001:db8::2"},
+		{config.ResolvePolicyIPv4, "", ""},
+		{config.ResolvePolicyDeterministic, "", ""},
+	} {
+		selected := selectAddresses(tc.policy, parseIPs(tc.ips))
+		if expected := parseIPs(tc.expected); !reflect.DeepEqual(selected, expected) {
+			t.Errorf("selectAddresses(%s, %s) = %v, expected %v", tc.policy, tc.ips, selected, expected)
+		}
+
+		// selectAddress is always the most preferred address.
+		var expected net.IP
+		if ips := parseIPs(tc.expected); len(ips) > 0 {
+			expected = ips[0]
+		}
+		if ip := selectAddress(tc.policy, parseIPs(tc.ips)); !ip.Equal(expected) {
+			t.Errorf("selectAddress(%s, %s) = %v, expected %v", tc.policy, tc.ips, ip, expected)
+		}
+	}
+
+	// The deterministic choice does not depend on the answer order.
+	a := selectAddress(config.ResolvePolicyDeterministic, parseIPs("192.0.2.9 192.0.2.3 2001:db8::1"))
+	b := selectAddress(config.ResolvePolicyDeterministic, parseIPs("2001:db8::1 192.0.2.3 192.0.2.9"))
+	if !a.Equal(b) || !a.Equal(net.ParseIP("192.0.2.3")) {
+		t.Errorf("Deterministic choice = %v/%v, expected 192.0.2.3", a, b)
+	}
+}
+
+func TestResolvePolicy(t *testing.T) {
+	var err error
+	cfg := loadTestConfig(t, "ResolvePolicy = \"prefer-ipv6\"\n")
+	s, _ := newTestSession(t, cfg, "127.0.0.1:40000", "example.com:443")
+	if policy := s.resolvePolicy(); policy != config.ResolvePolicyPreferIPv6 {
+		t.Errorf("resolvePolicy() = '%s', expected '%s'", policy, config.ResolvePolicyPreferIPv6)
+	}
+
+	// SOCKS 4 can only represent IPv4 addresses.
+	conn := &testConn{remote: &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 40000}}
+	conn.rd.Reset([]byte("\x04\x01\x00\x50\x00\x00\x00\x01\x00example.com\x00"))
+	if s.req, err = socks5.Handshake(conn); err != nil {
+		t.Fatalf("Handshake failed: %v", err)
+	}
+	if policy := s.resolvePolicy(); policy != config.ResolvePolicyIPv4 {
+		t.Errorf("SOCKS 4 resolvePolicy() = '%s', expected '%s'", policy, config.ResolvePolicyIPv4)
+	}
+
+	cfg = loadTestConfig(t, "")
+	s, _ = newTestSession(t, cfg, "127.0.0.1:40000", "example.com:443")
+	if policy := s.resolvePolicy(); policy != config.ResolvePolicyIPv4 {
+		t.Errorf("Default resolvePolicy() = '%s', expected '%s'", policy, config.ResolvePolicyIPv4)
+	}
+}
+
+func TestAnswerDNSQueryRecords(t *testing.T) {
+	// UDP DNS answers hold every address of the queried family that the
+	// policy allows, unlike RESOLVE answers.
+	ips, err := net.LookupIP("localhost")
+	if err != nil {
+		t.Skipf("Failed to resolve localhost: %v", err)
+	}
+
+	cfg := loadTestConfig(t, "ResolvePolicy = \"ipv6\"\n")
+	s, _ := newTestSession(t, cfg, "127.0.0.1:40000", "example.com:443")
+	for _, qtype := range []uint16{dnsTypeA, dnsTypeAAAA} {
+		var expected int
+		for _, ip := range ips {
+			if (ip.To4() != nil) == (qtype == dnsTypeA) {
+				expected++
+			}
+		}
+
+		q, err := parseDNSQuery(testDNSQuery(1, "localhost", qtype))
+		if err != nil {
+			t.Fatalf("parseDNSQuery() failed: %v", err)
+		}
+		resp := s.answerDNSQuery(q)
+		if rcode := int(resp[3] & 0xf); rcode != dnsRcodeNoError {
+			t.Fatalf("answerDNSQuery(localhost, %d) rcode = %d", qtype, rcode)
+		}
+		if nrAnswers := int(resp[6])<<8 | int(resp[7]); nrAnswers != expected {
+			t.Errorf("answerDNSQuery(localhost, %d) = %d answers, expected %d", qtype, nrAnswers, expected)
+		}
+	}
+}
@@ -0,0 +1,162 @@
+/*
+ * safesocks.go - or-ctl-filter SafeSocks IP address destination checks.
+ *
+ * To the extent possible under law, Yawning Angel has waived all copyright and
+ * related or neighboring rights to or-ctl-filter, using the creative commons
+ * "cc0" public domain dedication. See LICENSE or
+ * <http://creativecommons.org/publicdomain/zero/1.0/> for full details.
+ */
+
+package proxy
+
+import (
+	"container/list"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/yawning/or-ctl-filter/config"
+	"github.com/yawning/or-ctl-filter/socks5"
+)
+
+const maxResolvedAddrEntries = 4096
+
+// SafeSocksCounters are the number of times each SafeSocks check triggered.
+type SafeSocksCounters struct {
+	// Warned is the number of IP address destinations allowed with a
+	// warning.
+	Warned uint64
+
+	// Rejected is the number of IP address destinations rejected.
+	Rejected uint64
+
+	// AllowedResolved is the number of IP address destinations allowed
+	// because they were recently answered to a RESOLVE request.
+	AllowedResolved uint64
+}
+
+var safeSocksCounters SafeSocksCounters
+
+type resolvedAddr struct {
+	key  string
+	time time.Time
+}
+
+// resolvedAddrs are the addresses recently answered to RESOLVE requests (and
+// UDP DNS queries), per client host, and when they were answered, in most
+// recently answered order.
+var resolvedAddrs struct {
+	sync.Mutex
+	m   map[string]*list.Element
+	lru *list.List
+}
+
+// SafeSocksStats returns a snapshot of the SafeSocks counters.
+func SafeSocksStats() SafeSocksCounters {
+	return SafeSocksCounters{
+		Warned:          atomic.LoadUint64(&safeSocksCounters.Warned),
+		Rejected:        atomic.LoadUint64(&safeSocksCounters.Rejected),
+		AllowedResolved: atomic.LoadUint64(&safeSocksCounters.AllowedResolved),
+	}
+}
+
+// safeSocks returns the SafeSocks mode for the session.
+func (s *session) safeSocks() string {
+	if s.user != nil && s.user.RoutingProfile().SafeSocks != "" {
+		return s.user.RoutingProfile().SafeSocks
+	} else if s.ws != nil {
+		return s.cfg.Gateway.SafeSocks
+	}
+	return s.cfg.SafeSocks
+}
+
+func (s *session) resolvedAddrKey(ip net.IP) string {
+	host, _, err := net.SplitHostPort(s.clientConn.RemoteAddr().String())
+	if err != nil {
+		host = s.clientConn.RemoteAddr().String()
+	}
+	return host + "|" + ip.String()
+}
+
+// recordResolved remembers that the client was told that a name resolved to
+// the addresses, for the SafeSocks "resolved" mode.
+func (s *session) recordResolved(ips ...net.IP) {
+	if s.safeSocks() != config.SafeSocksResolved {
+		return
+	}
+
+	resolvedAddrs.Lock()
+	defer resolvedAddrs.Unlock()
+
+	if resolvedAddrs.m == nil {
+		resolvedAddrs.m = make(map[string]*list.Element)
+		resolvedAddrs.lru = list.New()
+	}
+
+	// Expire the entries that are past the window, and then make room by
+	// evicting the oldest entries.
+	window := time.Duration(s.cfg.SafeSocksWindow) * time.Second
+	for e := resolvedAddrs.lru.Back(); e != nil && time.Since(e.Value.(*resolvedAddr).time) > window; e = resolvedAddrs.lru.Back() {
+		removeResolvedAddr(e)
+	}
+	now := time.Now()
+	for _, ip := range ips {
+		key := s.resolvedAddrKey(ip)
+		if e, ok := resolvedAddrs.m[key]; ok {
+			e.Value.(*resolvedAddr).time = now
+			resolvedAddrs.lru.MoveToFront(e)
+			continue
+		}
+		for resolvedAddrs.lru.Len() >= maxResolvedAddrEntries {
+			removeResolvedAddr(resolvedAddrs.lru.Back())
+		}
+		resolvedAddrs.m[key] = resolvedAddrs.lru.PushFront(&resolvedAddr{key: key, time: now})
+	}
+}
+
+func removeResolvedAddr(e *list.Element) {
+	ra := resolvedAddrs.lru.Remove(e).(*resolvedAddr)
+	delete(resolvedAddrs.m, ra.key)
+}
+
+func (s *session) wasResolved(ip net.IP) bool {
+	resolvedAddrs.Lock()
+	defer resolvedAddrs.Unlock()
+
+	e, ok := resolvedAddrs.m[s.resolvedAddrKey(ip)]
+	return ok && time.Since(e.Value.(*resolvedAddr).time) <= time.Duration(s.cfg.SafeSocksWindow)*time.Second
+}
+
+// checkSafeSocks applies the SafeSocks mode to CONNECT requests with IP
+// address destinations.  On failure, the request is replied to.
+func (s *session) checkSafeSocks() error {
+	targetStr := s.req.Addr.String()
+	host, _ := s.req.Addr.HostPort()
+	ip := net.ParseIP(strings.Trim(host, "[]"))
+	if ip == nil || s.isI2PRouterAddr() {
+		// Names, and the I2P router services, which are always addressed
+		// by IP address.
+		return nil
+	}
+
+	switch s.safeSocks() {
+	case config.SafeSocksWarn:
+		log.Printf("WARN/socks: IP address destination: '%s' (SafeSocks, possible DNS leak)", targetStr)
+		atomic.AddUint64(&safeSocksCounters.Warned, 1)
+	case config.SafeSocksResolved:
+		if s.wasResolved(ip) {
+			atomic.AddUint64(&safeSocksCounters.AllowedResolved, 1)
+			return nil
+		}
+		fallthrough
+	case config.SafeSocksReject:
+		log.Printf("ERR/socks: Rejecting IP address destination: '%s' (SafeSocks, possible DNS leak)", targetStr)
+		atomic.AddUint64(&safeSocksCounters.Rejected, 1)
+		s.req.Reply(socks5.ReplyConnectionNotAllowed)
+		return errDstForbidden
+	}
+	return nil
+}
@@ -0,0 +1,219 @@
+/*
+ * safesocks_test.go - or-ctl-filter SafeSocks tests.
+ *
+ * To the extent possible under law, Yawning Angel has waived all copyright and
+ * related or neighboring rights to or-ctl-filter, using the creative commons
+ * "cc0" public domain dedication. See LICENSE or
+ * <http://creativecommons.org/publicdomain/zero/1.0/> for full details.
+ */
+
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/yawning/or-ctl-filter/config"
+	"github.com/yawning/or-ctl-filter/socks5"
+)
+
+const testI2PConfig = `[I2P]
+Enable = true
+EnableManagement = true
+ManagementAddress = "tcp://127.0.0.1:7657"
+HTTPAddress = "tcp://127.0.0.1:4444"
+HTTPSAddress = "tcp://127.0.0.1:4445"
+`
+
+// testConn is a net.Conn that reads the client's side of a SOCKS handshake
+// from a fixed buffer, and records the replies.
+type testConn struct {
+	rd     bytes.Reader
+	out    bytes.Buffer
+	remote net.Addr
+}
+
+func (c *testConn) Read(b []byte) (int, error)         { return c.rd.Read(b) }
+func (c *testConn) Write(b []byte) (int, error)        { return c.out.Write(b) }
+func (c *testConn) Close() error                       { return nil }
+func (c *testConn) LocalAddr() net.Addr                { return &net.TCPAddr{} }
+func (c *testConn) RemoteAddr() net.Addr               { return c.remote }
+func (c *testConn) SetDeadline(t time.Time) error      { return nil }
+func (c *testConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c *testConn) SetWriteDeadline(t time.Time) error { return nil }
+
+// replyCode returns the reply code sent to the SOCKS 5 request, or -1 if the
+// request has not been replied to.
+func (c *testConn) replyCode() int {
+	// The method selection message is 2 bytes, followed by the reply.
+	if b := c.out.Bytes(); len(b) > 3 {
+		return int(b[3])
+	}
+	return -1
+}
+
+// newTestSession returns a session for a SOCKS 5 CONNECT request to dst made
+// from the client address client.
+func newTestSession(t *testing.T, cfg *config.Config, client, dst string) (*session, *testConn) {
+	host, portStr, err := net.SplitHostPort(dst)
+	if err != nil {
+		t.Fatalf("Invalid destination '%s': %v", dst, err)
+	}
+	port, _ := strconv.Atoi(portStr)
+
+	hs := []byte{0x05, 0x01, 0x00, 0x05, byte(socks5.CommandConnect), 0x00}
+	if ip := net.ParseIP(host); ip == nil {
+		hs = append(hs, 0x03, byte(len(host)))
+		hs = append(hs, host...)
+	} else if v4 := ip.To4(); v4 != nil {
+		hs = append(append(hs, 0x01), v4...)
+	} else {
+		hs = append(append(hs, 0x04), ip.To16()...)
+	}
+	hs = append(hs, byte(port>>8), byte(port))
+
+	clientAddr, err := net.ResolveTCPAddr("tcp", client)
+	if err != nil {
+		t.Fatalf("Invalid client address '%s': %v", client, err)
+	}
+	conn := &testConn{remote: clientAddr}
+	conn.rd.Reset(hs)
+	req, err := socks5.Handshake(conn)
+	if err != nil {
+		t.Fatalf("Handshake failed: %v", err)
+	}
+
+	s := &session{ctx: context.Background(), cfg: cfg, clientConn: conn, req: req}
+	return s, conn
+}
+
+func resetResolvedAddrs() {
+	resolvedAddrs.Lock()
+	defer resolvedAddrs.Unlock()
+
+	resolvedAddrs.m = nil
+	resolvedAddrs.lru = nil
+}
+
+func TestCheckSafeSocks(t *testing.T) {
+	resetResolvedAddrs()
+	defer resetResolvedAddrs()
+
+	const client = "127.0.0.1:40000"
+	for _, tc := range []struct {
+		extra    string
+		dst      string
+		resolved string
+		ok       bool
+		counters SafeSocksCounters
+	}{
+		// Names are never checked.
+		{"SafeSocks = \"reject\"\n", "example.com:443", "", true, SafeSocksCounters{}},
+
+		{"SafeSocks = \"off\"\n", "192.0.2.1:443", "", true, SafeSocksCounters{}},
+		{"SafeSocks = \"warn\"\n", "192.0.2.1:443", "", true, SafeSocksCounters{Warned: 1}},
+		{"SafeSocks = \"reject\"\n", "192.0.2.1:443", "", false, SafeSocksCounters{Rejected: 1}},
+		{"SafeSocks = \"reject\"\n", "[2001:db8::1]:443", "", false, SafeSocksCounters{Rejected: 1}},
+
+		// The I2P router services are exempt.
+		{"SafeSocks = \"reject\"\n" + testI2PConfig, "127.0.0.1:7657", "", true, SafeSocksCounters{}},
+		{"SafeSocks = \"reject\"\n" + testI2PConfig, "127.0.0.1:7659", "", false, SafeSocksCounters{Rejected: 1}},
+
+		// Only addresses recently answered to the same client host are
+		// allowed in the resolved mode.
+		{"SafeSocks = \"resolved\"\n", "192.0.2.2:443", "", false, SafeSocksCounters{Rejected: 1}},
+		{"SafeSocks = \"resolved\"\n", "192.0.2.2:443", "127.0.0.1:1", true, SafeSocksCounters{AllowedResolved: 1}},
+		{"SafeSocks = \"resolved\"\n", "192.0.2.3:443", "127.0.0.2:1", false, SafeSocksCounters{Rejected: 1}},
+	} {
+		cfg := loadTestConfig(t, tc.extra)
+		if tc.resolved != "" {
+			rs, _ := newTestSession(t, cfg, tc.resolved, "example.com:443")
+			host, _, _ := net.SplitHostPort(tc.dst)
+			rs.recordResolved(net.ParseIP(host))
+		}
+
+		s, conn := newTestSession(t, cfg, client, tc.dst)
+		before := SafeSocksStats()
+		err := s.checkSafeSocks()
+		after := SafeSocksStats()
+		delta := SafeSocksCounters{
+			Warned:          after.Warned - before.Warned,
+			Rejected:        after.Rejected - before.Rejected,
+			AllowedResolved: after.AllowedResolved - before.AllowedResolved,
+		}
+
+		descr := fmt.Sprintf("%s(%q)", tc.dst, tc.extra)
+		if tc.ok {
+			if err != nil || conn.replyCode() != -1 {
+				t.Errorf("checkSafeSocks(%s) = %v, reply %d, expected success", descr, err, conn.replyCode())
+			}
+		} else if err != errDstForbidden || conn.replyCode() != int(socks5.ReplyConnectionNotAllowed) {
+			t.Errorf("checkSafeSocks(%s) = %v, reply %d, expected errDstForbidden", descr, err, conn.replyCode())
+		}
+		if delta != tc.counters {
+			t.Errorf("checkSafeSocks(%s) counters = %+v, expected %+v", descr, delta, tc.counters)
+		}
+	}
+}
+
+func TestResolvedAddrs(t *testing.T) {
+	resetResolvedAddrs()
+	defer resetResolvedAddrs()
+
+	cfg := loadTestConfig(t, "SafeSocks = \"resolved\"\nSafeSocksWindow = 60\n")
+	s, _ := newTestSession(t, cfg, "127.0.0.1:40000", "example.com:443")
+	ip := func(i int) net.IP {
+		return net.IPv4(10, byte(i>>16), byte(i>>8), byte(i))
+	}
+
+	// Addresses are only recorded in the resolved mode.
+	off, _ := newTestSession(t, loadTestConfig(t, ""), "127.0.0.1:40000", "example.com:443")
+	off.recordResolved(ip(0))
+	if s.wasResolved(ip(0)) {
+		t.Errorf("Address recorded with SafeSocks off")
+	}
+
+	// The oldest entries are evicted once the table is full, and recording
+	// an address again makes it the most recent.
+	for i := 0; i < maxResolvedAddrEntries; i++ {
+		s.recordResolved(ip(i))
+	}
+	s.recordResolved(ip(0))
+	s.recordResolved(ip(maxResolvedAddrEntries))
+	if resolvedAddrs.lru.Len() != maxResolvedAddrEntries || len(resolvedAddrs.m) != maxResolvedAddrEntries {
+		t.Errorf("Table has %d/%d entries, expected %d", resolvedAddrs.lru.Len(), len(resolvedAddrs.m), maxResolvedAddrEntries)
+	}
+	for _, tc := range []struct {
+		i        int
+		expected bool
+	}{
+		{0, true},
+		{1, false},
+		{2, true},
+		{maxResolvedAddrEntries, true},
+	} {
+		if s.wasResolved(ip(tc.i)) != tc.expected {
+			t.Errorf("wasResolved(%v) = %v, expected %v", ip(tc.i), !tc.expected, tc.expected)
+		}
+	}
+
+	// Entries past the window are no longer allowed, and are expired on the
+	// next insertion.
+	resolvedAddrs.Lock()
+	for e := resolvedAddrs.lru.Front(); e != nil; e = e.Next() {
+		e.Value.(*resolvedAddr).time = time.Now().Add(-61 * time.Second)
+	}
+	resolvedAddrs.Unlock()
+	if s.wasResolved(ip(0)) {
+		t.Errorf("wasResolved() past the window = true")
+	}
+	s.recordResolved(ip(0))
+	if resolvedAddrs.lru.Len() != 1 || !s.wasResolved(ip(0)) {
+		t.Errorf("Expired entries were not removed, %d entries", resolvedAddrs.lru.Len())
+	}
+}
@@ -13,13 +13,17 @@ package proxy
 
 import (
 	"bytes"
+	"context"
 	"errors"
 	"io"
 	"log"
 	"net"
+	gohttp "net/http"
 	"net/url"
+	"strconv"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/yawning/or-ctl-filter/config"
 	"github.com/yawning/or-ctl-filter/http"
@@ -40,18 +44,28 @@ const (
 	upstreamI2P
 	upstreamI2PConsole
 	upstreamI2PLocal
+	upstreamDirect
+	upstreamNamed
 	upstreamInternet
 )
 
+// upstreamTimeout bounds how long establishing an upstream connection, or
+// completing a RESOLVE/RESOLVE_PTR request may take.
+const upstreamTimeout = 30 * time.Second
+
 type session struct {
-	cfg *config.Config
+	ctx  context.Context
+	cfg  *config.Config
+	ws   *config.Workstation
+	user *config.User
 
 	clientConn   net.Conn
 	upstreamConn net.Conn
 
-	req     *socks5.Request
-	bndAddr *socks5.Address
-	optData []byte
+	req        *socks5.Request
+	bndAddr    *socks5.Address
+	optData    []byte
+	optimistic bool
 }
 
 // InitSocksListener initializes the redispatching SOCKS 5 server and starts
@@ -62,86 +76,243 @@ func InitSocksListener(cfg *config.Config, wg *sync.WaitGroup) {
 		log.Fatalf("ERR/socks: Failed to listen on the socks address: %v", err)
 	}
 
+	srv := newSocksServer(cfg)
 	wg.Add(1)
-	go socksAcceptLoop(cfg, ln, wg)
+	go serveSocks(srv, ln, wg)
+
+	if cfg.Gateway.Enable {
+		gwLn, err := net.Listen(cfg.Gateway.SOCKSNetAddr())
+		if err != nil {
+			log.Fatalf("ERR/socks: Failed to listen on the gateway socks address: %v", err)
+		}
+
+		wg.Add(1)
+		go serveSocks(srv, &gatewayListener{Listener: gwLn, cfg: cfg}, wg)
+	}
 }
 
-func socksAcceptLoop(cfg *config.Config, ln net.Listener, wg *sync.WaitGroup) error {
+func newSocksServer(cfg *config.Config) *socks5.Server {
+	// RESOLVE/RESOLVE_PTR and UDP ASSOCIATE need either tor or the system
+	// resolver, though RESOLVE/RESOLVE_PTR of names that can only be
+	// connected to via I2P can be answered with virtual addresses.
+	cmds := []socks5.Command{socks5.CommandConnect}
+	if cfg.Tor.Enable || cfg.UnsafeAllowDirect {
+		cmds = append(cmds, socks5.CommandTorResolve, socks5.CommandTorResolvePTR, socks5.CommandUDPAssociate)
+	} else if cfg.VirtualAddr.Enable {
+		cmds = append(cmds, socks5.CommandTorResolve, socks5.CommandTorResolvePTR)
+	}
+
+	srvCfg := &socks5.ServerConfig{
+		AllowedCommands: cmds,
+		OnHandshakeError: func(conn net.Conn, err error) {
+			log.Printf("ERR/socks: Failed SOCKS5 handshake from: %v: %v", conn.RemoteAddr(), err)
+		},
+		ConnContext: func(ctx context.Context, conn net.Conn) context.Context {
+			if wsConn, ok := conn.(*workstationConn); ok {
+				return context.WithValue(ctx, workstationKey{}, wsConn.ws)
+			}
+			return ctx
+		},
+	}
+	if cfg.SOCKSAuth.Enable {
+		srvCfg.Authenticator = &socksAuthenticator{cfg: cfg}
+		srvCfg.RequireAuth = true
+	}
+
+	return socks5.NewServer(&socksHandler{cfg: cfg}, srvCfg)
+}
+
+// socksAuthenticator is the socks5.Authenticator that validates credentials
+// against the SOCKS users file.
+type socksAuthenticator struct {
+	cfg *config.Config
+}
+
+func (a *socksAuthenticator) Authenticate(conn net.Conn, auth *socks5.AuthInfo) (interface{}, error) {
+	// Failures are logged as handshake errors.
+	u, err := a.cfg.SOCKSAuth.Authenticate(auth.Uname, auth.Passwd)
+	if err != nil {
+		return nil, err
+	}
+	return u, nil
+}
+
+func serveSocks(srv *socks5.Server, ln net.Listener, wg *sync.WaitGroup) {
 	defer wg.Done()
-	defer ln.Close()
 
+	if err := srv.Serve(context.Background(), ln); err != nil {
+		log.Printf("ERR/socks: Failed to Accept(): %v", err)
+	}
+}
+
+// gatewayListener is a net.Listener that only accepts connections from known
+// workstations, and tags each connection with the workstation.
+type gatewayListener struct {
+	net.Listener
+	cfg *config.Config
+}
+
+func (ln *gatewayListener) Accept() (net.Conn, error) {
 	for {
-		conn, err := ln.Accept()
+		conn, err := ln.Listener.Accept()
 		if err != nil {
-			if e, ok := err.(net.Error); ok && !e.Temporary() {
-				log.Printf("ERR/socks: Failed to Accept(): %v", err)
-				return err
-			}
+			return nil, err
+		}
+		ws := ln.cfg.Gateway.Lookup(conn.RemoteAddr())
+		if ws == nil {
+			log.Printf("ERR/socks: Rejecting connection from unknown workstation: %v", conn.RemoteAddr())
+			conn.Close()
 			continue
 		}
-		s := &session{cfg: cfg, clientConn: conn}
-		go s.sessionWorker()
+		return &workstationConn{Conn: conn, ws: ws}, nil
 	}
 }
 
-func (s *session) sessionWorker() {
-	defer s.clientConn.Close()
+// workstationConn is a connection accepted by a gatewayListener.
+type workstationConn struct {
+	net.Conn
+	ws *config.Workstation
+}
 
-	clientAddr := s.clientConn.RemoteAddr()
-	log.Printf("INFO/socks: New connection from: %v", clientAddr)
+// workstationKey is the context key for the workstation of a gateway
+// connection.
+type workstationKey struct{}
 
-	// Do the SOCKS handshake with the client, and read the command.
-	var err error
-	if s.req, err = socks5.Handshake(s.clientConn); err != nil {
-		log.Printf("ERR/socks: Failed SOCKS5 handshake: %v", err)
-		return
+// socksHandler is the socks5.Handler that redispatches requests to the
+// appropriate upstream.
+type socksHandler struct {
+	cfg *config.Config
+}
+
+func (h *socksHandler) newSession(ctx context.Context, conn net.Conn, req *socks5.Request) *session {
+	s := &session{ctx: ctx, cfg: h.cfg, clientConn: conn, req: req}
+	if ws, ok := ctx.Value(workstationKey{}).(*config.Workstation); ok {
+		s.ws = ws
+	}
+	if u, ok := req.User.(*config.User); ok {
+		s.user = u
 	}
+	if s.ws != nil {
+		log.Printf("INFO/socks: New connection from: %v (%s)", conn.RemoteAddr(), s.ws.Name)
+	} else {
+		log.Printf("INFO/socks: New connection from: %v", conn.RemoteAddr())
+	}
+	return s
+}
 
-	switch s.req.Cmd {
-	case socks5.CommandTorResolve, socks5.CommandTorResolvePTR:
-		if !s.cfg.Tor.Enable {
-			if s.cfg.UnsafeAllowDirect {
-				if s.req.Cmd == socks5.CommandTorResolve {
-					log.Printf("INFO/socks: Dispatching clearnet address: '%s' (Direct, DNS)", s.req.Addr.String())
-					err = s.resolveDirect()
-				} else {
-					log.Printf("INFO/socks: Dispatching clearnet address: '%s' (Direct, DNS PTR)", s.req.Addr.String())
-					err = s.resolvePTRDirect()
-				}
-			} else {
-				// TODO: Figure out what to do with I2P.  (Use the torsocks trick?)
-				log.Printf("ERR/socks: Rejecting RESOLVE/RESOLVE_PTR request (Tor not enabled)")
-				s.req.Reply(socks5.ReplyCommandNotSupported)
+func (h *socksHandler) Connect(ctx context.Context, conn net.Conn, req *socks5.Request) {
+	s := h.newSession(ctx, conn, req)
+	s.handleConnect()
+}
+
+func (h *socksHandler) Resolve(ctx context.Context, conn net.Conn, req *socks5.Request) {
+	s := h.newSession(ctx, conn, req)
+	s.handleResolve()
+}
+
+func (h *socksHandler) UDPAssociate(ctx context.Context, conn net.Conn, req *socks5.Request) {
+	s := h.newSession(ctx, conn, req)
+	s.handleUDPAssociate()
+}
+
+// allowsTor returns true iff the session may use tor.
+func (s *session) allowsTor() bool {
+	return s.cfg.Tor.Enable && (s.user == nil || s.user.RoutingProfile().Tor)
+}
+
+// allowsI2P returns true iff the session may use I2P.
+func (s *session) allowsI2P() bool {
+	return s.cfg.I2P.Enable && (s.user == nil || s.user.RoutingProfile().I2P)
+}
+
+// allowsDirect returns true iff the session may make direct connections.
+func (s *session) allowsDirect() bool {
+	return s.cfg.UnsafeAllowDirect && (s.user == nil || s.user.RoutingProfile().Direct)
+}
+
+func (s *session) handleResolve() {
+	var err error
+	var virtual bool
+	if s.req.Cmd == socks5.CommandTorResolve {
+		var petname bool
+		if petname, err = s.resolvePetname(); err != nil {
+			return
+		} else if err = s.checkTorName(); err != nil {
+			return
+		}
+		virtual = s.wantsVirtualAddr()
+
+		// Otherwise, petnames are only ever resolved via tor, which will
+		// answer for onion addresses if it is configured to automap them.
+		if petname && !virtual {
+			host, _ := s.req.Addr.HostPort()
+			if !strings.HasSuffix(host, ".onion") {
+				log.Printf("ERR/socks: Rejecting RESOLVE request: '%s' (Not an onion address)", s.req.Addr.String())
+				s.req.Reply(socks5.ReplyAddressNotSupported)
+				return
+			} else if !s.cfg.Tor.Enable || !s.allowsTor() {
+				log.Printf("ERR/socks: Rejecting RESOLVE request: '%s' (Tor not allowed)", s.req.Addr.String())
+				s.req.Reply(socks5.ReplyConnectionNotAllowed)
 				return
 			}
+		}
+	} else {
+		virtual = s.virtualIP() != nil
+	}
+	if virtual {
+		err = s.resolveVirtual()
+	} else if !s.allowsTor() {
+		if !s.allowsDirect() {
+			log.Printf("ERR/socks: Rejecting RESOLVE/RESOLVE_PTR request (No suitable upstream)")
+			s.req.Reply(socks5.ReplyConnectionNotAllowed)
+			return
+		} else if s.req.Cmd == socks5.CommandTorResolve {
+			log.Printf("INFO/socks: Dispatching clearnet address: '%s' (Direct, DNS)", s.req.Addr.String())
+			err = s.resolveDirect()
 		} else {
-			// Redispatch the RESOLVE/RESOLVE_PTR request via tor.
-			log.Printf("INFO/socks: Dispatching clearnet address: '%s' (Tor, DNS)", s.req.Addr.String())
-			err = s.dispatchTorSOCKS()
+			log.Printf("INFO/socks: Dispatching clearnet address: '%s' (Direct, DNS PTR)", s.req.Addr.String())
+			err = s.resolvePTRDirect()
 		}
+	} else {
+		// Redispatch the RESOLVE/RESOLVE_PTR request via tor.
+		log.Printf("INFO/socks: Dispatching clearnet address: '%s' (Tor, DNS)", s.req.Addr.String())
+		if err = s.dispatchTorSOCKS(); err == nil && s.req.Cmd == socks5.CommandTorResolve {
+			// tor only ever returns a single address, so all that can be
+			// done is to enforce the policy on it.
+			if ip := s.bndAddr.IP(); ip != nil && selectAddress(s.resolvePolicy(), []net.IP{ip}) == nil {
+				log.Printf("ERR/socks: Rejecting RESOLVE answer '%s' (Resolve policy)", ip)
+				s.req.Reply(socks5.ReplyAddressNotSupported)
+				err = errDstForbidden
+			}
+		}
+	}
 
-		// If we reach here, the request has been dispatched and completed.
-		if err == nil {
-			// Successfully even, send the response back with the address.
-			s.req.ReplyAddr(socks5.ReplySucceeded, s.bndAddr)
+	// If we reach here, the request has been dispatched and completed.
+	if s.upstreamConn != nil {
+		s.upstreamConn.Close()
+	}
+	if err == nil {
+		// Successfully even, send the response back with the address.
+		if ip := s.bndAddr.IP(); ip != nil && !virtual {
+			s.recordResolved(ip)
 		}
-		return
-	case socks5.CommandConnect:
-	default:
-		// Should *NEVER* happen, validated as part of handshake.
-		log.Printf("BUG/socks: Unsupported SOCKS command: 0x%02x", s.req.Cmd)
-		s.req.Reply(socks5.ReplyCommandNotSupported)
-		return
+		s.req.ReplyAddr(socks5.ReplySucceeded, s.bndAddr)
 	}
+}
+
+func (s *session) handleConnect() {
+	clientAddr := s.clientConn.RemoteAddr()
 
-	if err = s.pickUpstreamAndDispatch(); err != nil {
+	if err := s.pickUpstreamAndDispatch(); err != nil {
 		return
 	}
-	s.req.Reply(socks5.ReplySucceeded)
+	if !s.optimistic {
+		s.req.Reply(socks5.ReplySucceeded)
+	}
 	defer s.upstreamConn.Close()
 
 	if s.optData != nil {
-		if _, err = s.upstreamConn.Write(s.optData); err != nil {
+		if _, err := s.upstreamConn.Write(s.optData); err != nil {
 			log.Printf("ERR/socks: Failed writing OptData: %v", err)
 			return
 		}
@@ -174,44 +345,84 @@ func (s *session) pickUpstreamAndDispatch() error {
 		httpPort = "80"
 	)
 
+	// Map virtual addresses back to names, apply SafeSocks and the private
+	// address policy to the remaining IP addresses, rewrite petnames, then
+	// reject malformed onion addresses and tor's special names up front,
+	// before they cost a round trip to an upstream.
+	if err := s.unmapVirtualAddr(); err != nil {
+		return err
+	} else if err = s.checkSafeSocks(); err != nil {
+		return err
+	} else if err = s.checkPrivateAddr(); err != nil {
+		return err
+	}
+	petname, err := s.resolvePetname()
+	if err != nil {
+		return err
+	} else if err = s.checkTorName(); err != nil {
+		return err
+	}
+
 	// First, determine the upstream connection type for a given request.
+	// The I2P router services are always special cased, since they need to
+	// be protected regardless of the routing table.
 	targetStr := s.req.Addr.String()
 	host, port := s.req.Addr.HostPort()
 	var upstream upstreamType
-	if strings.HasSuffix(host, suffixOnion) {
-		// Tor .onion address.
-		upstream = upstreamTor
-	} else if strings.HasSuffix(host, suffixI2P) {
-		// I2P address.
-		upstream = upstreamI2P
-	} else if s.cfg.I2P.IsManagementAddr(targetStr) {
+	var named *config.UpstreamCfg
+	if s.cfg.I2P.IsManagementAddr(targetStr) {
 		// I2P management web console.
 		upstream = upstreamI2PConsole
 	} else if s.cfg.I2P.IsLocalAddr(targetStr) {
 		// I2P local web server.
 		upstream = upstreamI2PLocal
+	} else if petname {
+		// Petnames bypass the routing table, so that they can never be
+		// dispatched anywhere but the overlay network they belong to.
+		upstream = upstreamTor
+		if strings.HasSuffix(host, suffixI2P) {
+			upstream = upstreamI2P
+		}
+	} else if route := s.matchRoute(host, port); route != nil {
+		switch route.Action {
+		case config.RouteActionTor:
+			upstream = upstreamTor
+		case config.RouteActionI2P:
+			upstream = upstreamI2P
+		case config.RouteActionDirect:
+			upstream = upstreamDirect
+		case config.RouteActionReject:
+			log.Printf("ERR/socks: Rejecting address: '%s' (Routing table)", targetStr)
+			s.req.Reply(route.ReplyCode())
+			return errDstForbidden
+		default:
+			if named = route.Upstream(); named == nil {
+				panic("BUG: unsupported route action: " + route.Action)
+			}
+			upstream = upstreamNamed
+		}
 	} else {
 		// Clearnet/IP address/etc.
-		// TODO: Check for I2P RESOLVE address range, and rewrite.
 		upstream = upstreamInternet
 	}
 
 	// Check the isolation settings:
+	iso := s.isolation()
 	if upstream == upstreamI2PConsole || upstream == upstreamI2PLocal {
 		// I2P router services hosted on localhost MUST be protected
 		// from everyone so require Tor Browser style IsolateSOCKSAuth
 		// to be set.
-		if s.req.Auth.Uname == nil || s.req.Auth.Passwd == nil {
+		if iso == nil {
 			log.Printf("ERR/socks: Rejecting I2P management/local server access, no isolation")
 			s.req.Reply(socks5.ReplyConnectionNotAllowed)
 			return errDstForbidden
 		}
 
-		if upstream == upstreamI2PConsole && !s.cfg.I2P.IsManagementHost(string(s.req.Auth.Uname)) {
+		if upstream == upstreamI2PConsole && !s.cfg.I2P.IsManagementHost(string(iso)) {
 			log.Printf("ERR/socks: Rejecting I2P management access, invalid isolation")
 			s.req.Reply(socks5.ReplyConnectionNotAllowed)
 			return errDstForbidden
-		} else if upstream == upstreamI2PLocal && !s.cfg.I2P.IsLocalHost(string(s.req.Auth.Uname)) {
+		} else if upstream == upstreamI2PLocal && !s.cfg.I2P.IsLocalHost(string(iso)) {
 			log.Printf("ERR/socks: Rejecting I2P local server access, invalid isolation")
 			s.req.Reply(socks5.ReplyConnectionNotAllowed)
 			return errDstForbidden
@@ -221,20 +432,20 @@ func (s *session) pickUpstreamAndDispatch() error {
 		// username set to the host component of the management interface
 		// address.  There's not more that can be done without hacking up
 		// Tor Browser I think. :(
-	} else if s.req.Auth.Uname != nil && s.req.Auth.Passwd != nil {
+	} else if iso != nil {
 		// Detect clearly bogus isolation, and fixup the upstream type to
 		// attempt to avoid giving information that the other protocol was
 		// considered.
 		switch upstream {
 		case upstreamI2P:
 			// I2P destination with Tor HS isolation.
-			if strings.HasSuffix(string(s.req.Auth.Uname), suffixOnion) {
+			if strings.HasSuffix(host, suffixI2P) && strings.HasSuffix(string(iso), suffixOnion) {
 				log.Printf("WARN/socks: Tor HS isolation for I2P destination, forcing Tor dispatch")
 				upstream = upstreamTor
 			}
 		case upstreamTor:
 			// Tor HS destination with I2P isolation.
-			if strings.HasSuffix(string(s.req.Auth.Uname), suffixI2P) {
+			if strings.HasSuffix(host, suffixOnion) && strings.HasSuffix(string(iso), suffixI2P) {
 				log.Printf("WARN/socks: I2P isolation for Tor HS destination, forcing I2P dispatch")
 				upstream = upstreamI2P
 			}
@@ -251,17 +462,25 @@ func (s *session) pickUpstreamAndDispatch() error {
 	switch upstream {
 	case upstreamTor:
 		if !s.cfg.Tor.Enable {
-			log.Printf("ERR/socks: Rejecting Tor HS address: '%s' (Tor not enabled)", targetStr)
+			log.Printf("ERR/socks: Rejecting Tor address: '%s' (Tor not enabled)", targetStr)
 			s.req.Reply(socks5.ReplyNetworkUnreachable)
 			return errInvalidUpstream
+		} else if !s.allowsTor() {
+			log.Printf("ERR/socks: Rejecting Tor address: '%s' (Tor not allowed for user '%s')", targetStr, s.user)
+			s.req.Reply(socks5.ReplyConnectionNotAllowed)
+			return errDstForbidden
 		}
-		log.Printf("INFO/socks: Dispatching Tor HS address: '%s'", targetStr)
-		return s.dispatchTorSOCKS()
+		log.Printf("INFO/socks: Dispatching Tor address: '%s'", targetStr)
+		return s.dispatch(s.dispatchTorSOCKS, s.cfg.Tor.OptimisticData)
 	case upstreamI2P, upstreamI2PConsole, upstreamI2PLocal:
 		if !s.cfg.I2P.Enable {
 			log.Printf("ERR/socks: Rejecting I2P address: '%s' (I2P not enabled)", targetStr)
 			s.req.Reply(socks5.ReplyNetworkUnreachable)
 			return errInvalidUpstream
+		} else if !s.allowsI2P() {
+			log.Printf("ERR/socks: Rejecting I2P address: '%s' (I2P not allowed for user '%s')", targetStr, s.user)
+			s.req.Reply(socks5.ReplyConnectionNotAllowed)
+			return errDstForbidden
 		}
 		if upstream == upstreamI2PConsole {
 			if !s.cfg.I2P.EnableManagement {
@@ -270,7 +489,7 @@ func (s *session) pickUpstreamAndDispatch() error {
 				return errDstForbidden
 			}
 			log.Printf("INFO/socks: Dispatching I2P address: '%s' (Direct)", targetStr)
-			return s.dispatchDirect()
+			return s.dispatch(s.dispatchDirect, s.cfg.I2P.OptimisticData)
 		} else if upstream == upstreamI2PLocal {
 			if !s.cfg.I2P.EnableLocal {
 				log.Printf("ERR/socks: Rejecting I2P address: '%s' (I2P local server access not enabled)", targetStr)
@@ -278,10 +497,10 @@ func (s *session) pickUpstreamAndDispatch() error {
 				return errDstForbidden
 			}
 			log.Printf("INFO/socks: Dispatching I2P address: '%s' (Direct)", targetStr)
-			return s.dispatchDirect()
+			return s.dispatch(s.dispatchDirect, s.cfg.I2P.OptimisticData)
 		} else if port == httpPort {
 			log.Printf("INFO/socks: Dispatching I2P address: '%s' (HTTP)", targetStr)
-			return s.dispatchI2PHTTP()
+			return s.dispatch(s.dispatchI2PHTTP, s.cfg.I2P.OptimisticData)
 		}
 
 		// Welp.  It's not going to port 80, so fall back to the HTTPS CONNECT
@@ -289,16 +508,32 @@ func (s *session) pickUpstreamAndDispatch() error {
 		// want this to also do things like SSH, and a SOCKS proxy isn't
 		// configured by default.
 		log.Printf("INFO/socks: Dispatching I2P address: '%s' (HTTPS CONNECT)", targetStr)
-		return s.dispatchI2PHTTPS()
+		return s.dispatch(s.dispatchI2PHTTPS, s.cfg.I2P.OptimisticData)
+	case upstreamDirect:
+		if !s.allowsDirect() {
+			log.Printf("ERR/socks: Rejecting address: '%s' (Direct not allowed)", targetStr)
+			s.req.Reply(socks5.ReplyConnectionNotAllowed)
+			return errDstForbidden
+		}
+		log.Printf("INFO/socks: Dispatching address: '%s' (Direct)", targetStr)
+		return s.dispatch(s.dispatchDirect, s.cfg.DirectOptimisticData)
+	case upstreamNamed:
+		if !s.allowsUpstream(named) {
+			log.Printf("ERR/socks: Rejecting address: '%s' (Upstream '%s' not allowed for user '%s')", targetStr, named.Name, s.user)
+			s.req.Reply(socks5.ReplyConnectionNotAllowed)
+			return errDstForbidden
+		}
+		log.Printf("INFO/socks: Dispatching address: '%s' (Upstream '%s')", targetStr, named.Name)
+		return s.dispatch(func() error { return s.dispatchUpstream(named) }, named.OptimisticData)
 	}
 
 	// Clearnet destinations.
-	if s.cfg.Tor.Enable {
+	if s.allowsTor() {
 		log.Printf("INFO/socks: Dispatching clearnet address: '%s' (Tor)", targetStr)
-		return s.dispatchTorSOCKS()
-	} else if s.cfg.UnsafeAllowDirect {
+		return s.dispatch(s.dispatchTorSOCKS, s.cfg.Tor.OptimisticData)
+	} else if s.allowsDirect() {
 		log.Printf("INFO/socks: Dispatching clearnet address: '%s' (Direct)", targetStr)
-		return s.dispatchDirect()
+		return s.dispatch(s.dispatchDirect, s.cfg.DirectOptimisticData)
 	}
 
 	log.Printf("ERR/socks: Unable to dispatch addres: '%s' (No suitable upstream)", targetStr)
@@ -306,38 +541,68 @@ func (s *session) pickUpstreamAndDispatch() error {
 	return errInvalidUpstream
 }
 
+// matchRoute returns the routing table rule for the destination, if any.
+func (s *session) matchRoute(host, port string) *config.RouteCfg {
+	portNum, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		// Should *NEVER* happen, the port comes from the SOCKS request.
+		panic("BUG: invalid SOCKS request port: " + port)
+	}
+	return s.cfg.MatchRoute(host, uint16(portNum), string(s.req.Auth.Uname))
+}
+
+// dispatch establishes the upstream connection with fn.  In optimistic mode,
+// the client is told that the connection succeeded before the upstream is
+// ready, so that it can send data immediately.  The data is left buffered in
+// the client connection till the copy loop starts, and if the upstream fails,
+// the client connection is simply closed.
+func (s *session) dispatch(fn func() error, optimistic bool) error {
+	if optimistic {
+		if err := s.req.Reply(socks5.ReplySucceeded); err != nil {
+			return err
+		}
+		s.optimistic = true
+	}
+
+	err := fn()
+	if err != nil && s.optimistic {
+		log.Printf("ERR/socks: Optimistic dispatch failed, closing connection: %v", err)
+	}
+	return err
+}
+
+// reply sends a reply to the client, unless an optimistic reply was already
+// sent.
+func (s *session) reply(code socks5.ReplyCode) {
+	if !s.optimistic {
+		s.req.Reply(code)
+	}
+}
+
 func (s *session) resolveDirect() error {
 	hostStr, portStr := s.req.Addr.HostPort()
-	hosts, err := net.LookupHost(hostStr)
+	ips, err := net.LookupIP(hostStr)
 	if err != nil {
 		s.req.Reply(socks5.ErrorToReplyCode(err))
 		return err
-	} else if len(hosts) == 0 {
+	} else if len(ips) == 0 {
 		s.req.Reply(socks5.ReplyGeneralFailure)
 		return errors.New("no results found (NXDOMAIN?)")
 	}
 
-	// torsocks (at least 2.1.0) totally flips out if a non-IPv4 address is
-	// returned, so return the first IPv4 address.
-	for _, h := range hosts {
-		if ip := net.ParseIP(h); ip == nil {
-			continue
-		} else if v4 := ip.To4(); v4 == nil {
-			continue
-		}
-
-		var resAddr socks5.Address
-		if err = resAddr.FromString(net.JoinHostPort(h, portStr)); err != nil {
-			s.req.Reply(socks5.ReplyGeneralFailure)
-			return err
-		}
-		s.bndAddr = &resAddr
-		return nil
+	ip := selectAddress(s.resolvePolicy(), ips)
+	if ip == nil {
+		s.req.Reply(socks5.ReplyGeneralFailure)
+		return errors.New("no suitable results found")
 	}
 
-	// No IPv4 addresses found.
-	s.req.Reply(socks5.ReplyGeneralFailure)
-	return errors.New("no IPv4 results found")
+	var resAddr socks5.Address
+	if err = resAddr.FromString(net.JoinHostPort(ip.String(), portStr)); err != nil {
+		s.req.Reply(socks5.ReplyGeneralFailure)
+		return err
+	}
+	s.bndAddr = &resAddr
+	return nil
 }
 
 func (s *session) resolvePTRDirect() error {
@@ -361,27 +626,146 @@ func (s *session) resolvePTRDirect() error {
 }
 
 func (s *session) dispatchDirect() (err error) {
-	s.upstreamConn, err = net.Dial("tcp", s.req.Addr.String())
-	if err != nil {
-		s.req.Reply(socks5.ErrorToReplyCode(err))
+	ctx, cancel := context.WithTimeout(s.ctx, upstreamTimeout)
+	defer cancel()
+
+	d := net.Dialer{Control: s.controlPrivateDial}
+	s.upstreamConn, err = d.DialContext(ctx, "tcp", s.req.Addr.String())
+	if errors.Is(err, errPrivateAddr) {
+		s.reply(socks5.ReplyConnectionNotAllowed)
+	} else if err != nil {
+		s.reply(socks5.ErrorToReplyCode(err))
 	}
 	return
 }
 
 func (s *session) dispatchTorSOCKS() (err error) {
-	pNet, pAddr := s.cfg.Tor.SOCKSNetAddr()
-	s.upstreamConn, s.bndAddr, err = socks5.Redispatch(pNet, pAddr, s.req)
+	if err = s.waitForTor(); err != nil {
+		s.reply(errorToReplyCode(err))
+		return
+	}
+
+	req := s.req
+	if s.ws != nil {
+		// Gateway workstations are isolated from each other by prepending
+		// the workstation's isolation tag to the SOCKS credentials.
+		if req, err = s.workstationRequest(s.req); err != nil {
+			log.Printf("ERR/socks: Failed to apply workstation isolation: %v", err)
+			s.reply(socks5.ReplyGeneralFailure)
+			return
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(s.ctx, upstreamTimeout)
+	defer cancel()
+
+	err = s.withTorInstances(ctx, req, func(inst *config.TorInstanceCfg) (err error) {
+		pNet, pAddr := inst.SOCKSNetAddr()
+		s.upstreamConn, s.bndAddr, err = socks5.Redispatch(ctx, pNet, pAddr, req)
+		return
+	})
 	if err != nil {
-		s.req.Reply(socks5.ErrorToReplyCode(err))
+		s.reply(socks5.ErrorToReplyCode(err))
+	}
+	return
+}
+
+// withTorInstances calls fn with the tor instances in order of preference for
+// req, failing over to the next instance if one is unreachable, and returns
+// the last error.
+func (s *session) withTorInstances(ctx context.Context, req *socks5.Request, fn func(*config.TorInstanceCfg) error) (err error) {
+	for _, inst := range s.cfg.Tor.PickInstances(torIsolationKey(s.clientConn, req)) {
+		if err = fn(inst); err == nil || !isTransportError(err) || ctx.Err() != nil {
+			// Either tor answered (or rejected the credentials), or there
+			// is no time left to fail over.
+			break
+		}
+		log.Printf("WARN/socks: Tor instance %v failed: %v", inst, err)
+		inst.MarkDown()
 	}
 	return
 }
 
+// isTransportError returns true iff err is a failure to connect to, or talk
+// to a proxy, as opposed to the proxy refusing the request.
+func isTransportError(err error) bool {
+	if _, ok := err.(net.Error); ok {
+		return true
+	}
+	return err == io.EOF || err == io.ErrUnexpectedEOF
+}
+
+// torIsolationKey returns the key used to pick the tor instance for a
+// request, which is derived from everything tor isolates streams by, so that
+// streams that share a circuit also share a tor instance.
+func torIsolationKey(conn net.Conn, req *socks5.Request) []byte {
+	host, _, err := net.SplitHostPort(conn.RemoteAddr().String())
+	if err != nil {
+		host = conn.RemoteAddr().String()
+	}
+
+	key := make([]byte, 0, len(host)+len(req.Auth.Uname)+len(req.Auth.Passwd)+2)
+	key = append(key, host...)
+	key = append(key, 0)
+	key = append(key, req.Auth.Uname...)
+	key = append(key, 0)
+	return append(key, req.Auth.Passwd...)
+}
+
+// isolation returns the isolation value supplied by the client, taking Tor's
+// extended parameters into account, or nil if none was supplied.
+func (s *session) isolation() []byte {
+	if s.req.ExtAuth != nil {
+		return s.req.ExtAuth.Isolation()
+	} else if s.req.Auth.Uname != nil && s.req.Auth.Passwd != nil {
+		return s.req.Auth.Uname
+	}
+	return nil
+}
+
+func (s *session) workstationRequest(origReq *socks5.Request) (*socks5.Request, error) {
+	const maxAuthLen = 255
+
+	tag := s.ws.IsolationTag()
+	req := *origReq
+	if origReq.ExtAuth != nil {
+		// Tag the isolation value, and re-encode the extended parameters
+		// so that tor sees a well formed username.
+		ea := *origReq.ExtAuth
+		ea.TagIsolation([]byte(tag + ":"))
+		auth, err := ea.AuthInfo()
+		if err != nil {
+			return nil, errInvalidIsolation
+		}
+		req.Auth, req.ExtAuth = auth, &ea
+		return &req, nil
+	} else if req.Auth.Uname == nil || req.Auth.Passwd == nil {
+		req.Auth.Uname = []byte(tag)
+		req.Auth.Passwd = []byte(tag)
+	} else {
+		req.Auth.Uname = append([]byte(tag+":"), origReq.Auth.Uname...)
+	}
+	if len(req.Auth.Uname) > maxAuthLen {
+		return nil, errInvalidIsolation
+	}
+	return &req, nil
+}
+
 func (s *session) dispatchI2PHTTP() (err error) {
+	if !isHealthy(healthNameI2PHTTP) {
+		log.Printf("ERR/socks: I2P HTTP proxy is unhealthy")
+		s.reply(socks5.ReplyNetworkUnreachable)
+		return errUnhealthy
+	}
+
+	ctx, cancel := context.WithTimeout(s.ctx, upstreamTimeout)
+	defer cancel()
+
+	var d net.Dialer
 	pNet, pAddr := s.cfg.I2P.HTTPNetAddr()
-	s.upstreamConn, err = net.Dial(pNet, pAddr)
+	s.upstreamConn, err = d.DialContext(ctx, pNet, pAddr)
 	if err != nil {
-		s.req.Reply(socks5.ErrorToReplyCode(err))
+		s.reply(socks5.ErrorToReplyCode(err))
 		return
 	}
 
@@ -400,14 +784,56 @@ func (s *session) dispatchI2PHTTP() (err error) {
 }
 
 func (s *session) dispatchI2PHTTPS() (err error) {
+	if !isHealthy(healthNameI2PHTTPS) {
+		log.Printf("ERR/socks: I2P HTTPS proxy is unhealthy")
+		s.reply(socks5.ReplyNetworkUnreachable)
+		return errUnhealthy
+	}
+
+	ctx, cancel := context.WithTimeout(s.ctx, upstreamTimeout)
+	defer cancel()
+
 	pNet, pAddr := s.cfg.I2P.HTTPSNetAddr()
-	s.upstreamConn, err = http.Dial(pNet, pAddr, s.req.Addr.String())
+	d := &http.Dialer{ProxyNetwork: pNet, ProxyAddress: pAddr}
+	s.upstreamConn, err = d.DialContext(ctx, "tcp", s.req.Addr.String())
 	if err != nil {
-		s.req.Reply(socks5.ErrorToReplyCode(err))
+		log.Printf("ERR/socks: I2P HTTPS CONNECT failed: %v", err)
+		s.reply(errorToReplyCode(err))
 	}
 	return
 }
 
+// errorToReplyCode converts an error to the "best" reply code, including
+// errors returned by the HTTP CONNECT proxy.
+func errorToReplyCode(err error) socks5.ReplyCode {
+	switch err {
+	case errBootstrapTimedOut:
+		return socks5.ReplyTTLExpired
+	case errUnhealthy:
+		return socks5.ReplyNetworkUnreachable
+	}
+
+	sErr, ok := err.(*http.StatusError)
+	if !ok {
+		return socks5.ErrorToReplyCode(err)
+	}
+
+	switch sErr.StatusCode {
+	case gohttp.StatusBadRequest:
+		return socks5.ReplyAddressNotSupported
+	case gohttp.StatusForbidden, gohttp.StatusProxyAuthRequired:
+		return socks5.ReplyConnectionNotAllowed
+	case gohttp.StatusNotFound, gohttp.StatusGone, gohttp.StatusBadGateway:
+		return socks5.ReplyHostUnreachable
+	case gohttp.StatusServiceUnavailable:
+		return socks5.ReplyNetworkUnreachable
+	case gohttp.StatusRequestTimeout, gohttp.StatusGatewayTimeout:
+		return socks5.ReplyTTLExpired
+	default:
+		return socks5.ReplyGeneralFailure
+	}
+}
+
 func (s *session) rewriteHTTPRequest() error {
 	const (
 		schemeHTTP = "http"
@@ -0,0 +1,339 @@
+/*
+ * udp.go - or-ctl-filter SOCKS UDP ASSOCIATE (DNS only) support.
+ *
+ * To the extent possible under law, Yawning Angel has waived all copyright and
+ * related or neighboring rights to or-ctl-filter, using the creative commons
+ * "cc0" public domain dedication. See LICENSE or
+ * <http://creativecommons.org/publicdomain/zero/1.0/> for full details.
+ */
+
+package proxy
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/yawning/or-ctl-filter/config"
+	"github.com/yawning/or-ctl-filter/socks5"
+)
+
+// errOverlayName is the error returned when a DNS query is for a name that
+// only exists on an overlay network.
+var errOverlayName = errors.New("onion and I2P names can not be resolved via DNS")
+
+const (
+	dnsPort = "53"
+
+	maxUDPDatagramLen       = 65535
+	maxConcurrentDNSQueries = 16
+)
+
+// handleUDPAssociate services a UDP ASSOCIATE request.  Only DNS queries
+// (A/AAAA/PTR) sent to port 53 are supported, and they are answered via tor's
+// RESOLVE/RESOLVE_PTR extensions (or the system resolver if direct
+// connections are allowed and tor is disabled).  Everything else is dropped.
+func (s *session) handleUDPAssociate() {
+	if !s.allowsTor() && !s.allowsDirect() {
+		log.Printf("ERR/socks: Rejecting UDP ASSOCIATE request (No suitable upstream)")
+		s.req.Reply(socks5.ReplyConnectionNotAllowed)
+		return
+	}
+
+	clientAddr, ok := s.clientConn.RemoteAddr().(*net.TCPAddr)
+	localAddr, ok2 := s.clientConn.LocalAddr().(*net.TCPAddr)
+	if !ok || !ok2 {
+		log.Printf("ERR/socks: UDP ASSOCIATE over non-TCP connection")
+		s.req.Reply(socks5.ReplyGeneralFailure)
+		return
+	}
+
+	uConn, err := net.ListenUDP("udp", &net.UDPAddr{IP: localAddr.IP})
+	if err != nil {
+		log.Printf("ERR/socks: Failed to create UDP socket: %v", err)
+		s.req.Reply(socks5.ErrorToReplyCode(err))
+		return
+	}
+	defer uConn.Close()
+
+	var bndAddr socks5.Address
+	if err = bndAddr.FromString(uConn.LocalAddr().String()); err != nil {
+		s.req.Reply(socks5.ReplyGeneralFailure)
+		return
+	}
+	if err = s.req.ReplyAddr(socks5.ReplySucceeded, &bndAddr); err != nil {
+		return
+	}
+	log.Printf("INFO/socks: UDP ASSOCIATE bound to: %v", uConn.LocalAddr())
+
+	// The client may specify the port it will send datagrams from.
+	var expectedPort int
+	if _, portStr := s.req.Addr.HostPort(); portStr != "" {
+		expectedPort, _ = strconv.Atoi(portStr)
+	}
+
+	// The association lasts as long as the TCP connection.
+	go func() {
+		io.Copy(ioutil.Discard, s.clientConn)
+		uConn.Close()
+	}()
+
+	sem := make(chan struct{}, maxConcurrentDNSQueries)
+	buf := make([]byte, maxUDPDatagramLen)
+	for {
+		n, from, err := uConn.ReadFromUDP(buf)
+		if err != nil {
+			break
+		}
+		if !from.IP.Equal(clientAddr.IP) || (expectedPort != 0 && from.Port != expectedPort) {
+			log.Printf("WARN/socks: Dropping UDP datagram from unexpected source: %v", from)
+			continue
+		}
+
+		pkt := append([]byte(nil), buf[:n]...)
+		dstAddr, payload, err := socks5.ParseUDPDatagram(pkt)
+		if err != nil {
+			log.Printf("WARN/socks: Dropping malformed UDP datagram: %v", err)
+			continue
+		}
+		if _, portStr := dstAddr.HostPort(); portStr != dnsPort {
+			log.Printf("WARN/socks: Dropping non-DNS UDP datagram to: '%s'", dstAddr.String())
+			continue
+		}
+		q, err := parseDNSQuery(payload)
+		if err != nil {
+			log.Printf("WARN/socks: Dropping non-DNS UDP datagram to: '%s': %v", dstAddr.String(), err)
+			continue
+		}
+
+		select {
+		case sem <- struct{}{}:
+		default:
+			log.Printf("WARN/socks: Dropping DNS query, too many outstanding queries")
+			continue
+		}
+		go func() {
+			defer func() { <-sem }()
+			resp := s.answerDNSQuery(q)
+			uConn.WriteToUDP(socks5.NewUDPDatagram(dstAddr, resp), from)
+		}()
+	}
+	log.Printf("INFO/socks: UDP ASSOCIATE closed: %v", uConn.LocalAddr())
+}
+
+func (s *session) answerDNSQuery(q *dnsQuery) []byte {
+	if q.qclass != dnsClassIN {
+		return q.response(dnsRcodeNotImp, nil, nil)
+	}
+
+	switch q.qtype {
+	case dnsTypeA, dnsTypeAAAA:
+		name, rcode := s.dnsQueryName(q.name)
+		if rcode != dnsRcodeNoError {
+			return q.response(rcode, nil, nil)
+		}
+
+		var ips []net.IP
+		virtual := s.wantsVirtualName(name, "0")
+		if virtual {
+			ip := s.mapVirtualAddr(strings.ToLower(strings.TrimSuffix(name, ".")))
+			log.Printf("INFO/socks: Mapped '%s' to virtual address '%s' (UDP DNS)", name, ip)
+			ips = []net.IP{ip}
+		} else {
+			log.Printf("INFO/socks: Dispatching clearnet address: '%s' (UDP DNS)", name)
+			var err error
+			if ips, err = s.resolveName(name); err != nil {
+				return q.response(dnsErrorToRcode(err), nil, nil)
+			}
+		}
+
+		// Answers follow the same policy as RESOLVE requests, but unlike
+		// a SOCKS reply, can hold every address that the policy allows.
+		var answers []net.IP
+		for _, ip := range selectAddresses(s.resolvePolicy(), ips) {
+			if v4 := ip.To4(); v4 != nil && q.qtype == dnsTypeA {
+				answers = append(answers, v4)
+			} else if v4 == nil && q.qtype == dnsTypeAAAA {
+				answers = append(answers, ip.To16())
+			}
+		}
+		if !virtual {
+			s.recordResolved(answers...)
+		}
+		return q.response(dnsRcodeNoError, answers, nil)
+	case dnsTypePTR:
+		ip := ptrNameToIP(q.name)
+		if ip == nil {
+			return q.response(dnsRcodeNXDomain, nil, nil)
+		}
+		if s.isVirtualIP(ip) {
+			name, ok := s.lookupVirtualAddr(ip)
+			if !ok {
+				return q.response(dnsRcodeNXDomain, nil, nil)
+			}
+			return q.response(dnsRcodeNoError, nil, []string{name})
+		}
+		log.Printf("INFO/socks: Dispatching clearnet address: '%s' (UDP DNS PTR)", ip)
+		name, err := s.resolveAddr(ip)
+		if err != nil {
+			return q.response(dnsErrorToRcode(err), nil, nil)
+		}
+		return q.response(dnsRcodeNoError, nil, []string{name})
+	default:
+		return q.response(dnsRcodeNotImp, nil, nil)
+	}
+}
+
+// dnsQueryName applies the petname address book and tor's hostname rules to
+// a DNS query name, the same way as for RESOLVE requests, and returns the name
+// to look up, or the rcode to answer with.
+func (s *session) dnsQueryName(qname string) (string, int) {
+	name := qname
+	if dst, ok := s.cfg.Petnames.Lookup(name); ok {
+		log.Printf("INFO/socks: Petname '%s' is '%s' (UDP DNS)", name, dst)
+		name = dst
+	} else if s.cfg.Petnames.IsReserved(name) {
+		log.Printf("ERR/socks: Refusing UDP DNS query: '%s' (Unknown petname)", name)
+		return "", dnsRcodeNXDomain
+	}
+
+	normalized, err := s.normalizeTorName(name)
+	if err == errDstForbidden {
+		log.Printf("ERR/socks: Refusing UDP DNS query: '%s' (Special suffix not allowed)", name)
+		return "", dnsRcodeRefused
+	} else if err != nil {
+		log.Printf("ERR/socks: Refusing UDP DNS query: '%s' (%v)", name, err)
+		return "", dnsRcodeNXDomain
+	}
+	return normalized, dnsRcodeNoError
+}
+
+func (s *session) resolveName(name string) ([]net.IP, error) {
+	if isOverlayName(name) {
+		// Never send these to the system resolver or a tor exit.
+		log.Printf("ERR/socks: Refusing UDP DNS query: '%s' (Overlay name)", name)
+		return nil, errOverlayName
+	}
+	if !s.allowsTor() {
+		return net.LookupIP(name)
+	}
+
+	d, err := s.torDialer()
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(s.ctx, upstreamTimeout)
+	defer cancel()
+
+	ip, err := d.Resolve(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	return []net.IP{ip}, nil
+}
+
+func (s *session) resolveAddr(ip net.IP) (string, error) {
+	if !s.allowsTor() {
+		names, err := net.LookupAddr(ip.String())
+		if err != nil {
+			return "", err
+		} else if len(names) == 0 {
+			return "", errInvalidUpstream
+		}
+		return names[0], nil
+	}
+
+	d, err := s.torDialer()
+	if err != nil {
+		return "", err
+	}
+	ctx, cancel := context.WithTimeout(s.ctx, upstreamTimeout)
+	defer cancel()
+
+	return d.ResolvePTR(ctx, ip)
+}
+
+// torDialer returns a dialer for tor's SOCKS port, with the same isolation as
+// the session's request, once tor is usable.
+func (s *session) torDialer() (*torFailoverDialer, error) {
+	if err := s.waitForTor(); err != nil {
+		return nil, err
+	}
+
+	req := s.req
+	if s.ws != nil {
+		var err error
+		if req, err = s.workstationRequest(s.req); err != nil {
+			return nil, err
+		}
+	}
+	return &torFailoverDialer{s: s, req: req}, nil
+}
+
+// torFailoverDialer connects to tor's SOCKS port, failing over across the
+// tor instances the same way as CONNECT requests.
+type torFailoverDialer struct {
+	s   *session
+	req *socks5.Request
+}
+
+func (d *torFailoverDialer) dialer(inst *config.TorInstanceCfg) *socks5.Dialer {
+	pNet, pAddr := inst.SOCKSNetAddr()
+	sd := &socks5.Dialer{ProxyNetwork: pNet, ProxyAddress: pAddr}
+	if d.req.Auth.Uname != nil && d.req.Auth.Passwd != nil {
+		auth := d.req.Auth
+		sd.Auth = &auth
+	}
+	return sd
+}
+
+func (d *torFailoverDialer) DialContext(ctx context.Context, network, addr string) (conn net.Conn, err error) {
+	err = d.s.withTorInstances(ctx, d.req, func(inst *config.TorInstanceCfg) (err error) {
+		conn, err = d.dialer(inst).DialContext(ctx, network, addr)
+		return
+	})
+	return
+}
+
+func (d *torFailoverDialer) Resolve(ctx context.Context, host string) (ip net.IP, err error) {
+	err = d.s.withTorInstances(ctx, d.req, func(inst *config.TorInstanceCfg) (err error) {
+		ip, err = d.dialer(inst).Resolve(ctx, host)
+		return
+	})
+	return
+}
+
+func (d *torFailoverDialer) ResolvePTR(ctx context.Context, ip net.IP) (name string, err error) {
+	err = d.s.withTorInstances(ctx, d.req, func(inst *config.TorInstanceCfg) (err error) {
+		name, err = d.dialer(inst).ResolvePTR(ctx, ip)
+		return
+	})
+	return
+}
+
+// isOverlayName returns true iff name is an onion or I2P name.
+func isOverlayName(name string) bool {
+	name = strings.ToLower(strings.TrimSuffix(name, "."))
+	return strings.HasSuffix(name, ".onion") || strings.HasSuffix(name, ".i2p")
+}
+
+func dnsErrorToRcode(err error) int {
+	if err == errOverlayName {
+		return dnsRcodeNXDomain
+	}
+	if dnsErr, ok := err.(*net.DNSError); ok {
+		if dnsErr.IsNotFound {
+			return dnsRcodeNXDomain
+		}
+		return dnsRcodeServFail
+	}
+	if socks5.ErrorToReplyCode(err) == socks5.ReplyHostUnreachable {
+		return dnsRcodeNXDomain
+	}
+	return dnsRcodeServFail
+}
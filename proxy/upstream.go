@@ -0,0 +1,108 @@
+/*
+ * upstream.go - or-ctl-filter named upstream proxies.
+ *
+ * To the extent possible under law, Yawning Angel has waived all copyright and
+ * related or neighboring rights to or-ctl-filter, using the creative commons
+ * "cc0" public domain dedication. See LICENSE or
+ * <http://creativecommons.org/publicdomain/zero/1.0/> for full details.
+ */
+
+package proxy
+
+import (
+	"context"
+	"log"
+	"net"
+
+	"github.com/yawning/or-ctl-filter/config"
+	"github.com/yawning/or-ctl-filter/http"
+	"github.com/yawning/or-ctl-filter/socks5"
+)
+
+type dialFunc func(ctx context.Context, network, addr string) (net.Conn, error)
+
+// rootUpstream returns the first upstream in the chain used to reach u.
+func rootUpstream(u *config.UpstreamCfg) *config.UpstreamCfg {
+	for u.ViaUpstream() != nil {
+		u = u.ViaUpstream()
+	}
+	return u
+}
+
+// allowsUpstream returns true iff the session may use the named upstream,
+// based on how the first proxy in the chain is connected to.
+func (s *session) allowsUpstream(u *config.UpstreamCfg) bool {
+	if rootUpstream(u).Via == config.UpstreamViaTor {
+		return s.allowsTor()
+	}
+	return s.user == nil || s.user.RoutingProfile().Direct
+}
+
+// upstreamProxyDial returns the dial function used to connect to the named
+// upstream's proxy, via the rest of the chain.  torDial is used for the hop
+// via tor, if any.
+func upstreamProxyDial(u *config.UpstreamCfg, torDial dialFunc) dialFunc {
+	if via := u.ViaUpstream(); via != nil {
+		return upstreamDialer(via, torDial)
+	} else if u.Via == config.UpstreamViaTor {
+		return torDial
+	}
+	var d net.Dialer
+	return d.DialContext
+}
+
+func upstreamSOCKSDialer(u *config.UpstreamCfg, proxyDial dialFunc) *socks5.Dialer {
+	pNet, pAddr := u.NetAddr()
+	d := &socks5.Dialer{ProxyNetwork: pNet, ProxyAddress: pAddr, ProxyDial: proxyDial}
+	if u.Username != "" {
+		d.Auth = &socks5.AuthInfo{Uname: []byte(u.Username), Passwd: []byte(u.Password)}
+	}
+	return d
+}
+
+// upstreamDialer returns the dial function for the named upstream.  The
+// tor/I2P dispatch paths use socks5.Redispatch and http.Dial, which are thin
+// wrappers around the same socks5.Dialer and http.Dialer.
+func upstreamDialer(u *config.UpstreamCfg, torDial dialFunc) dialFunc {
+	proxyDial := upstreamProxyDial(u, torDial)
+	switch u.Type {
+	case config.UpstreamTypeSOCKS5:
+		return upstreamSOCKSDialer(u, proxyDial).DialContext
+	case config.UpstreamTypeHTTPConnect:
+		pNet, pAddr := u.NetAddr()
+		d := &http.Dialer{ProxyNetwork: pNet, ProxyAddress: pAddr, Username: u.Username, Password: u.Password, ProxyDial: proxyDial}
+		return d.DialContext
+	default:
+		panic("BUG: unsupported upstream type: " + u.Type)
+	}
+}
+
+func (s *session) dispatchUpstream(u *config.UpstreamCfg) (err error) {
+	if !isHealthy(upstreamHealthName(u)) {
+		log.Printf("ERR/socks: Upstream '%s' is unhealthy", u.Name)
+		s.reply(socks5.ReplyNetworkUnreachable)
+		return errUnhealthy
+	}
+
+	var torDial dialFunc
+	if rootUpstream(u).Via == config.UpstreamViaTor {
+		// The hop to the proxy gets the client's isolation.
+		d, err := s.torDialer()
+		if err != nil {
+			log.Printf("ERR/socks: Upstream '%s' failed: %v", u.Name, err)
+			s.reply(errorToReplyCode(err))
+			return err
+		}
+		torDial = d.DialContext
+	}
+
+	ctx, cancel := context.WithTimeout(s.ctx, upstreamTimeout)
+	defer cancel()
+
+	s.upstreamConn, err = upstreamDialer(u, torDial)(ctx, "tcp", s.req.Addr.String())
+	if err != nil {
+		log.Printf("ERR/socks: Upstream '%s' failed: %v", u.Name, err)
+		s.reply(errorToReplyCode(err))
+	}
+	return
+}
@@ -0,0 +1,268 @@
+/*
+ * virtaddr.go - or-ctl-filter virtual address automapping.
+ *
+ * To the extent possible under law, Yawning Angel has waived all copyright and
+ * related or neighboring rights to or-ctl-filter, using the creative commons
+ * "cc0" public domain dedication. See LICENSE or
+ * <http://creativecommons.org/publicdomain/zero/1.0/> for full details.
+ */
+
+package proxy
+
+import (
+	"container/list"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/yawning/or-ctl-filter/config"
+	"github.com/yawning/or-ctl-filter/socks5"
+)
+
+type virtualAddr struct {
+	name    string
+	ip      net.IP
+	lastUse time.Time
+}
+
+// virtualAddrMap is the set of virtual address mappings of an isolation
+// scope, in least recently used order.
+type virtualAddrMap struct {
+	byName map[string]*list.Element
+	byIP   map[string]*list.Element
+	lru    *list.List
+	next   uint64
+}
+
+// virtualAddrs are the virtual address mappings, per isolation scope.  Each
+// gateway workstation gets a scope of its own, so that the mappings (and the
+// order that the addresses were handed out in) are not shared across
+// workstations.
+var virtualAddrs struct {
+	sync.Mutex
+	scopes map[string]*virtualAddrMap
+}
+
+func virtualAddrScope(ws *config.Workstation) string {
+	if ws != nil {
+		return "ws:" + ws.Name
+	}
+	return ""
+}
+
+// ForgetVirtualAddrs clears the virtual address mappings of a workstation, or
+// every mapping if ws is nil.  It is called on NEWNYM.
+func ForgetVirtualAddrs(ws *config.Workstation) {
+	virtualAddrs.Lock()
+	defer virtualAddrs.Unlock()
+
+	if ws == nil {
+		virtualAddrs.scopes = nil
+	} else {
+		delete(virtualAddrs.scopes, virtualAddrScope(ws))
+	}
+}
+
+// mapVirtualAddr returns the virtual address that name is mapped to,
+// allocating one if needed.
+func (s *session) mapVirtualAddr(name string) net.IP {
+	virtualAddrs.Lock()
+	defer virtualAddrs.Unlock()
+
+	m := s.virtualAddrMap()
+	if e, ok := m.byName[name]; ok {
+		m.touch(e)
+		return e.Value.(*virtualAddr).ip
+	}
+
+	// Make room, and then find the next unused address in the network.
+	vCfg := &s.cfg.VirtualAddr
+	ipNet := vCfg.VirtualNetwork()
+	usable := virtualNetworkSize(ipNet) - 2
+	for m.lru.Len() >= vCfg.MaxEntries || uint64(m.lru.Len()) >= usable {
+		m.remove(m.lru.Back())
+	}
+	for {
+		ip := offsetIP(ipNet.IP, m.next%usable+1)
+		m.next++
+		if _, ok := m.byIP[ip.String()]; !ok {
+			e := m.lru.PushFront(&virtualAddr{name: name, ip: ip, lastUse: time.Now()})
+			m.byName[name] = e
+			m.byIP[ip.String()] = e
+			return ip
+		}
+	}
+}
+
+// lookupVirtualAddr returns the name that the virtual address is mapped to.
+func (s *session) lookupVirtualAddr(ip net.IP) (string, bool) {
+	virtualAddrs.Lock()
+	defer virtualAddrs.Unlock()
+
+	m := s.virtualAddrMap()
+	if e, ok := m.byIP[ip.String()]; ok {
+		m.touch(e)
+		return e.Value.(*virtualAddr).name, true
+	}
+	return "", false
+}
+
+// virtualAddrMap returns the session's scope's mappings, with the expired
+// mappings removed.  virtualAddrs must be locked.
+func (s *session) virtualAddrMap() *virtualAddrMap {
+	if virtualAddrs.scopes == nil {
+		virtualAddrs.scopes = make(map[string]*virtualAddrMap)
+	}
+	scope := virtualAddrScope(s.ws)
+	m, ok := virtualAddrs.scopes[scope]
+	if !ok {
+		m = &virtualAddrMap{
+			byName: make(map[string]*list.Element),
+			byIP:   make(map[string]*list.Element),
+			lru:    list.New(),
+		}
+		virtualAddrs.scopes[scope] = m
+	}
+
+	ttl := time.Duration(s.cfg.VirtualAddr.TTL) * time.Second
+	for e := m.lru.Back(); e != nil && time.Since(e.Value.(*virtualAddr).lastUse) > ttl; e = m.lru.Back() {
+		m.remove(e)
+	}
+	return m
+}
+
+func (m *virtualAddrMap) touch(e *list.Element) {
+	e.Value.(*virtualAddr).lastUse = time.Now()
+	m.lru.MoveToFront(e)
+}
+
+func (m *virtualAddrMap) remove(e *list.Element) {
+	va := m.lru.Remove(e).(*virtualAddr)
+	delete(m.byName, va.name)
+	delete(m.byIP, va.ip.String())
+}
+
+// virtualNetworkSize returns the number of addresses in the network, capped
+// to 2^32.
+func virtualNetworkSize(ipNet *net.IPNet) uint64 {
+	ones, bits := ipNet.Mask.Size()
+	hostBits := bits - ones
+	if hostBits > 32 {
+		hostBits = 32
+	}
+	return uint64(1) << uint(hostBits)
+}
+
+func offsetIP(base net.IP, off uint64) net.IP {
+	ip := make(net.IP, len(base))
+	copy(ip, base)
+	for i := len(ip) - 1; i >= 0 && off > 0; i-- {
+		sum := uint64(ip[i]) + off&0xff
+		ip[i] = byte(sum)
+		off = off>>8 + sum>>8
+	}
+	return ip
+}
+
+// virtualIP returns the destination address if it is in the virtual network,
+// or nil.
+func (s *session) virtualIP() net.IP {
+	host, _ := s.req.Addr.HostPort()
+	ip := net.ParseIP(strings.Trim(host, "[]"))
+	if ip == nil || !s.isVirtualIP(ip) {
+		return nil
+	}
+	return ip
+}
+
+// isVirtualIP returns true iff ip is in the virtual network.
+func (s *session) isVirtualIP(ip net.IP) bool {
+	return s.cfg.VirtualAddr.Enable && s.cfg.VirtualAddr.VirtualNetwork().Contains(ip)
+}
+
+// wantsVirtualAddr returns true iff a RESOLVE request should be answered with
+// a virtual address, because the name can not be resolved via DNS.
+func (s *session) wantsVirtualAddr() bool {
+	host, port := s.req.Addr.HostPort()
+	return s.wantsVirtualName(host, port)
+}
+
+// wantsVirtualName returns true iff host should be answered with a virtual
+// address.
+func (s *session) wantsVirtualName(host, port string) bool {
+	if !s.cfg.VirtualAddr.Enable {
+		return false
+	}
+	if net.ParseIP(strings.Trim(host, "[]")) != nil {
+		return false
+	}
+	name := strings.ToLower(strings.TrimSuffix(host, "."))
+	if strings.HasSuffix(name, ".onion") || strings.HasSuffix(name, ".i2p") {
+		return true
+	}
+	if route := s.matchRoute(host, port); route != nil {
+		return route.Action == config.RouteActionI2P || route.Upstream() != nil
+	}
+	return false
+}
+
+// resolveVirtual answers a RESOLVE request with a virtual address, or a
+// RESOLVE_PTR request for a virtual address with the name it is mapped to.
+func (s *session) resolveVirtual() error {
+	host, _ := s.req.Addr.HostPort()
+	var addrStr string
+	if s.req.Cmd == socks5.CommandTorResolvePTR {
+		name, ok := s.lookupVirtualAddr(s.virtualIP())
+		if !ok {
+			log.Printf("ERR/socks: Rejecting RESOLVE_PTR request: '%s' (Unmapped virtual address)", host)
+			s.req.Reply(socks5.ReplyHostUnreachable)
+			return errDstForbidden
+		}
+		addrStr = name
+	} else {
+		name := strings.ToLower(strings.TrimSuffix(host, "."))
+		ip := s.mapVirtualAddr(name)
+		if selectAddress(s.resolvePolicy(), []net.IP{ip}) == nil {
+			log.Printf("ERR/socks: Rejecting virtual address '%s' (Resolve policy)", ip)
+			s.req.Reply(socks5.ReplyAddressNotSupported)
+			return errDstForbidden
+		}
+		log.Printf("INFO/socks: Mapped '%s' to virtual address '%s'", name, ip)
+		addrStr = ip.String()
+	}
+
+	s.bndAddr = new(socks5.Address)
+	if err := s.bndAddr.FromString(net.JoinHostPort(addrStr, "0")); err != nil {
+		s.req.Reply(socks5.ReplyGeneralFailure)
+		return err
+	}
+	return nil
+}
+
+// unmapVirtualAddr rewrites a destination in the virtual network to the name
+// that it is mapped to.  Virtual addresses that are not mapped are rejected,
+// since they are never valid destinations.  On failure, the request is
+// replied to.
+func (s *session) unmapVirtualAddr() error {
+	ip := s.virtualIP()
+	if ip == nil {
+		return nil
+	}
+
+	_, port := s.req.Addr.HostPort()
+	name, ok := s.lookupVirtualAddr(ip)
+	if !ok {
+		log.Printf("ERR/socks: Rejecting address: '%s' (Unmapped virtual address)", s.req.Addr.String())
+		s.req.Reply(socks5.ReplyHostUnreachable)
+		return errDstForbidden
+	}
+	if err := s.req.Addr.FromString(net.JoinHostPort(name, port)); err != nil {
+		log.Printf("ERR/socks: Failed to rewrite virtual address '%s': %v", ip, err)
+		s.req.Reply(socks5.ReplyGeneralFailure)
+		return err
+	}
+	log.Printf("INFO/socks: Virtual address '%s' is '%s'", ip, name)
+	return nil
+}
@@ -0,0 +1,185 @@
+/*
+ * virtaddr_test.go - or-ctl-filter virtual address automapping tests.
+ *
+ * To the extent possible under law, Yawning Angel has waived all copyright and
+ * related or neighboring rights to or-ctl-filter, using the creative commons
+ * "cc0" public domain dedication. See LICENSE or
+ * <http://creativecommons.org/publicdomain/zero/1.0/> for full details.
+ */
+
+package proxy
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/yawning/or-ctl-filter/config"
+	"github.com/yawning/or-ctl-filter/socks5"
+)
+
+const testVirtualAddrConfig = `[VirtualAddr]
+Enable = true
+Network = "10.255.0.0/24"
+MaxEntries = 3
+TTL = 60
+`
+
+func TestMapVirtualAddr(t *testing.T) {
+	ForgetVirtualAddrs(nil)
+	defer ForgetVirtualAddrs(nil)
+
+	cfg := loadTestConfig(t, testVirtualAddrConfig)
+	s := &session{cfg: cfg}
+	expectMapped := func(s *session, name, expected string) {
+		if ip := s.mapVirtualAddr(name); !ip.Equal(net.ParseIP(expected)) {
+			t.Errorf("mapVirtualAddr('%s') = %v, expected %s", name, ip, expected)
+		}
+	}
+	expectLookup := func(s *session, ipStr, expected string) {
+		name, ok := s.lookupVirtualAddr(net.ParseIP(ipStr).To4())
+		if ok != (expected != "") || name != expected {
+			t.Errorf("lookupVirtualAddr(%s) = '%s', %v, expected '%s'", ipStr, name, ok, expected)
+		}
+	}
+
+	// Addresses are handed out in order, and names keep their address.
+	expectMapped(s, "a.onion", "10.255.0.1")
+	expectMapped(s, "b.onion", "10.255.0.2")
+	expectMapped(s, "c.onion", "10.255.0.3")
+	expectMapped(s, "a.onion", "10.255.0.1")
+
+	// Once MaxEntries is reached, the least recently used mapping is
+	// evicted.
+	expectMapped(s, "d.onion", "10.255.0.4")
+	expectLookup(s, "10.255.0.2", "")
+	expectLookup(s, "10.255.0.1", "a.onion")
+	expectLookup(s, "10.255.0.3", "c.onion")
+	expectMapped(s, "e.onion", "10.255.0.5")
+	expectLookup(s, "10.255.0.4", "")
+
+	// Each workstation has a scope of its own.
+	ws0 := &session{cfg: cfg, ws: &config.Workstation{Name: "ws0"}}
+	ws1 := &session{cfg: cfg, ws: &config.Workstation{Name: "ws1"}}
+	expectLookup(ws0, "10.255.0.1", "")
+	expectMapped(ws0, "a.onion", "10.255.0.1")
+	expectMapped(ws0, "x.onion", "10.255.0.2")
+	expectMapped(ws1, "y.onion", "10.255.0.1")
+	expectLookup(ws1, "10.255.0.2", "")
+
+	// Mappings that were not used within the TTL expire.
+	virtualAddrs.Lock()
+	m := virtualAddrs.scopes[virtualAddrScope(nil)]
+	for e := m.lru.Front(); e != nil; e = e.Next() {
+		e.Value.(*virtualAddr).lastUse = time.Now().Add(-61 * time.Second)
+	}
+	virtualAddrs.Unlock()
+	expectLookup(s, "10.255.0.1", "")
+	expectMapped(s, "a.onion", "10.255.0.6")
+
+	// Forgetting a workstation's mappings leaves the others alone, and
+	// forgetting everything clears every scope.
+	ForgetVirtualAddrs(ws0.ws)
+	expectLookup(ws0, "10.255.0.2", "")
+	expectLookup(ws1, "10.255.0.1", "y.onion")
+	expectLookup(s, "10.255.0.6", "a.onion")
+	ForgetVirtualAddrs(nil)
+	expectLookup(ws1, "10.255.0.1", "")
+	expectLookup(s, "10.255.0.6", "")
+}
+
+func TestMapVirtualAddrWrap(t *testing.T) {
+	ForgetVirtualAddrs(nil)
+	defer ForgetVirtualAddrs(nil)
+
+	// The network and broadcast addresses are never handed out, and once
+	// the network is exhausted, the least recently used address is reused.
+	cfg := loadTestConfig(t, "[VirtualAddr]\nEnable = true\nNetwork = \"10.255.0.0/24\"\n")
+	s := &session{cfg: cfg}
+	names := make(map[string]string)
+	for i := 0; i < 254; i++ {
+		name := string(rune('a'+i%26)) + string(rune('a'+i/26)) + ".onion"
+		ip := s.mapVirtualAddr(name)
+		if ip[3] == 0 || ip[3] == 255 {
+			t.Fatalf("mapVirtualAddr('%s') = %v", name, ip)
+		} else if prev, ok := names[ip.String()]; ok {
+			t.Fatalf("mapVirtualAddr('%s') = %v, already mapped to '%s'", name, ip, prev)
+		}
+		names[ip.String()] = name
+	}
+	s.mapVirtualAddr("aa.onion")
+	if ip := s.mapVirtualAddr("new.onion"); !ip.Equal(net.ParseIP("10.255.0.2")) {
+		t.Errorf("mapVirtualAddr() on a full network = %v, expected 10.255.0.2", ip)
+	}
+	if name, ok := s.lookupVirtualAddr(net.ParseIP("10.255.0.1").To4()); !ok || name != "aa.onion" {
+		t.Errorf("Recently used mapping was evicted")
+	}
+}
+
+func TestVirtualNetworkMath(t *testing.T) {
+	for _, tc := range []struct {
+		cidr     string
+		expected uint64
+	}{
+		{"10.255.0.0/24", 256},
+		{"127.192.0.0/10", 1 << 22},
+		{"fd00::/120", 256},
+		{"fd00::/64", 1 << 32},
+	} {
+		_, ipNet, _ := net.ParseCIDR(tc.cidr)
+		if size := virtualNetworkSize(ipNet); size != tc.expected {
+			t.Errorf("virtualNetworkSize(%s) = %d, expected %d", tc.cidr, size, tc.expected)
+		}
+	}
+
+	for _, tc := range []struct {
+		base     string
+		off      uint64
+		expected string
+	}{
+		{"10.255.0.0", 1, "10.255.0.1"},
+		{"10.255.0.0", 256, "10.255.1.0"},
+		{"127.192.0.0", 0x3fffff, "127.255.255.255"},
+		{"fd00::", 0x10001, "fd00::1:1"},
+	} {
+		base := net.ParseIP(tc.base)
+		if v4 := base.To4(); v4 != nil {
+			base = v4
+		}
+		if ip := offsetIP(base, tc.off); !ip.Equal(net.ParseIP(tc.expected)) {
+			t.Errorf("offsetIP(%s, %d) = %v, expected %s", tc.base, tc.off, ip, tc.expected)
+		}
+	}
+}
+
+func TestUnmapVirtualAddr(t *testing.T) {
+	ForgetVirtualAddrs(nil)
+	defer ForgetVirtualAddrs(nil)
+
+	cfg := loadTestConfig(t, testVirtualAddrConfig)
+	(&session{cfg: cfg}).mapVirtualAddr("a.onion")
+
+	for _, tc := range []struct {
+		dst      string
+		expected string
+		reply    int
+	}{
+		{"10.255.0.1:80", "a.onion:80", -1},
+		{"10.255.0.2:80", "", int(socks5.ReplyHostUnreachable)},
+		{"192.0.2.1:80", "192.0.2.1:80", -1},
+		{"example.com:80", "example.com:80", -1},
+	} {
+		s, conn := newTestSession(t, cfg, "127.0.0.1:40000", tc.dst)
+		err := s.unmapVirtualAddr()
+		if tc.expected == "" {
+			if err != errDstForbidden {
+				t.Errorf("unmapVirtualAddr(%s) = %v, expected errDstForbidden", tc.dst, err)
+			}
+		} else if err != nil || s.req.Addr.String() != tc.expected {
+			t.Errorf("unmapVirtualAddr(%s) = '%s', %v, expected '%s'", tc.dst, s.req.Addr.String(), err, tc.expected)
+		}
+		if conn.replyCode() != tc.reply {
+			t.Errorf("unmapVirtualAddr(%s) reply = %d, expected %d", tc.dst, conn.replyCode(), tc.reply)
+		}
+	}
+}
@@ -0,0 +1,175 @@
+/*
+ * auth_ext.go - Tor SOCKS extended parameters (proposal 351) support.
+ *
+ * To the extent possible under law, Yawning Angel has waived all copyright and
+ * related or neighboring rights to or-ctl-filter, using the creative commons
+ * "cc0" public domain dedication. See LICENSE or
+ * <http://creativecommons.org/publicdomain/zero/1.0/> for full details.
+ */
+
+package socks5
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+const extAuthMagic = "<torS0X>"
+
+// ErrExtAuthFormat is the error returned when an extended parameters username
+// uses an unknown format, or malformed key/value parameters.  Tor rejects
+// such usernames, so they are rejected rather than passed through as an
+// opaque username.
+var ErrExtAuthFormat = errors.New("invalid extended SOCKS username format")
+
+// The extended parameter username formats.
+const (
+	// ExtAuthFormatIsolation is the format where the remainder of the
+	// username and the password are used for stream isolation.
+	ExtAuthFormatIsolation = '0'
+
+	// ExtAuthFormatRPC is the format where the remainder of the username is
+	// an RPC object ID, and the password is used for stream isolation.
+	ExtAuthFormatRPC = '1'
+
+	// ExtAuthFormatParams is the format where the remainder of the username
+	// is a list of space separated key=value parameters (per-stream
+	// options), and the parameters and the password are used for stream
+	// isolation.
+	ExtAuthFormatParams = '2'
+)
+
+// ExtAuthParam is a single key=value parameter of an ExtAuthFormatParams
+// username.
+type ExtAuthParam struct {
+	Key   string
+	Value string
+}
+
+// ExtendedAuth is a decoded Tor SOCKS extended parameters username/password
+// ("<torS0X>" followed by a format code), as specified by proposal 351.
+type ExtendedAuth struct {
+	Format byte
+
+	// UnameData is the remainder of the username after the format code,
+	// for formats other than ExtAuthFormatParams.
+	UnameData []byte
+
+	// Params are the parameters of an ExtAuthFormatParams username, in the
+	// order that they were specified.
+	Params []ExtAuthParam
+
+	// Passwd is the password.
+	Passwd []byte
+}
+
+// ParseExtendedAuth decodes auth as a proposal 351 username/password.  If the
+// username is not in the extended format, nil is returned without an error.
+// Unknown format codes and malformed parameters return ErrExtAuthFormat.
+func ParseExtendedAuth(auth *AuthInfo) (*ExtendedAuth, error) {
+	if !bytes.HasPrefix(auth.Uname, []byte(extAuthMagic)) {
+		return nil, nil
+	}
+
+	rest := auth.Uname[len(extAuthMagic):]
+	if len(rest) == 0 {
+		return nil, fmt.Errorf("extended SOCKS username with no format code")
+	}
+	ea := &ExtendedAuth{
+		Format: rest[0],
+		Passwd: append([]byte{}, auth.Passwd...),
+	}
+	switch ea.Format {
+	case ExtAuthFormatIsolation, ExtAuthFormatRPC:
+		ea.UnameData = append([]byte{}, rest[1:]...)
+	case ExtAuthFormatParams:
+		var err error
+		if ea.Params, err = parseExtAuthParams(string(rest[1:])); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, ErrExtAuthFormat
+	}
+	return ea, nil
+}
+
+func parseExtAuthParams(s string) ([]ExtAuthParam, error) {
+	if s == "" {
+		return nil, nil
+	}
+
+	var params []ExtAuthParam
+	seen := make(map[string]bool)
+	for _, kv := range strings.Split(s, " ") {
+		idx := strings.IndexByte(kv, '=')
+		if idx <= 0 {
+			return nil, ErrExtAuthFormat
+		}
+		p := ExtAuthParam{Key: kv[:idx], Value: kv[idx+1:]}
+		if seen[p.Key] {
+			return nil, ErrExtAuthFormat
+		}
+		seen[p.Key] = true
+		params = append(params, p)
+	}
+	return params, nil
+}
+
+// Param returns the value of a parameter of an ExtAuthFormatParams username.
+func (ea *ExtendedAuth) Param(key string) (string, bool) {
+	for _, p := range ea.Params {
+		if p.Key == key {
+			return p.Value, true
+		}
+	}
+	return "", false
+}
+
+// unameData returns the remainder of the username after the format code.
+func (ea *ExtendedAuth) unameData() []byte {
+	if ea.Format != ExtAuthFormatParams {
+		return ea.UnameData
+	}
+	var kvs []string
+	for _, p := range ea.Params {
+		kvs = append(kvs, p.Key+"="+p.Value)
+	}
+	return []byte(strings.Join(kvs, " "))
+}
+
+// Isolation returns the stream isolation value, which is everything that tor
+// isolates streams on: the password for ExtAuthFormatRPC, and the remainder
+// of the username and the password (separated by a NUL byte) otherwise.
+func (ea *ExtendedAuth) Isolation() []byte {
+	if ea.Format == ExtAuthFormatRPC {
+		return ea.Passwd
+	}
+	uname := ea.unameData()
+	iso := make([]byte, 0, len(uname)+1+len(ea.Passwd))
+	iso = append(iso, uname...)
+	iso = append(iso, 0)
+	return append(iso, ea.Passwd...)
+}
+
+// TagIsolation prefixes the password, which is part of the stream isolation
+// value in every format, with tag.
+func (ea *ExtendedAuth) TagIsolation(tag []byte) {
+	passwd := make([]byte, 0, len(tag)+len(ea.Passwd))
+	passwd = append(passwd, tag...)
+	ea.Passwd = append(passwd, ea.Passwd...)
+}
+
+// AuthInfo encodes the extended parameters as a RFC 1929 username/password.
+func (ea *ExtendedAuth) AuthInfo() (AuthInfo, error) {
+	unameData := ea.unameData()
+	uname := make([]byte, 0, len(extAuthMagic)+1+len(unameData))
+	uname = append(uname, extAuthMagic...)
+	uname = append(uname, ea.Format)
+	uname = append(uname, unameData...)
+	if len(uname) > 255 || len(ea.Passwd) > 255 {
+		return AuthInfo{}, fmt.Errorf("extended SOCKS username/password too long")
+	}
+	return AuthInfo{Uname: uname, Passwd: append([]byte{}, ea.Passwd...)}, nil
+}
@@ -0,0 +1,110 @@
+/*
+ * auth_ext_test.go - Tor SOCKS extended parameters tests.
+ *
+ * To the extent possible under law, Yawning Angel has waived all copyright and
+ * related or neighboring rights to or-ctl-filter, using the creative commons
+ * "cc0" public domain dedication. See LICENSE or
+ * <http://creativecommons.org/publicdomain/zero/1.0/> for full details.
+ */
+
+package socks5
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+func TestParseExtendedAuth(t *testing.T) {
+	for _, tc := range []struct {
+		uname, passwd string
+		ok            bool
+		isolation     string
+		params        []ExtAuthParam
+	}{
+		{"user", "pass", true, "", nil},
+		{"<torS0X>0iso", "pass", true, "iso\x00pass", nil},
+		{"<torS0X>0", "pass", true, "\x00pass", nil},
+		{"<torS0X>1rpc-object", "iso", true, "iso", nil},
+		{"<torS0X>2", "pass", true, "\x00pass", nil},
+		{"<torS0X>2iso=a", "pass", true, "iso=a\x00pass", []ExtAuthParam{{"iso", "a"}}},
+		{"<torS0X>2iso=a opt= x=y=z", "pass", true, "iso=a opt= x=y=z\x00pass", []ExtAuthParam{{"iso", "a"}, {"opt", ""}, {"x", "y=z"}}},
+		{"<torS0X>", "pass", false, "", nil},
+		{"<torS0X>3", "pass", false, "", nil},
+		{"<torS0X>2iso", "pass", false, "", nil},
+		{"<torS0X>2=a", "pass", false, "", nil},
+		{"<torS0X>2iso=a  opt=b", "pass", false, "", nil},
+		{"<torS0X>2iso=a iso=b", "pass", false, "", nil},
+	} {
+		auth := &AuthInfo{Uname: []byte(tc.uname), Passwd: []byte(tc.passwd)}
+		ea, err := ParseExtendedAuth(auth)
+		if !tc.ok {
+			if err == nil {
+				t.Errorf("ParseExtendedAuth('%s') succeeded, expected failure", tc.uname)
+			}
+			continue
+		} else if err != nil {
+			t.Fatalf("ParseExtendedAuth('%s') failed: %v", tc.uname, err)
+		}
+		if ea == nil {
+			if tc.isolation != "" {
+				t.Errorf("ParseExtendedAuth('%s') = nil, expected extended parameters", tc.uname)
+			}
+			continue
+		}
+		if string(ea.Isolation()) != tc.isolation {
+			t.Errorf("ParseExtendedAuth('%s').Isolation() = '%q', expected '%q'", tc.uname, ea.Isolation(), tc.isolation)
+		}
+		if !reflect.DeepEqual(ea.Params, tc.params) {
+			t.Errorf("ParseExtendedAuth('%s').Params = %v, expected %v", tc.uname, ea.Params, tc.params)
+		}
+
+		// Re-encoding must be lossless.
+		reenc, err := ea.AuthInfo()
+		if err != nil {
+			t.Fatalf("AuthInfo() failed: %v", err)
+		}
+		if !bytes.Equal(reenc.Uname, auth.Uname) || !bytes.Equal(reenc.Passwd, auth.Passwd) {
+			t.Errorf("AuthInfo() = '%s'/'%s', expected '%s'/'%s'", reenc.Uname, reenc.Passwd, tc.uname, tc.passwd)
+		}
+	}
+
+	if _, err := ParseExtendedAuth(&AuthInfo{Uname: []byte("<torS0X>3")}); err != ErrExtAuthFormat {
+		t.Errorf("ParseExtendedAuth() with an unknown format = %v, expected ErrExtAuthFormat", err)
+	}
+}
+
+func TestExtendedAuthIsolation(t *testing.T) {
+	parse := func(uname, passwd string) *ExtendedAuth {
+		ea, err := ParseExtendedAuth(&AuthInfo{Uname: []byte(uname), Passwd: []byte(passwd)})
+		if err != nil || ea == nil {
+			t.Fatalf("ParseExtendedAuth('%s') failed: %v", uname, err)
+		}
+		return ea
+	}
+
+	// The password is part of the isolation value in every format, so
+	// clients that only differ by password are isolated from each other.
+	for _, uname := range []string{"<torS0X>0iso", "<torS0X>1rpc-object", "<torS0X>2iso=a"} {
+		if bytes.Equal(parse(uname, "a").Isolation(), parse(uname, "b").Isolation()) {
+			t.Errorf("'%s' with different passwords has the same isolation", uname)
+		}
+	}
+
+	// Tagging changes the isolation, but keeps the username well formed.
+	ea := parse("<torS0X>2iso=a", "pass")
+	ea.TagIsolation([]byte("ws:0:"))
+	auth, err := ea.AuthInfo()
+	if err != nil {
+		t.Fatalf("AuthInfo() failed: %v", err)
+	}
+	if string(auth.Uname) != "<torS0X>2iso=a" || string(auth.Passwd) != "ws:0:pass" {
+		t.Errorf("Tagged AuthInfo() = '%s'/'%s'", auth.Uname, auth.Passwd)
+	}
+	if v, ok := ea.Param("iso"); !ok || v != "a" {
+		t.Errorf("Param(iso) = '%s', %v", v, ok)
+	}
+	if _, ok := ea.Param("missing"); ok {
+		t.Errorf("Param(missing) found a value")
+	}
+}
@@ -10,53 +10,168 @@
 package socks5
 
 import (
+	"context"
 	"fmt"
 	"io"
 	"net"
 	"time"
 )
 
-// Redispatch dials the provided proxy and redispatches an existing request.
-func Redispatch(proxyNet, proxyAddr string, req *Request) (conn net.Conn, bndAddr *Address, err error) {
-	defer func() {
-		if err != nil && conn != nil {
-			conn.Close()
-		}
-	}()
+// Dialer is a SOCKS5 client that establishes connections via a SOCKS5 proxy.
+// It implements the golang.org/x/net/proxy Dialer and ContextDialer
+// interfaces.  Deadlines for the proxy handshake are taken from the context.
+type Dialer struct {
+	// ProxyNetwork and ProxyAddress specify the SOCKS5 proxy.
+	ProxyNetwork string
+	ProxyAddress string
 
-	conn, err = clientHandshake(proxyNet, proxyAddr, req)
-	if err != nil {
-		return nil, nil, err
+	// Auth is the optional RFC 1929 Username/Password credentials.
+	Auth *AuthInfo
+
+	// ProxyDial, if set, is used to connect to the proxy instead of
+	// net.Dialer.
+	ProxyDial func(ctx context.Context, network, addr string) (net.Conn, error)
+}
+
+// Dial connects to the address addr on the network net via the proxy.
+func (d *Dialer) Dial(network, addr string) (net.Conn, error) {
+	return d.DialContext(context.Background(), network, addr)
+}
+
+// DialContext connects to the address addr on the network net via the proxy
+// using the provided context.
+func (d *Dialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	switch network {
+	case "tcp", "tcp4", "tcp6":
+	default:
+		return nil, &net.OpError{Op: "dial", Net: network, Err: fmt.Errorf("unsupported network: %s", network)}
 	}
-	bndAddr, err = clientCmd(conn, req)
-	return
+
+	var dst Address
+	if err := dst.FromString(addr); err != nil {
+		return nil, err
+	}
+	conn, _, err := d.request(ctx, CommandConnect, &dst)
+	return conn, err
 }
 
-func clientHandshake(proxyNet, proxyAddr string, req *Request) (net.Conn, error) {
-	conn, err := net.Dial(proxyNet, proxyAddr)
+// Resolve resolves host via tor's RESOLVE extension.
+func (d *Dialer) Resolve(ctx context.Context, host string) (net.IP, error) {
+	var dst Address
+	if err := dst.FromString(net.JoinHostPort(host, "0")); err != nil {
+		return nil, err
+	}
+	conn, bndAddr, err := d.request(ctx, CommandTorResolve, &dst)
 	if err != nil {
 		return nil, err
 	}
-	if err := conn.SetDeadline(time.Now().Add(requestTimeout)); err != nil {
-		return conn, err
+	conn.Close()
+
+	ip := bndAddr.IP()
+	if ip == nil {
+		return nil, fmt.Errorf("socks5: RESOLVE returned a non-IP address: '%s'", bndAddr.addrStr)
+	}
+	return ip, nil
+}
+
+// ResolvePTR resolves ip to a host name via tor's RESOLVE_PTR extension.
+func (d *Dialer) ResolvePTR(ctx context.Context, ip net.IP) (string, error) {
+	var dst Address
+	if err := dst.FromString(net.JoinHostPort(ip.String(), "0")); err != nil {
+		return "", err
 	}
-	authMethod, err := clientNegotiateAuth(conn, req)
+	conn, bndAddr, err := d.request(ctx, CommandTorResolvePTR, &dst)
 	if err != nil {
-		return conn, err
+		return "", err
 	}
-	if err := clientAuthenticate(conn, req, authMethod); err != nil {
-		return conn, err
+	conn.Close()
+
+	name, _ := bndAddr.HostPort()
+	return name, nil
+}
+
+// Probe connects to the proxy and authenticates, without issuing a command,
+// to check that the proxy is working.
+func (d *Dialer) Probe(ctx context.Context) error {
+	conn, _, err := d.request(ctx, 0, nil)
+	if err != nil {
+		return err
 	}
-	if err := conn.SetDeadline(time.Time{}); err != nil {
-		return conn, err
+	return conn.Close()
+}
+
+// Redispatch dials the provided proxy and redispatches an existing request.
+func Redispatch(ctx context.Context, proxyNet, proxyAddr string, req *Request) (net.Conn, *Address, error) {
+	d := &Dialer{ProxyNetwork: proxyNet, ProxyAddress: proxyAddr}
+	if req.Auth.Uname != nil && req.Auth.Passwd != nil {
+		d.Auth = &req.Auth
+	}
+	return d.request(ctx, req.Cmd, &req.Addr)
+}
+
+func (d *Dialer) request(ctx context.Context, cmd Command, dst *Address) (conn net.Conn, bndAddr *Address, err error) {
+	if d.Auth != nil {
+		if len(d.Auth.Uname) < 1 || len(d.Auth.Uname) > 255 || len(d.Auth.Passwd) > 255 {
+			return nil, nil, fmt.Errorf("socks5: invalid RFC 1929 credential length")
+		}
+	}
+
+	dial := d.ProxyDial
+	if dial == nil {
+		var netDialer net.Dialer
+		dial = netDialer.DialContext
+	}
+	if conn, err = dial(ctx, d.ProxyNetwork, d.ProxyAddress); err != nil {
+		return nil, nil, err
 	}
 
-	return conn, nil
+	// Bound the handshake by the context's deadline, and abort it if the
+	// context is canceled.
+	if deadline, ok := ctx.Deadline(); ok {
+		if err = conn.SetDeadline(deadline); err != nil {
+			conn.Close()
+			return nil, nil, err
+		}
+	}
+	stopChan, doneChan := make(chan struct{}), make(chan struct{})
+	go func() {
+		defer close(doneChan)
+		select {
+		case <-ctx.Done():
+			conn.SetDeadline(time.Unix(1, 0))
+		case <-stopChan:
+		}
+	}()
+	defer func() {
+		close(stopChan)
+		<-doneChan
+		if ctx.Err() != nil {
+			err = ctx.Err()
+		} else if err == nil {
+			err = conn.SetDeadline(time.Time{})
+		}
+		if err != nil {
+			conn.Close()
+			conn, bndAddr = nil, nil
+		}
+	}()
+
+	var authMethod byte
+	if authMethod, err = clientNegotiateAuth(conn, d.Auth); err != nil {
+		return
+	}
+	if err = clientAuthenticate(conn, d.Auth, authMethod); err != nil {
+		return
+	} else if dst == nil {
+		// Probe, there is no command to send.
+		return
+	}
+	bndAddr, err = clientCmd(conn, cmd, dst)
+	return
 }
 
-func clientNegotiateAuth(conn net.Conn, req *Request) (byte, error) {
-	useRFC1929 := req.Auth.Uname != nil && req.Auth.Passwd != nil
-	// XXX: Validate uname/passwd lengths, though should always be valid.
+func clientNegotiateAuth(conn net.Conn, auth *AuthInfo) (byte, error) {
+	useRFC1929 := auth != nil
 
 	var buf [3]byte
 	buf[0] = version
@@ -85,16 +200,16 @@ func clientNegotiateAuth(conn net.Conn, req *Request) (byte, error) {
 	return resp[1], nil
 }
 
-func clientAuthenticate(conn net.Conn, req *Request, authMethod byte) error {
+func clientAuthenticate(conn net.Conn, auth *AuthInfo, authMethod byte) error {
 	switch authMethod {
 	case authNoneRequired:
 	case authUsernamePassword:
 		var buf []byte
 		buf = append(buf, authRFC1929Ver)
-		buf = append(buf, byte(len(req.Auth.Uname)))
-		buf = append(buf, req.Auth.Uname...)
-		buf = append(buf, byte(len(req.Auth.Passwd)))
-		buf = append(buf, req.Auth.Passwd...)
+		buf = append(buf, byte(len(auth.Uname)))
+		buf = append(buf, auth.Uname...)
+		buf = append(buf, byte(len(auth.Passwd)))
+		buf = append(buf, auth.Passwd...)
 		if _, err := conn.Write(buf); err != nil {
 			return err
 		}
@@ -115,12 +230,12 @@ func clientAuthenticate(conn net.Conn, req *Request, authMethod byte) error {
 	return nil
 }
 
-func clientCmd(conn net.Conn, req *Request) (*Address, error) {
+func clientCmd(conn net.Conn, cmd Command, dst *Address) (*Address, error) {
 	var buf []byte
 	buf = append(buf, version)
-	buf = append(buf, byte(req.Cmd))
+	buf = append(buf, byte(cmd))
 	buf = append(buf, rsv)
-	buf = append(buf, req.Addr.raw...)
+	buf = append(buf, dst.raw...)
 	if _, err := conn.Write(buf); err != nil {
 		return nil, err
 	}
@@ -134,7 +249,7 @@ func clientCmd(conn net.Conn, req *Request) (*Address, error) {
 		return nil, err
 	}
 	if err := validateByte("rep", respHdr[1], byte(ReplySucceeded)); err != nil {
-		return nil, clientError(respHdr[1])
+		return nil, ReplyError(respHdr[1])
 	}
 	if err := validateByte("rsv", respHdr[2], rsv); err != nil {
 		return nil, err
@@ -145,9 +260,5 @@ func clientCmd(conn net.Conn, req *Request) (*Address, error) {
 		return nil, err
 	}
 
-	if err := conn.SetDeadline(time.Time{}); err != nil {
-		return nil, err
-	}
-
 	return &bndAddr, nil
 }
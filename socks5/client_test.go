@@ -0,0 +1,266 @@
+/*
+ * client_test.go - SOCSK5 client tests.
+ *
+ * To the extent possible under law, Yawning Angel has waived all copyright and
+ * related or neighboring rights to or-ctl-filter, using the creative commons
+ * "cc0" public domain dedication. See LICENSE or
+ * <http://creativecommons.org/publicdomain/zero/1.0/> for full details.
+ */
+
+package socks5
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// testHandler is a Handler that echoes back CONNECTs, and resolves every
+// host to a fixed address.  Requests for "refused.example" are rejected.
+type testHandler struct{}
+
+func (h *testHandler) Connect(ctx context.Context, conn net.Conn, req *Request) {
+	if host, _ := req.Addr.HostPort(); host == "refused.example" {
+		req.Reply(ReplyConnectionRefused)
+		return
+	}
+
+	var bndAddr Address
+	bndAddr.FromString("192.0.2.1:1234")
+	if req.ReplyAddr(ReplySucceeded, &bndAddr) != nil {
+		return
+	}
+	io.Copy(conn, conn)
+}
+
+func (h *testHandler) Resolve(ctx context.Context, conn net.Conn, req *Request) {
+	host, _ := req.Addr.HostPort()
+	if host == "refused.example" {
+		req.Reply(ReplyHostUnreachable)
+		return
+	}
+
+	var addr Address
+	if req.Cmd == CommandTorResolvePTR {
+		addr.FromString("ptr.example:0")
+	} else {
+		addr.FromString("192.0.2.2:0")
+	}
+	req.ReplyAddr(ReplySucceeded, &addr)
+}
+
+// testAuthenticator accepts every username except "bad".
+type testAuthenticator struct{}
+
+func (a *testAuthenticator) Authenticate(conn net.Conn, auth *AuthInfo) (interface{}, error) {
+	if string(auth.Uname) == "bad" {
+		return nil, errors.New("bad username")
+	}
+	return string(auth.Uname), nil
+}
+
+// newTestServer starts a Server with the testHandler on a loopback listener.
+func newTestServer(t *testing.T, cfg *ServerConfig) (*Server, string) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	srv := NewServer(&testHandler{}, cfg)
+	go srv.Serve(context.Background(), ln)
+	return srv, ln.Addr().String()
+}
+
+// newSilentListener returns a listener that accepts connections, and never
+// replies to anything sent over them.
+func newSilentListener(t *testing.T) net.Listener {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go io.Copy(io.Discard, conn)
+		}
+	}()
+	return ln
+}
+
+func testContext() (context.Context, context.CancelFunc) {
+	return context.WithTimeout(context.Background(), 5*time.Second)
+}
+
+func TestDialerDialContext(t *testing.T) {
+	srv, addr := newTestServer(t, &ServerConfig{Authenticator: &testAuthenticator{}})
+	defer srv.Close()
+
+	ctx, cancel := testContext()
+	defer cancel()
+
+	for _, tc := range []struct {
+		name string
+		auth *AuthInfo
+	}{
+		{"NoAuth", nil},
+		{"RFC1929", &AuthInfo{Uname: []byte("user"), Passwd: []byte("pass")}},
+		{"ExtendedAuth", &AuthInfo{Uname: []byte("<torS0X>0iso"), Passwd: []byte("pass")}},
+	} {
+		d := &Dialer{ProxyNetwork: "tcp", ProxyAddress: addr, Auth: tc.auth}
+		conn, err := d.DialContext(ctx, "tcp", "example.com:443")
+		if err != nil {
+			t.Fatalf("%s: DialContext failed: %v", tc.name, err)
+		}
+
+		// The handshake deadline must be cleared, and the connection
+		// usable for data.
+		msg := []byte("hello " + tc.name)
+		if _, err = conn.Write(msg); err != nil {
+			t.Fatalf("%s: Write failed: %v", tc.name, err)
+		}
+		buf := make([]byte, len(msg))
+		if _, err = io.ReadFull(conn, buf); err != nil {
+			t.Fatalf("%s: Read failed: %v", tc.name, err)
+		}
+		if !bytes.Equal(buf, msg) {
+			t.Errorf("%s: Echoed '%s', expected '%s'", tc.name, buf, msg)
+		}
+		conn.Close()
+	}
+}
+
+func TestDialerErrors(t *testing.T) {
+	srv, addr := newTestServer(t, &ServerConfig{
+		Authenticator:   &testAuthenticator{},
+		AllowedCommands: []Command{CommandConnect},
+	})
+	defer srv.Close()
+
+	ctx, cancel := testContext()
+	defer cancel()
+
+	d := &Dialer{ProxyNetwork: "tcp", ProxyAddress: addr}
+
+	// Failure replies are returned as ReplyError.
+	if _, err := d.DialContext(ctx, "tcp", "refused.example:80"); err != ReplyError(ReplyConnectionRefused) {
+		t.Errorf("DialContext(refused.example) = %v, expected ReplyConnectionRefused", err)
+	}
+	if _, err := d.Resolve(ctx, "example.com"); err != ReplyError(ReplyCommandNotSupported) {
+		t.Errorf("Resolve() with RESOLVE disallowed = %v, expected ReplyCommandNotSupported", err)
+	}
+
+	// Rejected credentials fail the handshake.
+	d.Auth = &AuthInfo{Uname: []byte("bad"), Passwd: []byte("pass")}
+	if _, err := d.DialContext(ctx, "tcp", "example.com:443"); err == nil {
+		t.Errorf("DialContext() with rejected credentials succeeded")
+	}
+	if err := d.Probe(ctx); err == nil {
+		t.Errorf("Probe() with rejected credentials succeeded")
+	}
+
+	// Invalid requests fail without connecting to the proxy.
+	nrDials := 0
+	d = &Dialer{
+		ProxyNetwork: "tcp",
+		ProxyAddress: addr,
+		ProxyDial: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			nrDials++
+			var netDialer net.Dialer
+			return netDialer.DialContext(ctx, network, addr)
+		},
+	}
+	if _, err := d.DialContext(ctx, "udp", "example.com:53"); err == nil {
+		t.Errorf("DialContext(udp) succeeded")
+	} else if _, ok := err.(*net.OpError); !ok {
+		t.Errorf("DialContext(udp) = %v, expected a *net.OpError", err)
+	}
+	if _, err := d.DialContext(ctx, "tcp", "example.com"); err == nil {
+		t.Errorf("DialContext() without a port succeeded")
+	}
+	for _, auth := range []*AuthInfo{
+		{Uname: []byte{}, Passwd: []byte("pass")},
+		{Uname: bytes.Repeat([]byte{'u'}, 256), Passwd: []byte("pass")},
+		{Uname: []byte("user"), Passwd: bytes.Repeat([]byte{'p'}, 256)},
+	} {
+		d.Auth = auth
+		if _, err := d.DialContext(ctx, "tcp", "example.com:443"); err == nil {
+			t.Errorf("DialContext() with a %d/%d byte username/password succeeded", len(auth.Uname), len(auth.Passwd))
+		}
+	}
+	if nrDials != 0 {
+		t.Errorf("Invalid requests dialed the proxy %d times", nrDials)
+	}
+}
+
+func TestDialerResolve(t *testing.T) {
+	srv, addr := newTestServer(t, nil)
+	defer srv.Close()
+
+	ctx, cancel := testContext()
+	defer cancel()
+
+	d := &Dialer{ProxyNetwork: "tcp", ProxyAddress: addr}
+	ip, err := d.Resolve(ctx, "example.com")
+	if err != nil {
+		t.Fatalf("Resolve() failed: %v", err)
+	}
+	if !ip.Equal(net.ParseIP("192.0.2.2")) {
+		t.Errorf("Resolve() = %v, expected 192.0.2.2", ip)
+	}
+	if _, err = d.Resolve(ctx, "refused.example"); err != ReplyError(ReplyHostUnreachable) {
+		t.Errorf("Resolve(refused.example) = %v, expected ReplyHostUnreachable", err)
+	}
+
+	name, err := d.ResolvePTR(ctx, net.ParseIP("192.0.2.2"))
+	if err != nil {
+		t.Fatalf("ResolvePTR() failed: %v", err)
+	}
+	if name != "ptr.example" {
+		t.Errorf("ResolvePTR() = '%s', expected 'ptr.example'", name)
+	}
+
+	if err = d.Probe(ctx); err != nil {
+		t.Errorf("Probe() failed: %v", err)
+	}
+}
+
+func TestDialerContext(t *testing.T) {
+	ln := newSilentListener(t)
+	defer ln.Close()
+
+	d := &Dialer{ProxyNetwork: "tcp", ProxyAddress: ln.Addr().String()}
+
+	// A proxy that never replies is bounded by the context's deadline.
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if _, err := d.DialContext(ctx, "tcp", "example.com:443"); err != context.DeadlineExceeded {
+		t.Errorf("DialContext() with a deadline = %v, expected context.DeadlineExceeded", err)
+	}
+
+	// Canceling the context aborts the handshake.
+	ctx, cancel = context.WithCancel(context.Background())
+	time.AfterFunc(100*time.Millisecond, cancel)
+	doneChan := make(chan error, 1)
+	go func() {
+		doneChan <- d.Probe(ctx)
+	}()
+	select {
+	case err := <-doneChan:
+		if err != context.Canceled {
+			t.Errorf("Probe() when canceled = %v, expected context.Canceled", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Probe() did not return after the context was canceled")
+	}
+
+	// An already canceled context never completes a request.
+	if _, err := d.Resolve(ctx, "example.com"); err == nil {
+		t.Errorf("Resolve() with a canceled context succeeded")
+	}
+}
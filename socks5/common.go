@@ -12,11 +12,15 @@
 //
 // Notes:
 //  * GSSAPI authentication, is NOT supported.
-//  * The authentication provided by the client is always accepted.
+//  * The server also accepts SOCKS 4/4a requests, which are presented as
+//    SOCKS5 requests, and replied to in the SOCKS 4 format.
+//  * The authentication provided by the client is accepted, unless the Server
+//    is configured with an Authenticator.
 //  * A lot of the code is shamelessly stolen from obfs4proxy.
 package socks5
 
 import (
+	"bufio"
 	"errors"
 	"fmt"
 	"io"
@@ -39,7 +43,6 @@ const (
 	authNoAcceptableMethods = 0xff
 
 	inboundTimeout = 5 * time.Second
-	requestTimeout = 30 * time.Second
 )
 
 var errInvalidAtyp = errors.New("invalid address type")
@@ -60,12 +63,26 @@ const (
 	ReplyAddressNotSupported
 )
 
+// The extended reply codes used by tor for onion service failures.  See
+// tor's socks-extensions.txt for more details.
+const (
+	ReplyOnionDescNotFound      ReplyCode = 0xf0
+	ReplyOnionDescInvalid       ReplyCode = 0xf1
+	ReplyOnionIntroFailed       ReplyCode = 0xf2
+	ReplyOnionRendezvousFailed  ReplyCode = 0xf3
+	ReplyOnionMissingClientAuth ReplyCode = 0xf4
+	ReplyOnionWrongClientAuth   ReplyCode = 0xf5
+	ReplyOnionInvalidAddress    ReplyCode = 0xf6
+	ReplyOnionIntroTimedOut     ReplyCode = 0xf7
+)
+
 // Command is a SOCKS 5 command.
 type Command byte
 
 // The various SOCKS 5 commands.
 const (
 	CommandConnect       Command = 0x01
+	CommandUDPAssociate  Command = 0x03
 	CommandTorResolve    Command = 0xf0
 	CommandTorResolvePTR Command = 0xf1
 )
@@ -102,6 +119,7 @@ func (addr *Address) FromString(addrStr string) (err error) {
 			return fmt.Errorf("invalid FQDN, len > 255 bytes (%d bytes)", len(addr.addrStr))
 		}
 		raw = append(raw, atypDomainName)
+		raw = append(raw, byte(len(addr.addrStr)))
 		raw = append(raw, addr.addrStr...)
 	}
 
@@ -128,72 +146,65 @@ func (addr *Address) HostPort() (string, string) {
 	return addr.addrStr, addr.portStr
 }
 
-func (addr *Address) read(conn net.Conn) (err error) {
+func (addr *Address) read(r io.Reader) (err error) {
 	// The address looks like:
 	//  uint8_t atyp
 	//  uint8_t addr[] (Length depends on atyp)
 	//  uint16_t port
 
-	// Read the atype.
+	// Read the atype, and determine the address length.
 	var atyp byte
-	if atyp, err = readByte(conn); err != nil {
+	if atyp, err = readByte(r); err != nil {
 		return
 	}
-	addr.raw = append(addr.raw, atyp)
-
-	// Read the address.
-	var rawAddr []byte
+	hdrLen, alen := 1, 0
 	switch atyp {
 	case atypIPv4:
-		rawAddr = make([]byte, net.IPv4len)
-		if _, err = io.ReadFull(conn, rawAddr); err != nil {
-			return
-		}
-		v4Addr := net.IPv4(rawAddr[0], rawAddr[1], rawAddr[2], rawAddr[3])
-		addr.addrStr = v4Addr.String()
+		alen = net.IPv4len
+	case atypIPv6:
+		alen = net.IPv6len
 	case atypDomainName:
-		var alen byte
-		if alen, err = readByte(conn); err != nil {
+		var l byte
+		if l, err = readByte(r); err != nil {
 			return
 		}
-		if alen == 0 {
+		if l == 0 {
 			return fmt.Errorf("domain name with 0 length")
 		}
-		rawAddr = make([]byte, alen)
-		addr.raw = append(addr.raw, alen)
-		if _, err = io.ReadFull(conn, rawAddr); err != nil {
-			return
-		}
-		addr.addrStr = string(rawAddr)
-	case atypIPv6:
-		rawAddr = make([]byte, net.IPv6len)
-		if _, err = io.ReadFull(conn, rawAddr); err != nil {
-			return
-		}
-		v6Addr := make(net.IP, net.IPv6len)
-		copy(v6Addr[:], rawAddr)
-		addr.addrStr = fmt.Sprintf("[%s]", v6Addr.String())
+		hdrLen, alen = 2, int(l)
 	default:
 		return errInvalidAtyp
 	}
-	addr.raw = append(addr.raw, rawAddr...)
 
-	// Read the port.
-	var rawPort [2]byte
-	if _, err = io.ReadFull(conn, rawPort[:]); err != nil {
+	// Read the address and port in one go.
+	raw := make([]byte, hdrLen+alen+2)
+	raw[0] = atyp
+	if atyp == atypDomainName {
+		raw[1] = byte(alen)
+	}
+	if _, err = io.ReadFull(r, raw[hdrLen:]); err != nil {
 		return
 	}
-	port := int(rawPort[0])<<8 | int(rawPort[1])
-	addr.portStr = fmt.Sprintf("%d", port)
-	addr.raw = append(addr.raw, rawPort[:]...)
+	rawAddr := raw[hdrLen : hdrLen+alen]
+	switch atyp {
+	case atypIPv4:
+		addr.addrStr = net.IP(rawAddr).String()
+	case atypIPv6:
+		addr.addrStr = "[" + net.IP(rawAddr).String() + "]"
+	case atypDomainName:
+		addr.addrStr = string(rawAddr)
+	}
+	port := int(raw[hdrLen+alen])<<8 | int(raw[hdrLen+alen+1])
+	addr.portStr = strconv.Itoa(port)
+	addr.raw = raw
 
 	return
 }
 
 // ErrorToReplyCode converts an error to the "best" reply code.
 func ErrorToReplyCode(err error) ReplyCode {
-	if cErr, ok := err.(clientError); ok {
-		return ReplyCode(cErr)
+	if rErr, ok := err.(ReplyError); ok {
+		return ReplyCode(rErr)
 	}
 	opErr, ok := err.(*net.OpError)
 	if !ok {
@@ -226,12 +237,28 @@ type Request struct {
 	Cmd  Command
 	Addr Address
 
-	conn net.Conn
+	// ExtAuth is the decoded Tor extended parameters username, if any.
+	ExtAuth *ExtendedAuth
+
+	// User is the value returned by the Server's Authenticator, if any.
+	User interface{}
+
+	conn     net.Conn
+	rd       *bufio.Reader
+	cfg      *handshakeConfig
+	isSOCKS4 bool
+}
+
+// IsSOCKS4 returns true iff the request was made via SOCKS 4/4a.
+func (req *Request) IsSOCKS4() bool {
+	return req.isSOCKS4
 }
 
-type clientError ReplyCode
+// ReplyError is the error returned by the client when the proxy replies with
+// a failure code.
+type ReplyError ReplyCode
 
-func (e clientError) Error() string {
+func (e ReplyError) Error() string {
 	switch ReplyCode(e) {
 	case ReplySucceeded:
 		return "socks5: succeeded"
@@ -251,14 +278,34 @@ func (e clientError) Error() string {
 		return "socks5: command not supported"
 	case ReplyAddressNotSupported:
 		return "socks5: address not supported"
+	case ReplyOnionDescNotFound:
+		return "socks5: onion service descriptor not found"
+	case ReplyOnionDescInvalid:
+		return "socks5: onion service descriptor invalid"
+	case ReplyOnionIntroFailed:
+		return "socks5: onion service introduction failed"
+	case ReplyOnionRendezvousFailed:
+		return "socks5: onion service rendezvous failed"
+	case ReplyOnionMissingClientAuth:
+		return "socks5: onion service missing client authorization"
+	case ReplyOnionWrongClientAuth:
+		return "socks5: onion service wrong client authorization"
+	case ReplyOnionInvalidAddress:
+		return "socks5: onion service invalid address"
+	case ReplyOnionIntroTimedOut:
+		return "socks5: onion service introduction timed out"
 	default:
-		return fmt.Sprintf("socks5: reply code: 0x%02x", e)
+		return fmt.Sprintf("socks5: reply code: 0x%02x", byte(e))
 	}
 }
 
-func readByte(conn net.Conn) (byte, error) {
+func readByte(r io.Reader) (byte, error) {
+	if br, ok := r.(io.ByteReader); ok {
+		return br.ReadByte()
+	}
+
 	var tmp [1]byte
-	if _, err := conn.Read(tmp[:]); err != nil {
+	if _, err := io.ReadFull(r, tmp[:]); err != nil {
 		return 0, err
 	}
 	return tmp[0], nil
@@ -0,0 +1,100 @@
+/*
+ * common_test.go - SOCSK5 common routine tests/benchmarks.
+ *
+ * To the extent possible under law, Yawning Angel has waived all copyright and
+ * related or neighboring rights to or-ctl-filter, using the creative commons
+ * "cc0" public domain dedication. See LICENSE or
+ * <http://creativecommons.org/publicdomain/zero/1.0/> for full details.
+ */
+
+package socks5
+
+import (
+	"bufio"
+	"bytes"
+	"net"
+	"testing"
+)
+
+var (
+	rawAddrIPv4   = []byte{atypIPv4, 192, 0, 2, 1, 0x01, 0xbb}
+	rawAddrIPv6   = []byte{atypIPv6, 0x20, 0x01, 0x0d, 0xb8, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1, 0x00, 0x50}
+	rawAddrDomain = []byte{atypDomainName, 11, 'e', 'x', 'a', 'm', 'p', 'l', 'e', '.', 'c', 'o', 'm', 0x00, 0x50}
+)
+
+func TestAddressRead(t *testing.T) {
+	for _, tc := range []struct {
+		raw      []byte
+		expected string
+	}{
+		{rawAddrIPv4, "192.0.2.1:443"},
+		{rawAddrIPv6, "[2001:db8::1]:80"},
+		{rawAddrDomain, "example.com:80"},
+	} {
+		var addr Address
+		if err := addr.read(bytes.NewReader(tc.raw)); err != nil {
+			t.Fatalf("read(%v) failed: %v", tc.raw, err)
+		}
+		if addr.String() != tc.expected {
+			t.Errorf("read(%v) = '%s', expected '%s'", tc.raw, addr.String(), tc.expected)
+		}
+
+		// FromString must produce the same wire representation.
+		var addr2 Address
+		if err := addr2.FromString(tc.expected); err != nil {
+			t.Fatalf("FromString('%s') failed: %v", tc.expected, err)
+		}
+		if !bytes.Equal(addr2.raw, tc.raw) {
+			t.Errorf("FromString('%s') = %v, expected %v", tc.expected, addr2.raw, tc.raw)
+		}
+	}
+}
+
+func benchmarkAddressRead(b *testing.B, raw []byte) {
+	var rd bytes.Reader
+	brd := bufio.NewReader(&rd)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		rd.Reset(raw)
+		brd.Reset(&rd)
+		var addr Address
+		if err := addr.read(brd); err != nil {
+			b.Fatalf("read failed: %v", err)
+		}
+	}
+}
+
+func BenchmarkAddressReadIPv4(b *testing.B) {
+	benchmarkAddressRead(b, rawAddrIPv4)
+}
+
+func BenchmarkAddressReadIPv6(b *testing.B) {
+	benchmarkAddressRead(b, rawAddrIPv6)
+}
+
+func BenchmarkAddressReadDomain(b *testing.B) {
+	benchmarkAddressRead(b, rawAddrDomain)
+}
+
+func FuzzAddressRead(f *testing.F) {
+	f.Add(rawAddrIPv4)
+	f.Add(rawAddrIPv6)
+	f.Add(rawAddrDomain)
+	f.Fuzz(func(t *testing.T, data []byte) {
+		rd := bytes.NewReader(data)
+		var addr Address
+		if err := addr.read(rd); err != nil {
+			return
+		}
+
+		// The wire representation must be exactly what was consumed.
+		consumed := data[:len(data)-rd.Len()]
+		if !bytes.Equal(addr.raw, consumed) {
+			t.Fatalf("raw = %v, consumed %v", addr.raw, consumed)
+		}
+		if _, _, err := net.SplitHostPort(addr.String()); err != nil && addr.raw[0] != atypDomainName {
+			t.Fatalf("read returned an invalid address: %v", err)
+		}
+	})
+}
@@ -0,0 +1,301 @@
+/*
+ * listener.go - Reusable SOCKS5 server.
+ *
+ * To the extent possible under law, Yawning Angel has waived all copyright and
+ * related or neighboring rights to or-ctl-filter, using the creative commons
+ * "cc0" public domain dedication. See LICENSE or
+ * <http://creativecommons.org/publicdomain/zero/1.0/> for full details.
+ */
+
+package socks5
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"time"
+)
+
+const shutdownPollInterval = 100 * time.Millisecond
+
+// ErrServerClosed is returned by Server.Serve after Shutdown or Close is
+// called.
+var ErrServerClosed = errors.New("socks5: server closed")
+
+// Handler services requests accepted by a Server.  Handlers are responsible
+// for sending the reply via Request.Reply/Request.ReplyAddr, and the client
+// connection is closed when the handler returns.  Reads from the connection
+// passed to the handler return any data the client sent after the request.
+type Handler interface {
+	// Connect services a CONNECT request.
+	Connect(ctx context.Context, conn net.Conn, req *Request)
+
+	// Resolve services a tor RESOLVE or RESOLVE_PTR request.
+	Resolve(ctx context.Context, conn net.Conn, req *Request)
+}
+
+// UDPAssociateHandler is implemented by Handlers that support UDP ASSOCIATE.
+// The association should last until the client connection is closed.
+type UDPAssociateHandler interface {
+	UDPAssociate(ctx context.Context, conn net.Conn, req *Request)
+}
+
+// Authenticator validates the credentials supplied by a client, either via
+// RFC 1929 Username/Password authentication, or the SOCKS 4 USERID.  The
+// returned value is made available to the Handler as Request.User.
+type Authenticator interface {
+	Authenticate(conn net.Conn, auth *AuthInfo) (interface{}, error)
+}
+
+// ServerConfig is the per-Server configuration.
+type ServerConfig struct {
+	// HandshakeTimeout is the maximum duration allowed for the handshake.
+	// If 0, a default of 5 seconds is used.
+	HandshakeTimeout time.Duration
+
+	// Authenticator, if set, validates client supplied credentials.
+	Authenticator Authenticator
+
+	// RequireAuth rejects clients that do not supply credentials.
+	RequireAuth bool
+
+	// AllowedCommands is the set of commands that will be passed to the
+	// Handler.  If nil, all commands supported by the Handler are allowed.
+	AllowedCommands []Command
+
+	// OnHandshakeError, if set, is called when a client handshake fails.
+	OnHandshakeError func(conn net.Conn, err error)
+
+	// ConnContext, if set, modifies the context passed to the Handler for
+	// a newly accepted connection.
+	ConnContext func(ctx context.Context, conn net.Conn) context.Context
+}
+
+// handshakeConfig is the configuration used by the handshake routines.
+type handshakeConfig struct {
+	timeout     time.Duration
+	auth        Authenticator
+	requireAuth bool
+	allowed     map[Command]bool
+}
+
+func (cfg *handshakeConfig) allowsCommand(cmd Command) bool {
+	return cfg.allowed == nil || cfg.allowed[cmd]
+}
+
+var defaultHandshakeConfig = handshakeConfig{timeout: inboundTimeout}
+
+// Server is a SOCKS5 server that dispatches requests to a Handler.
+type Server struct {
+	handler    Handler
+	udpHandler UDPAssociateHandler
+	hsCfg      handshakeConfig
+	onHsErr    func(net.Conn, error)
+	connCtx    func(context.Context, net.Conn) context.Context
+
+	lock      sync.Mutex
+	listeners map[net.Listener]bool
+	conns     map[net.Conn]context.CancelFunc
+	closed    bool
+}
+
+// NewServer creates a new Server that dispatches to handler, with the
+// optional configuration cfg.
+func NewServer(handler Handler, cfg *ServerConfig) *Server {
+	if cfg == nil {
+		cfg = &ServerConfig{}
+	}
+
+	srv := &Server{
+		handler:   handler,
+		onHsErr:   cfg.OnHandshakeError,
+		connCtx:   cfg.ConnContext,
+		listeners: make(map[net.Listener]bool),
+		conns:     make(map[net.Conn]context.CancelFunc),
+	}
+	srv.udpHandler, _ = handler.(UDPAssociateHandler)
+
+	srv.hsCfg.timeout = cfg.HandshakeTimeout
+	if srv.hsCfg.timeout == 0 {
+		srv.hsCfg.timeout = inboundTimeout
+	}
+	srv.hsCfg.auth = cfg.Authenticator
+	srv.hsCfg.requireAuth = cfg.RequireAuth
+
+	cmds := cfg.AllowedCommands
+	if cmds == nil {
+		cmds = []Command{CommandConnect, CommandUDPAssociate, CommandTorResolve, CommandTorResolvePTR}
+	}
+	srv.hsCfg.allowed = make(map[Command]bool)
+	for _, cmd := range cmds {
+		if cmd == CommandUDPAssociate && srv.udpHandler == nil {
+			continue
+		}
+		srv.hsCfg.allowed[cmd] = true
+	}
+
+	return srv
+}
+
+// Serve accepts connections on ln and services them, until ctx is done, or
+// the Server is shut down.  The listener is closed when Serve returns.
+func (srv *Server) Serve(ctx context.Context, ln net.Listener) error {
+	if !srv.trackListener(ln, true) {
+		ln.Close()
+		return ErrServerClosed
+	}
+	defer srv.trackListener(ln, false)
+	defer ln.Close()
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go func() {
+		<-ctx.Done()
+		ln.Close()
+	}()
+
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if srv.isClosed() {
+				return ErrServerClosed
+			} else if ctx.Err() != nil {
+				return ctx.Err()
+			} else if e, ok := err.(net.Error); ok && e.Temporary() {
+				continue
+			}
+			return err
+		}
+
+		connCtx, connCancel := context.WithCancel(ctx)
+		if srv.connCtx != nil {
+			connCtx = srv.connCtx(connCtx, conn)
+		}
+		if !srv.trackConn(conn, connCancel) {
+			connCancel()
+			conn.Close()
+			return ErrServerClosed
+		}
+		go srv.serveConn(connCtx, conn)
+	}
+}
+
+// Shutdown gracefully shuts down the Server, by closing all listeners, and
+// waiting for active connections to finish.  If ctx is done before all
+// connections finish, the remaining connections are forcefully closed and
+// the context's error is returned.
+func (srv *Server) Shutdown(ctx context.Context) error {
+	srv.closeListeners()
+
+	ticker := time.NewTicker(shutdownPollInterval)
+	defer ticker.Stop()
+	for {
+		if srv.numConns() == 0 {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			srv.closeConns()
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// Close immediately closes all listeners and active connections.
+func (srv *Server) Close() error {
+	srv.closeListeners()
+	srv.closeConns()
+	return nil
+}
+
+func (srv *Server) serveConn(ctx context.Context, conn net.Conn) {
+	defer srv.trackConn(conn, nil)
+	defer conn.Close()
+
+	req, err := handshake(conn, &srv.hsCfg)
+	if err != nil {
+		if srv.onHsErr != nil {
+			srv.onHsErr(conn, err)
+		}
+		return
+	}
+
+	switch req.Cmd {
+	case CommandConnect:
+		srv.handler.Connect(ctx, req.Conn(), req)
+	case CommandTorResolve, CommandTorResolvePTR:
+		srv.handler.Resolve(ctx, req.Conn(), req)
+	case CommandUDPAssociate:
+		srv.udpHandler.UDPAssociate(ctx, req.Conn(), req)
+	default:
+		// Should *NEVER* happen, validated as part of handshake.
+		panic("BUG: unsupported SOCKS command")
+	}
+}
+
+func (srv *Server) trackListener(ln net.Listener, add bool) bool {
+	srv.lock.Lock()
+	defer srv.lock.Unlock()
+
+	if add {
+		if srv.closed {
+			return false
+		}
+		srv.listeners[ln] = true
+	} else {
+		delete(srv.listeners, ln)
+	}
+	return true
+}
+
+func (srv *Server) trackConn(conn net.Conn, cancel context.CancelFunc) bool {
+	srv.lock.Lock()
+	defer srv.lock.Unlock()
+
+	if cancel != nil {
+		if srv.closed {
+			return false
+		}
+		srv.conns[conn] = cancel
+	} else if cancelFn, ok := srv.conns[conn]; ok {
+		cancelFn()
+		delete(srv.conns, conn)
+	}
+	return true
+}
+
+func (srv *Server) isClosed() bool {
+	srv.lock.Lock()
+	defer srv.lock.Unlock()
+
+	return srv.closed
+}
+
+func (srv *Server) numConns() int {
+	srv.lock.Lock()
+	defer srv.lock.Unlock()
+
+	return len(srv.conns)
+}
+
+func (srv *Server) closeListeners() {
+	srv.lock.Lock()
+	defer srv.lock.Unlock()
+
+	srv.closed = true
+	for ln := range srv.listeners {
+		ln.Close()
+	}
+}
+
+func (srv *Server) closeConns() {
+	srv.lock.Lock()
+	defer srv.lock.Unlock()
+
+	for conn, cancel := range srv.conns {
+		cancel()
+		conn.Close()
+	}
+}
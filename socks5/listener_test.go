@@ -0,0 +1,253 @@
+/*
+ * listener_test.go - Reusable SOCKS5 server tests.
+ *
+ * To the extent possible under law, Yawning Angel has waived all copyright and
+ * related or neighboring rights to or-ctl-filter, using the creative commons
+ * "cc0" public domain dedication. See LICENSE or
+ * <http://creativecommons.org/publicdomain/zero/1.0/> for full details.
+ */
+
+package socks5
+
+import (
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// serveTestServer runs srv on a loopback listener, and returns the address,
+// and a channel that receives the return value of Serve.
+func serveTestServer(t *testing.T, ctx context.Context, srv *Server) (string, chan error) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	errChan := make(chan error, 1)
+	go func() {
+		errChan <- srv.Serve(ctx, ln)
+	}()
+	return ln.Addr().String(), errChan
+}
+
+func waitServe(t *testing.T, errChan chan error) error {
+	select {
+	case err := <-errChan:
+		return err
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Serve did not return")
+	}
+	return nil
+}
+
+// dialEcho CONNECTs via the proxy at addr, and checks that the connection
+// works.
+func dialEcho(t *testing.T, addr string) net.Conn {
+	ctx, cancel := testContext()
+	defer cancel()
+
+	d := &Dialer{ProxyNetwork: "tcp", ProxyAddress: addr}
+	conn, err := d.DialContext(ctx, "tcp", "example.com:443")
+	if err != nil {
+		t.Fatalf("DialContext failed: %v", err)
+	}
+	var buf [4]byte
+	if _, err = conn.Write([]byte("ping")); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	if _, err = io.ReadFull(conn, buf[:]); err != nil {
+		t.Fatalf("Read failed: %v", err)
+	}
+	return conn
+}
+
+// expectClosed checks that the remote end of conn closes it.
+func expectClosed(t *testing.T, conn net.Conn, descr string) {
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.Copy(io.Discard, conn); err != nil {
+		t.Errorf("%s: connection was not closed: %v", descr, err)
+	}
+}
+
+func TestServerServe(t *testing.T) {
+	// Canceling the context stops Serve.
+	ctx, cancel := context.WithCancel(context.Background())
+	srv := NewServer(&testHandler{}, nil)
+	addr, errChan := serveTestServer(t, ctx, srv)
+	dialEcho(t, addr).Close()
+	cancel()
+	if err := waitServe(t, errChan); err != context.Canceled {
+		t.Errorf("Serve() after cancel = %v, expected context.Canceled", err)
+	}
+
+	// Close stops Serve, and Serve on a closed Server fails immediately.
+	srv = NewServer(&testHandler{}, nil)
+	addr, errChan = serveTestServer(t, context.Background(), srv)
+	conn := dialEcho(t, addr)
+	srv.Close()
+	if err := waitServe(t, errChan); err != ErrServerClosed {
+		t.Errorf("Serve() after Close = %v, expected ErrServerClosed", err)
+	}
+	expectClosed(t, conn, "Close")
+	if _, errChan = serveTestServer(t, context.Background(), srv); waitServe(t, errChan) != ErrServerClosed {
+		t.Errorf("Serve() on a closed Server did not return ErrServerClosed")
+	}
+}
+
+func TestServerShutdown(t *testing.T) {
+	srv := NewServer(&testHandler{}, nil)
+	addr, errChan := serveTestServer(t, context.Background(), srv)
+	conn := dialEcho(t, addr)
+
+	// Shutdown stops accepting, and waits for active connections.
+	shutdownChan := make(chan error, 1)
+	go func() {
+		shutdownChan <- srv.Shutdown(context.Background())
+	}()
+	if err := waitServe(t, errChan); err != ErrServerClosed {
+		t.Errorf("Serve() after Shutdown = %v, expected ErrServerClosed", err)
+	}
+	if _, err := net.Dial("tcp", addr); err == nil {
+		t.Errorf("Dial() after Shutdown succeeded")
+	}
+	select {
+	case err := <-shutdownChan:
+		t.Fatalf("Shutdown() returned %v with an active connection", err)
+	case <-time.After(3 * shutdownPollInterval):
+	}
+
+	// Once the active connection finishes, Shutdown returns.
+	conn.Close()
+	select {
+	case err := <-shutdownChan:
+		if err != nil {
+			t.Errorf("Shutdown() = %v, expected nil", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Shutdown() did not return after the connection finished")
+	}
+
+	// If the context is done first, remaining connections are closed.
+	srv = NewServer(&testHandler{}, nil)
+	addr, errChan = serveTestServer(t, context.Background(), srv)
+	conn = dialEcho(t, addr)
+	ctx, cancel := context.WithTimeout(context.Background(), 3*shutdownPollInterval)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != context.DeadlineExceeded {
+		t.Errorf("Shutdown() with an active connection = %v, expected context.DeadlineExceeded", err)
+	}
+	expectClosed(t, conn, "Shutdown")
+	waitServe(t, errChan)
+}
+
+func TestServerConfig(t *testing.T) {
+	hsErrChan := make(chan error, 16)
+	onHsErr := func(conn net.Conn, err error) {
+		hsErrChan <- err
+	}
+	expectHsErr := func(descr string) {
+		select {
+		case <-hsErrChan:
+		case <-time.After(5 * time.Second):
+			t.Errorf("%s: OnHandshakeError was not called", descr)
+		}
+	}
+
+	srv := NewServer(&testHandler{}, &ServerConfig{
+		HandshakeTimeout: 100 * time.Millisecond,
+		RequireAuth:      true,
+		AllowedCommands:  []Command{CommandConnect, CommandUDPAssociate},
+		OnHandshakeError: onHsErr,
+	})
+	addr, _ := serveTestServer(t, context.Background(), srv)
+	defer srv.Close()
+
+	ctx, cancel := testContext()
+	defer cancel()
+
+	// RequireAuth rejects clients without credentials.
+	d := &Dialer{ProxyNetwork: "tcp", ProxyAddress: addr}
+	if _, err := d.DialContext(ctx, "tcp", "example.com:443"); err == nil {
+		t.Errorf("DialContext() without credentials succeeded")
+	}
+	expectHsErr("RequireAuth")
+
+	d.Auth = &AuthInfo{Uname: []byte("user"), Passwd: []byte("pass")}
+	conn, err := d.DialContext(ctx, "tcp", "example.com:443")
+	if err != nil {
+		t.Fatalf("DialContext() with credentials failed: %v", err)
+	}
+	conn.Close()
+
+	// Commands that are not allowed, or that the Handler does not support
+	// are rejected.
+	for _, cmd := range []Command{CommandTorResolve, CommandTorResolvePTR, CommandUDPAssociate} {
+		var dst Address
+		dst.FromString("example.com:0")
+		if _, _, err = d.request(ctx, cmd, &dst); err != ReplyError(ReplyCommandNotSupported) {
+			t.Errorf("Command 0x%02x = %v, expected ReplyCommandNotSupported", byte(cmd), err)
+		}
+		expectHsErr("AllowedCommands")
+	}
+
+	// Clients that do not complete the handshake in time are disconnected.
+	if conn, err = net.Dial("tcp", addr); err != nil {
+		t.Fatalf("Dial() failed: %v", err)
+	}
+	defer conn.Close()
+	start := time.Now()
+	if _, err = conn.Write([]byte{version, 1}); err != nil {
+		t.Fatalf("Write() failed: %v", err)
+	}
+	expectClosed(t, conn, "HandshakeTimeout")
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("Handshake timed out after %v, expected 100ms", elapsed)
+	}
+	select {
+	case err = <-hsErrChan:
+		if nErr, ok := err.(net.Error); !ok || !nErr.Timeout() {
+			t.Errorf("OnHandshakeError() = %v, expected a timeout", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Errorf("HandshakeTimeout: OnHandshakeError was not called")
+	}
+}
+
+// testCtxKey is the context key set by ConnContext in TestServerConnContext.
+type testCtxKey struct{}
+
+// ctxHandler is a Handler that reports the testCtxKey context value.
+type ctxHandler struct {
+	testHandler
+	values chan interface{}
+}
+
+func (h *ctxHandler) Connect(ctx context.Context, conn net.Conn, req *Request) {
+	h.values <- ctx.Value(testCtxKey{})
+	req.Reply(ReplySucceeded)
+}
+
+func TestServerConnContext(t *testing.T) {
+	handler := &ctxHandler{values: make(chan interface{}, 1)}
+	srv := NewServer(handler, &ServerConfig{
+		ConnContext: func(ctx context.Context, conn net.Conn) context.Context {
+			return context.WithValue(ctx, testCtxKey{}, conn.RemoteAddr().String())
+		},
+	})
+	addr, _ := serveTestServer(t, context.Background(), srv)
+	defer srv.Close()
+
+	ctx, cancel := testContext()
+	defer cancel()
+	d := &Dialer{ProxyNetwork: "tcp", ProxyAddress: addr}
+	conn, err := d.DialContext(ctx, "tcp", "example.com:443")
+	if err != nil {
+		t.Fatalf("DialContext() failed: %v", err)
+	}
+	defer conn.Close()
+
+	if v := <-handler.values; v != conn.LocalAddr().String() {
+		t.Errorf("Handler context value = %v, expected %s", v, conn.LocalAddr())
+	}
+}
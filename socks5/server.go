@@ -10,51 +10,102 @@
 package socks5
 
 import (
+	"bufio"
 	"bytes"
 	"fmt"
 	"io"
 	"net"
+	"sync"
 	"time"
 )
 
+// handshakeBufSize is the size of the buffer used to read the handshake,
+// which is large enough for the largest possible RFC 1929 request.
+const handshakeBufSize = 1024
+
+var readerPool = sync.Pool{
+	New: func() interface{} {
+		return bufio.NewReaderSize(nil, handshakeBufSize)
+	},
+}
+
 // Handshake attempts to handle a incoming client handshake over the provided
 // connection and receive the SOCKS5 request.  The routine handles sending
-// appropriate errors if applicable, but will not close the connection.
+// appropriate errors if applicable, but will not close the connection.  Any
+// data sent by the client after the request (eg: optimistic data) is returned
+// by reads from Request.Conn.
 func Handshake(conn net.Conn) (*Request, error) {
+	return handshake(conn, &defaultHandshakeConfig)
+}
+
+func handshake(conn net.Conn, cfg *handshakeConfig) (req *Request, err error) {
 	// Arm the handshake timeout.
-	var err error
-	if err = conn.SetDeadline(time.Now().Add(inboundTimeout)); err != nil {
+	if err = conn.SetDeadline(time.Now().Add(cfg.timeout)); err != nil {
 		return nil, err
 	}
+
+	req = new(Request)
+	req.conn = conn
+	req.cfg = cfg
+	req.rd = readerPool.Get().(*bufio.Reader)
+	req.rd.Reset(conn)
+
 	defer func() {
+		// Carry over anything buffered past the end of the request into
+		// the connection, and release the reader.
+		if n := req.rd.Buffered(); n > 0 && err == nil {
+			leftover := make([]byte, n)
+			req.rd.Read(leftover)
+			req.conn = &bufferedConn{Conn: conn, buf: leftover}
+		}
+		req.rd.Reset(nil)
+		readerPool.Put(req.rd)
+		req.rd = nil
+
 		// Disarm the handshake timeout, only propagate the error if
 		// the handshake was successful.
 		nerr := conn.SetDeadline(time.Time{})
 		if err == nil {
 			err = nerr
+		} else {
+			req = nil
 		}
 	}()
 
-	req := new(Request)
-	req.conn = conn
+	// Determine the protocol version, and handle SOCKS 4/4a if applicable.
+	var ver byte
+	if ver, err = req.readByte(); err != nil {
+		return
+	}
+	switch ver {
+	case version:
+	case version4:
+		err = req.readSOCKS4Command()
+		return
+	default:
+		err = fmt.Errorf("unsupported SOCKS version: 0x%02x", ver)
+		return
+	}
 
-	// Negotiate the protocol version and authentication method.
+	// Negotiate the authentication method.
 	var method byte
 	if method, err = req.negotiateAuth(); err != nil {
-		return nil, err
+		return
 	}
 
 	// Authenticate if neccecary.
 	if err = req.authenticate(method); err != nil {
-		return nil, err
+		return
 	}
 
 	// Read the client command.
-	if err = req.readCommand(); err != nil {
-		return nil, err
-	}
+	err = req.readCommand()
+	return
+}
 
-	return req, err
+// Conn returns the client connection.
+func (req *Request) Conn() net.Conn {
+	return req.conn
 }
 
 // Reply sends a SOCKS5 reply to the corresponding request.  The BND.ADDR and
@@ -67,6 +118,10 @@ func (req *Request) Reply(code ReplyCode) error {
 // ReplyAddr sends a SOCKS5 reply to the corresponding request.  The BND.ADDR
 // and BND.PORT fields are specified by addr, or "0.0.0.0:0" if not provided.
 func (req *Request) ReplyAddr(code ReplyCode, addr *Address) error {
+	if req.isSOCKS4 {
+		return req.replySOCKS4(code, addr)
+	}
+
 	// The server sends a reply message.
 	//  uint8_t ver (0x05)
 	//  uint8_t rep
@@ -94,11 +149,10 @@ func (req *Request) negotiateAuth() (byte, error) {
 	//	uint8_t ver (0x05)
 	//  uint8_t nmethods (>= 1).
 	//  uint8_t methods[nmethods]
+	//
+	// Note: The version is consumed by Handshake.
 
 	var err error
-	if err = req.readByteVerify("version", version); err != nil {
-		return 0, err
-	}
 
 	// Read the number of methods, and the methods.
 	var nmethods byte
@@ -106,8 +160,9 @@ func (req *Request) negotiateAuth() (byte, error) {
 	if nmethods, err = req.readByte(); err != nil {
 		return method, err
 	}
-	methods := make([]byte, nmethods)
-	if _, err := io.ReadFull(req.conn, methods); err != nil {
+	var methodBuf [255]byte
+	methods := methodBuf[:nmethods]
+	if _, err := io.ReadFull(req.rd, methods); err != nil {
 		return 0, err
 	}
 
@@ -115,7 +170,7 @@ func (req *Request) negotiateAuth() (byte, error) {
 	// over not if both options are present.
 	if bytes.IndexByte(methods, authUsernamePassword) != -1 {
 		method = authUsernamePassword
-	} else if bytes.IndexByte(methods, authNoneRequired) != -1 {
+	} else if bytes.IndexByte(methods, authNoneRequired) != -1 && !req.cfg.requireAuth {
 		method = authNoneRequired
 	}
 
@@ -165,19 +220,23 @@ func (req *Request) readCommand() error {
 		return err
 	}
 	switch Command(cmd) {
-	case CommandConnect, CommandTorResolve, CommandTorResolvePTR:
+	case CommandConnect, CommandUDPAssociate, CommandTorResolve, CommandTorResolvePTR:
 		req.Cmd = Command(cmd)
 	default:
 		req.Reply(ReplyCommandNotSupported)
 		return fmt.Errorf("unsupported SOCKS command: 0x%02x", cmd)
 	}
+	if !req.cfg.allowsCommand(req.Cmd) {
+		req.Reply(ReplyCommandNotSupported)
+		return fmt.Errorf("SOCKS command not allowed: 0x%02x", cmd)
+	}
 	if err = req.readByteVerify("reserved", rsv); err != nil {
 		req.Reply(ReplyGeneralFailure)
 		return err
 	}
 
 	// Read the destination address/port.
-	err = req.Addr.read(req.conn)
+	err = req.Addr.read(req.rd)
 	if err == errInvalidAtyp {
 		req.Reply(ReplyAddressNotSupported)
 	} else if err != nil {
@@ -188,7 +247,7 @@ func (req *Request) readCommand() error {
 }
 
 func (req *Request) readByte() (byte, error) {
-	return readByte(req.conn)
+	return req.rd.ReadByte()
 }
 
 func (req *Request) readByteVerify(descr string, expected byte) error {
@@ -198,3 +257,19 @@ func (req *Request) readByteVerify(descr string, expected byte) error {
 	}
 	return validateByte(descr, val, expected)
 }
+
+// bufferedConn is a net.Conn that returns data that was buffered during the
+// handshake, before reading from the underlying connection.
+type bufferedConn struct {
+	net.Conn
+	buf []byte
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	if len(c.buf) > 0 {
+		n := copy(b, c.buf)
+		c.buf = c.buf[n:]
+		return n, nil
+	}
+	return c.Conn.Read(b)
+}
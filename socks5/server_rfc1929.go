@@ -55,7 +55,7 @@ func (req *Request) authRFC1929() (err error) {
 		return fmt.Errorf("username with 0 length")
 	}
 	uname := make([]byte, ulen)
-	if _, err = io.ReadFull(req.conn, uname); err != nil {
+	if _, err = io.ReadFull(req.rd, uname); err != nil {
 		sendErrResp()
 		return
 	}
@@ -70,7 +70,7 @@ func (req *Request) authRFC1929() (err error) {
 		return fmt.Errorf("password with 0 length")
 	}
 	passwd := make([]byte, plen)
-	if _, err = io.ReadFull(req.conn, passwd); err != nil {
+	if _, err = io.ReadFull(req.rd, passwd); err != nil {
 		sendErrResp()
 		return
 	}
@@ -78,6 +78,19 @@ func (req *Request) authRFC1929() (err error) {
 	req.Auth.Uname = uname
 	req.Auth.Passwd = passwd
 
+	// Decode Tor's extended parameters if present, rejecting malformed
+	// usernames like tor does.
+	if req.ExtAuth, err = ParseExtendedAuth(&req.Auth); err != nil {
+		sendErrResp()
+		return
+	}
+	if req.cfg.auth != nil {
+		if req.User, err = req.cfg.auth.Authenticate(req.conn, &req.Auth); err != nil {
+			sendErrResp()
+			return
+		}
+	}
+
 	resp := []byte{authRFC1929Ver, authRFC1929Success}
 	_, err = req.conn.Write(resp[:])
 	return
@@ -0,0 +1,154 @@
+/*
+ * server_socks4.go - SOCKS 4/4a server compatibility.
+ *
+ * To the extent possible under law, Yawning Angel has waived all copyright and
+ * related or neighboring rights to or-ctl-filter, using the creative commons
+ * "cc0" public domain dedication. See LICENSE or
+ * <http://creativecommons.org/publicdomain/zero/1.0/> for full details.
+ */
+
+package socks5
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+)
+
+const (
+	version4      = 0x04
+	version4Reply = 0x00
+
+	socks4Granted  = 90
+	socks4Rejected = 91
+
+	maxSOCKS4StrLen = 255
+)
+
+var errSOCKS4StrTooLong = errors.New("SOCKS 4 string too long")
+
+func (req *Request) readSOCKS4Command() error {
+	// The client sends the request details.
+	//  uint8_t vn (0x04)
+	//  uint8_t cd
+	//  uint16_t dst_port
+	//  uint8_t dst_ip[4]
+	//  uint8_t userid[] (NUL terminated)
+	//  uint8_t hostname[] (NUL terminated, SOCKS 4a only)
+	//
+	// Note: The version is consumed by Handshake.
+
+	req.isSOCKS4 = true
+
+	var hdr [7]byte
+	if _, err := io.ReadFull(req.rd, hdr[:]); err != nil {
+		return err
+	}
+	cmd := Command(hdr[0])
+	switch cmd {
+	case CommandConnect, CommandTorResolve:
+		req.Cmd = cmd
+	default:
+		// SOCKS 4 has no way to represent a RESOLVE_PTR result.
+		req.Reply(ReplyCommandNotSupported)
+		return fmt.Errorf("unsupported SOCKS 4 command: 0x%02x", hdr[0])
+	}
+	if !req.cfg.allowsCommand(req.Cmd) {
+		req.Reply(ReplyCommandNotSupported)
+		return fmt.Errorf("SOCKS 4 command not allowed: 0x%02x", hdr[0])
+	}
+	port := int(hdr[1])<<8 | int(hdr[2])
+	ip := net.IPv4(hdr[3], hdr[4], hdr[5], hdr[6])
+
+	userID, err := req.readSOCKS4String()
+	if err != nil {
+		req.Reply(ReplyGeneralFailure)
+		return err
+	}
+	if len(userID) > 0 {
+		// The USERID is used as the username for isolation purposes.  It
+		// is redispatched to tor as a SOCKS 5 username, so Tor's extended
+		// parameters are decoded (and rejected if malformed) the same way.
+		req.Auth.Uname = userID
+		req.Auth.Passwd = []byte{}
+		if req.ExtAuth, err = ParseExtendedAuth(&req.Auth); err != nil {
+			req.Reply(ReplyConnectionNotAllowed)
+			return err
+		}
+	}
+	if req.cfg.auth != nil && req.Auth.Uname != nil {
+		if req.User, err = req.cfg.auth.Authenticate(req.conn, &req.Auth); err != nil {
+			req.Reply(ReplyConnectionNotAllowed)
+			return err
+		}
+	} else if req.cfg.requireAuth && req.Auth.Uname == nil {
+		req.Reply(ReplyConnectionNotAllowed)
+		return fmt.Errorf("SOCKS 4 request without a USERID")
+	}
+
+	// SOCKS 4a signals that a hostname follows with a DST.IP of 0.0.0.x.
+	host := ip.String()
+	if hdr[3] == 0 && hdr[4] == 0 && hdr[5] == 0 && hdr[6] != 0 {
+		var rawHost []byte
+		if rawHost, err = req.readSOCKS4String(); err != nil {
+			req.Reply(ReplyGeneralFailure)
+			return err
+		} else if len(rawHost) == 0 {
+			req.Reply(ReplyGeneralFailure)
+			return fmt.Errorf("domain name with 0 length")
+		}
+		host = string(rawHost)
+	} else if req.Cmd == CommandTorResolve {
+		req.Reply(ReplyAddressNotSupported)
+		return fmt.Errorf("SOCKS 4 RESOLVE without a hostname")
+	}
+
+	if err = req.Addr.FromString(net.JoinHostPort(host, strconv.Itoa(port))); err != nil {
+		req.Reply(ReplyGeneralFailure)
+	}
+	return err
+}
+
+func (req *Request) readSOCKS4String() ([]byte, error) {
+	var s []byte
+	for {
+		b, err := req.readByte()
+		if err != nil {
+			return nil, err
+		} else if b == 0 {
+			return s, nil
+		} else if len(s) == maxSOCKS4StrLen {
+			return nil, errSOCKS4StrTooLong
+		}
+		s = append(s, b)
+	}
+}
+
+func (req *Request) replySOCKS4(code ReplyCode, addr *Address) error {
+	// The server sends a reply message.
+	//  uint8_t vn (0x00)
+	//  uint8_t cd
+	//  uint16_t dst_port
+	//  uint8_t dst_ip[4]
+
+	resp := make([]byte, 8)
+	resp[0] = version4Reply
+	resp[1] = socks4Rejected
+	if code == ReplySucceeded {
+		resp[1] = socks4Granted
+	}
+	if addr != nil && code == ReplySucceeded {
+		// Only IPv4 addresses can be represented.
+		if len(addr.raw) != 1+net.IPv4len+2 || addr.raw[0] != atypIPv4 {
+			resp[1] = socks4Rejected
+		} else {
+			copy(resp[2:4], addr.raw[1+net.IPv4len:])
+			copy(resp[4:8], addr.raw[1:1+net.IPv4len])
+		}
+	}
+
+	_, err := req.conn.Write(resp)
+	return err
+}
@@ -0,0 +1,239 @@
+/*
+ * server_test.go - SOCSK5 server tests/benchmarks.
+ *
+ * To the extent possible under law, Yawning Angel has waived all copyright and
+ * related or neighboring rights to or-ctl-filter, using the creative commons
+ * "cc0" public domain dedication. See LICENSE or
+ * <http://creativecommons.org/publicdomain/zero/1.0/> for full details.
+ */
+
+package socks5
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// testConn is a net.Conn that reads from a fixed buffer, and discards writes.
+type testConn struct {
+	rd  bytes.Reader
+	out bytes.Buffer
+}
+
+func (c *testConn) Read(b []byte) (int, error)         { return c.rd.Read(b) }
+func (c *testConn) Write(b []byte) (int, error)        { return c.out.Write(b) }
+func (c *testConn) Close() error                       { return nil }
+func (c *testConn) LocalAddr() net.Addr                { return &net.TCPAddr{} }
+func (c *testConn) RemoteAddr() net.Addr               { return &net.TCPAddr{} }
+func (c *testConn) SetDeadline(t time.Time) error      { return nil }
+func (c *testConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c *testConn) SetWriteDeadline(t time.Time) error { return nil }
+
+func (c *testConn) reset(b []byte) {
+	c.rd.Reset(b)
+	c.out.Reset()
+}
+
+var (
+	// Method negotiation (no auth), CONNECT "example.com:443".
+	hsNoAuth = []byte{
+		0x05, 0x01, 0x00,
+		0x05, 0x01, 0x00, 0x03, 11, 'e', 'x', 'a', 'm', 'p', 'l', 'e', '.', 'c', 'o', 'm', 0x01, 0xbb,
+	}
+
+	// Method negotiation (RFC 1929), "user"/"pass", CONNECT 127.0.0.1:80.
+	hsRFC1929 = []byte{
+		0x05, 0x02, 0x00, 0x02,
+		0x01, 4, 'u', 's', 'e', 'r', 4, 'p', 'a', 's', 's',
+		0x05, 0x01, 0x00, 0x01, 127, 0, 0, 1, 0x00, 0x50,
+	}
+
+	// SOCKS 4a CONNECT "example.com:80" with a USERID.
+	hsSOCKS4a = []byte{
+		0x04, 0x01, 0x00, 0x50, 0, 0, 0, 1,
+		'u', 's', 'e', 'r', 0,
+		'e', 'x', 'a', 'm', 'p', 'l', 'e', '.', 'c', 'o', 'm', 0,
+	}
+)
+
+func TestHandshake(t *testing.T) {
+	optData := []byte("GET / HTTP/1.1\r\n\r\n")
+
+	for _, tc := range []struct {
+		name  string
+		hs    []byte
+		addr  string
+		uname string
+	}{
+		{"NoAuth", hsNoAuth, "example.com:443", ""},
+		{"RFC1929", hsRFC1929, "127.0.0.1:80", "user"},
+		{"SOCKS4a", hsSOCKS4a, "example.com:80", "user"},
+	} {
+		conn := new(testConn)
+		conn.reset(append(append([]byte{}, tc.hs...), optData...))
+
+		req, err := Handshake(conn)
+		if err != nil {
+			t.Fatalf("%s: Handshake failed: %v", tc.name, err)
+		}
+		if req.Addr.String() != tc.addr {
+			t.Errorf("%s: Addr = '%s', expected '%s'", tc.name, req.Addr.String(), tc.addr)
+		}
+		if string(req.Auth.Uname) != tc.uname {
+			t.Errorf("%s: Uname = '%s', expected '%s'", tc.name, req.Auth.Uname, tc.uname)
+		}
+
+		// Data sent after the request must not be lost.
+		b, err := io.ReadAll(req.Conn())
+		if err != nil {
+			t.Fatalf("%s: Failed to read leftover data: %v", tc.name, err)
+		}
+		if !bytes.Equal(b, optData) {
+			t.Errorf("%s: Leftover data = %q, expected %q", tc.name, b, optData)
+		}
+	}
+}
+
+func TestHandshakeSOCKS4(t *testing.T) {
+	socks4Hdr := func(cmd Command, port uint16, ip ...byte) []byte {
+		return append([]byte{version4, byte(cmd), byte(port >> 8), byte(port)}, ip...)
+	}
+	longStr := bytes.Repeat([]byte{'a'}, maxSOCKS4StrLen+1)
+	rejected := []byte{version4Reply, socks4Rejected, 0, 0, 0, 0, 0, 0}
+
+	for _, tc := range []struct {
+		name  string
+		hs    []byte
+		ok    bool
+		cmd   Command
+		addr  string
+		reply []byte
+	}{
+		{"CONNECT", append(socks4Hdr(CommandConnect, 80, 192, 0, 2, 1), 0), true, CommandConnect, "192.0.2.1:80", nil},
+		{"4aCONNECT", hsSOCKS4a, true, CommandConnect, "example.com:80", nil},
+		{"4aRESOLVE", append(socks4Hdr(CommandTorResolve, 0, 0, 0, 0, 1), append([]byte("user\x00"), "example.com\x00"...)...), true, CommandTorResolve, "example.com:0", nil},
+
+		// RESOLVE needs a hostname, and RESOLVE_PTR/UDP ASSOCIATE can't
+		// be represented.
+		{"RESOLVE", append(socks4Hdr(CommandTorResolve, 0, 192, 0, 2, 1), 0), false, 0, "", rejected},
+		{"RESOLVE_PTR", append(socks4Hdr(CommandTorResolvePTR, 0, 192, 0, 2, 1), 0), false, 0, "", rejected},
+		{"UDP", append(socks4Hdr(CommandUDPAssociate, 0, 192, 0, 2, 1), 0), false, 0, "", rejected},
+
+		// Malformed USERIDs and hostnames.
+		{"LongUserID", append(append(socks4Hdr(CommandConnect, 80, 192, 0, 2, 1), longStr...), 0), false, 0, "", rejected},
+		{"BadExtUserID", append(socks4Hdr(CommandConnect, 80, 192, 0, 2, 1), "<torS0X>3\x00"...), false, 0, "", rejected},
+		{"LongHost", append(append(socks4Hdr(CommandConnect, 80, 0, 0, 0, 1), 0), append(longStr, 0)...), false, 0, "", rejected},
+		{"EmptyHost", append(socks4Hdr(CommandConnect, 80, 0, 0, 0, 1), 0, 0), false, 0, "", rejected},
+		{"UnterminatedUserID", append(socks4Hdr(CommandConnect, 80, 192, 0, 2, 1), "user"...), false, 0, "", rejected},
+		{"Truncated", socks4Hdr(CommandConnect, 80, 192, 0), false, 0, "", []byte{}},
+	} {
+		conn := new(testConn)
+		conn.reset(tc.hs)
+
+		req, err := Handshake(conn)
+		if !tc.ok {
+			if err == nil {
+				t.Errorf("%s: Handshake succeeded, expected failure", tc.name)
+			} else if !bytes.Equal(conn.out.Bytes(), tc.reply) {
+				t.Errorf("%s: Reply = %v, expected %v", tc.name, conn.out.Bytes(), tc.reply)
+			}
+			continue
+		} else if err != nil {
+			t.Fatalf("%s: Handshake failed: %v", tc.name, err)
+		}
+		if !req.IsSOCKS4() || req.Cmd != tc.cmd || req.Addr.String() != tc.addr {
+			t.Errorf("%s: Request = 0x%02x '%s', expected 0x%02x '%s'", tc.name, byte(req.Cmd), req.Addr.String(), byte(tc.cmd), tc.addr)
+		}
+		if conn.out.Len() != 0 {
+			t.Errorf("%s: Handshake replied %v before the request was serviced", tc.name, conn.out.Bytes())
+		}
+	}
+}
+
+func TestReplySOCKS4(t *testing.T) {
+	addr := func(s string) *Address {
+		var a Address
+		if err := a.FromString(s); err != nil {
+			t.Fatalf("FromString('%s') failed: %v", s, err)
+		}
+		return &a
+	}
+
+	for _, tc := range []struct {
+		code     ReplyCode
+		addr     *Address
+		expected []byte
+	}{
+		{ReplySucceeded, nil, []byte{version4Reply, socks4Granted, 0, 0, 0, 0, 0, 0}},
+		{ReplySucceeded, addr("192.0.2.1:443"), []byte{version4Reply, socks4Granted, 0x01, 0xbb, 192, 0, 2, 1}},
+
+		// Only IPv4 addresses fit in a SOCKS 4 reply.
+		{ReplySucceeded, addr("[2001:db8::1]:80"), []byte{version4Reply, socks4Rejected, 0, 0, 0, 0, 0, 0}},
+		{ReplySucceeded, addr("example.com:80"), []byte{version4Reply, socks4Rejected, 0, 0, 0, 0, 0, 0}},
+
+		// Every failure is a rejection, without an address.
+		{ReplyGeneralFailure, nil, []byte{version4Reply, socks4Rejected, 0, 0, 0, 0, 0, 0}},
+		{ReplyHostUnreachable, addr("192.0.2.1:443"), []byte{version4Reply, socks4Rejected, 0, 0, 0, 0, 0, 0}},
+		{ReplyOnionDescNotFound, nil, []byte{version4Reply, socks4Rejected, 0, 0, 0, 0, 0, 0}},
+	} {
+		conn := new(testConn)
+		conn.reset(hsSOCKS4a)
+		req, err := Handshake(conn)
+		if err != nil {
+			t.Fatalf("Handshake failed: %v", err)
+		}
+		if err = req.ReplyAddr(tc.code, tc.addr); err != nil {
+			t.Fatalf("ReplyAddr failed: %v", err)
+		}
+		if !bytes.Equal(conn.out.Bytes(), tc.expected) {
+			t.Errorf("ReplyAddr(0x%02x, %v) = %v, expected %v", byte(tc.code), tc.addr, conn.out.Bytes(), tc.expected)
+		}
+	}
+}
+
+func benchmarkHandshake(b *testing.B, hs []byte) {
+	conn := new(testConn)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		conn.reset(hs)
+		if _, err := Handshake(conn); err != nil {
+			b.Fatalf("Handshake failed: %v", err)
+		}
+	}
+}
+
+func BenchmarkHandshakeNoAuth(b *testing.B) {
+	benchmarkHandshake(b, hsNoAuth)
+}
+
+func BenchmarkHandshakeRFC1929(b *testing.B) {
+	benchmarkHandshake(b, hsRFC1929)
+}
+
+func BenchmarkHandshakeSOCKS4a(b *testing.B) {
+	benchmarkHandshake(b, hsSOCKS4a)
+}
+
+func FuzzHandshake(f *testing.F) {
+	f.Add(hsNoAuth)
+	f.Add(hsRFC1929)
+	f.Add(hsSOCKS4a)
+	f.Fuzz(func(t *testing.T, data []byte) {
+		conn := new(testConn)
+		conn.reset(data)
+		req, err := Handshake(conn)
+		if err != nil {
+			return
+		}
+
+		// Any leftover data must be the tail end of the input.
+		leftover, _ := io.ReadAll(req.Conn())
+		if len(leftover) > len(data) || !bytes.HasSuffix(data, leftover) {
+			t.Fatalf("Leftover data is not a suffix of the input")
+		}
+	})
+}
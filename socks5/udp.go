@@ -0,0 +1,66 @@
+/*
+ * udp.go - SOCKS5 UDP ASSOCIATE datagram handling.
+ *
+ * To the extent possible under law, Yawning Angel has waived all copyright and
+ * related or neighboring rights to or-ctl-filter, using the creative commons
+ * "cc0" public domain dedication. See LICENSE or
+ * <http://creativecommons.org/publicdomain/zero/1.0/> for full details.
+ */
+
+package socks5
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"strings"
+)
+
+var errFragmented = errors.New("fragmented UDP datagram")
+
+// ParseUDPDatagram parses a SOCKS5 UDP request datagram, and returns the
+// destination address and the payload.  Fragmented datagrams are not
+// supported.
+func ParseUDPDatagram(b []byte) (*Address, []byte, error) {
+	// The client sends UDP request datagrams.
+	//  uint16_t rsv (0x0000)
+	//  uint8_t frag
+	//  uint8_t atyp
+	//  uint8_t dst_addr[]
+	//  uint16_t dst_port
+	//  uint8_t data[]
+
+	if len(b) < 3 {
+		return nil, nil, errors.New("truncated UDP datagram")
+	}
+	if err := validateByte("rsv", b[0], rsv); err != nil {
+		return nil, nil, err
+	}
+	if err := validateByte("rsv", b[1], rsv); err != nil {
+		return nil, nil, err
+	}
+	if b[2] != 0 {
+		return nil, nil, errFragmented
+	}
+
+	rd := bytes.NewReader(b[3:])
+	addr := new(Address)
+	if err := addr.read(rd); err != nil {
+		return nil, nil, err
+	}
+	return addr, b[len(b)-rd.Len():], nil
+}
+
+// NewUDPDatagram returns a SOCKS5 UDP reply datagram, with the source address
+// set to addr.
+func NewUDPDatagram(addr *Address, payload []byte) []byte {
+	b := make([]byte, 0, 3+len(addr.raw)+len(payload))
+	b = append(b, rsv, rsv, 0)
+	b = append(b, addr.raw...)
+	return append(b, payload...)
+}
+
+// IP returns the address as a net.IP, or nil if the address is a FQDN.
+func (addr *Address) IP() net.IP {
+	return net.ParseIP(strings.Trim(addr.addrStr, "[]"))
+}
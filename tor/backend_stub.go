@@ -9,8 +9,32 @@
 
 package tor
 
+import (
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/yawning/or-ctl-filter/audit"
+)
+
+const (
+	eventStatusClient = "STATUS_CLIENT"
+
+	bootstrapDone = "NOTICE BOOTSTRAP PROGRESS=100 TAG=done SUMMARY=\"Done\""
+)
+
+// stubScenario is the scenario shared by all stub backend sessions.
+var stubScenario *scenario
+
 type stubBackend struct {
-	s *session
+	s  *session
+	sc *scenario
+
+	eventLock sync.Mutex
+	events    map[string]bool
+
+	closeOnce sync.Once
+	closeChan chan struct{}
 }
 
 func (b *stubBackend) Init() error {
@@ -19,23 +43,141 @@ func (b *stubBackend) Init() error {
 }
 
 func (b *stubBackend) Term() {
-	// Nothing to cleanup.
+	b.closeOnce.Do(func() {
+		close(b.closeChan)
+	})
 }
 
 func (b *stubBackend) TorVersion() string {
-	return "0.2.7.1-alpha"
+	return b.sc.Version
 }
 
-func (b *stubBackend) OnNewnym(raw []byte) error {
+func (b *stubBackend) OnNewnym(raw []byte, r *audit.Record) error {
+	if resp, ok := b.sc.injectError(string(raw)); ok {
+		return b.reply(resp, r)
+	}
+
 	// Pretend everything went ok, so that Tor Browser at least clears state.
-	_, err := b.s.appConnWrite(false, []byte(responseOk))
+	return b.reply(responseOk, r)
+}
+
+func (b *stubBackend) Forward(splitCmd []string, raw []byte, r *audit.Record) error {
+	if resp, ok := b.sc.injectError(string(raw)); ok {
+		return b.reply(resp, r)
+	}
+
+	var respStr string
+	switch strings.ToUpper(splitCmd[0]) {
+	case cmdSetEvents:
+		b.eventLock.Lock()
+		b.events = make(map[string]bool)
+		for _, ev := range splitCmd[1:] {
+			b.events[strings.ToUpper(ev)] = true
+		}
+		b.eventLock.Unlock()
+		respStr = responseOk
+	default:
+		respStr = errUnrecognizedCommand
+	}
+	return b.reply(respStr, r)
+}
+
+// reply logs the audit record with the reply code, and sends the reply.
+func (b *stubBackend) reply(resp string, r *audit.Record) error {
+	r.ReplyCode = audit.ReplyCode(resp)
+	audit.Log(r)
+	_, err := b.s.appConnWrite(true, []byte(resp))
 	return err
 }
 
+func (b *stubBackend) GetInfo(keys []string) (map[string]string, string, error) {
+	if resp, ok := b.sc.injectError(cmdGetInfo + " " + strings.Join(keys, " ")); ok {
+		return nil, resp, nil
+	}
+
+	vals := make(map[string]string)
+	for _, k := range keys {
+		v, ok := b.getInfo(k)
+		if !ok {
+			return nil, "552 Unrecognized key \"" + k + "\"\r\n", nil
+		}
+		vals[k] = v
+	}
+	return vals, "", nil
+}
+
+func (b *stubBackend) getInfo(key string) (string, bool) {
+	const (
+		keyVersion            = "version"
+		keyBootstrapPhase     = "status/bootstrap-phase"
+		keyCircuitEstablished = "status/circuit-established"
+		keyCircuitStatus      = "circuit-status"
+		keyStreamStatus       = "stream-status"
+	)
+
+	switch key {
+	case keyVersion:
+		return b.sc.Version, true
+	case keyBootstrapPhase:
+		if step := b.sc.bootstrapStatus(); step != nil {
+			return step.phase(), true
+		}
+		return bootstrapDone, true
+	case keyCircuitEstablished:
+		if b.sc.bootstrapStatus() != nil {
+			return "0", true
+		}
+		return "1", true
+	case keyCircuitStatus:
+		var lines []string
+		for _, c := range b.sc.Circuit {
+			lines = append(lines, c.String())
+		}
+		return strings.Join(lines, "\n"), true
+	case keyStreamStatus:
+		var lines []string
+		for _, s := range b.sc.Stream {
+			lines = append(lines, s.String())
+		}
+		return strings.Join(lines, "\n"), true
+	}
+	return "", false
+}
+
 func (b *stubBackend) RelayTorToApp() {
-	b.s.Done()
+	defer b.s.Done()
+
+	// Replay the scripted bootstrap progression as STATUS_CLIENT events, to
+	// clients that are interested.
+	for _, step := range b.sc.Bootstrap {
+		if d := step.at.Sub(time.Now()); d > 0 {
+			select {
+			case <-b.closeChan:
+				return
+			case <-time.After(d):
+			}
+		} else {
+			// Only events that happen after the session starts are sent.
+			continue
+		}
+
+		b.eventLock.Lock()
+		wantEvent := b.events[eventStatusClient]
+		b.eventLock.Unlock()
+		if wantEvent {
+			ev := "650 " + eventStatusClient + " " + step.phase() + "\r\n"
+			if _, err := b.s.appConnWrite(true, []byte(ev)); err != nil {
+				b.s.errChan <- err
+				return
+			}
+		}
+	}
 }
 
 func newStubBackend(session *session) sessionBackend {
-	return &stubBackend{s: session}
+	return &stubBackend{
+		s:         session,
+		sc:        stubScenario,
+		closeChan: make(chan struct{}),
+	}
 }
@@ -11,40 +11,66 @@ package tor
 
 import (
 	"bufio"
+	"errors"
+	"io"
 	"log"
+	"strings"
+	"sync"
 
 	"github.com/yawning/bulb"
+	"github.com/yawning/or-ctl-filter/audit"
+	"github.com/yawning/or-ctl-filter/config"
 )
 
+var errBackendClosed = errors.New("tor backend closed")
+
 type torBackend struct {
 	s *session
 
-	torConn   *bulb.Conn
+	inst      *config.TorInstanceCfg
+	torConn   io.ReadWriteCloser
 	protoInfo *bulb.ProtocolInfo
+
+	// Every command sent to tor has a corresponding entry in pending, so
+	// that replies can be matched to commands.  The filter waits for each
+	// reply before handling the client's next command, so that the replies
+	// from tor and the replies from the filter are never reordered.
+	pendingLock sync.Mutex
+	pending     []chan []string
+	relayDone   chan struct{}
 }
 
 func (b *torBackend) Init() (err error) {
-	// Connect to the real control port.
-	if b.torConn, err = bulb.Dial(b.s.cfg.Tor.ControlNetAddr()); err != nil {
-		log.Printf("ERR/tor: Failed to connect to tor control port: %v", err)
+	// Connect to the real control port, of the first tor instance that is
+	// reachable.
+	var conn *bulb.Conn
+	for _, inst := range b.s.cfg.Tor.Instances() {
+		if conn, err = bulb.Dial(inst.ControlNetAddr()); err == nil {
+			b.inst = inst
+			break
+		}
+		log.Printf("ERR/tor: Failed to connect to tor control port (%v): %v", inst, err)
+	}
+	if err != nil {
 		return
 	}
 
 	// Issue a PROTOCOLINFO, so we can send a realistic response.
-	if b.protoInfo, err = b.torConn.ProtocolInfo(); err != nil {
+	if b.protoInfo, err = conn.ProtocolInfo(); err != nil {
 		log.Printf("ERR/tor: Failed to issue PROTOCOLINFO: %v", err)
-		b.torConn.Close()
+		conn.Close()
 		return
 	}
 
 	// Authenticate with the real tor control port.
 	// XXX: Pull password out of `b.s.cfg`.
-	if err = b.torConn.Authenticate(""); err != nil {
+	if err = conn.Authenticate(""); err != nil {
 		log.Printf("ERR/tor: Failed to authenticate: %v", err)
-		b.torConn.Close()
+		conn.Close()
 		return
 	}
 
+	b.torConn = conn
 	return
 }
 
@@ -58,24 +84,120 @@ func (b *torBackend) TorVersion() string {
 	return b.protoInfo.TorVersion
 }
 
-func (b *torBackend) OnNewnym(raw []byte) error {
-	_, err := b.torConn.Write(raw)
+func (b *torBackend) OnNewnym(raw []byte, r *audit.Record) error {
+	// NEWNYM goes to every tor instance, but only the reply from the
+	// instance that the client is connected to is relayed.
+	for _, inst := range b.s.cfg.Tor.Instances() {
+		if inst != b.inst {
+			go signalNewnym(inst)
+		}
+	}
+	return b.forward(raw, r)
+}
+
+func signalNewnym(inst *config.TorInstanceCfg) {
+	conn, err := bulb.Dial(inst.ControlNetAddr())
+	if err != nil {
+		log.Printf("ERR/tor: Failed to connect to tor control port (%v): %v", inst, err)
+		return
+	}
+	defer conn.Close()
+
+	if err = conn.Authenticate(""); err != nil {
+		log.Printf("ERR/tor: Failed to authenticate (%v): %v", inst, err)
+	} else if _, err = conn.Request("SIGNAL NEWNYM"); err != nil {
+		log.Printf("ERR/tor: Failed to send NEWNYM (%v): %v", inst, err)
+	}
+}
+
+func (b *torBackend) Forward(splitCmd []string, raw []byte, r *audit.Record) error {
+	return b.forward(raw, r)
+}
+
+// forward sends a command to tor, logs the audit record with tor's reply
+// code, and relays the reply.
+func (b *torBackend) forward(raw []byte, r *audit.Record) error {
+	reply, err := b.request(raw)
+	if err != nil {
+		return err
+	}
+	r.ReplyCode = audit.ReplyCode(reply[len(reply)-1])
+	audit.Log(r)
+	_, err = b.s.appConnWrite(true, []byte(strings.Join(reply, "")))
 	return err
 }
 
+func (b *torBackend) GetInfo(keys []string) (map[string]string, string, error) {
+	reply, err := b.request([]byte(cmdGetInfo + " " + strings.Join(keys, " ") + "\r\n"))
+	if err != nil {
+		return nil, "", err
+	}
+	if !strings.HasPrefix(reply[len(reply)-1], "250 ") {
+		// Let the caller relay tor's error response.
+		return nil, strings.Join(reply, ""), nil
+	}
+	vals, err := parseGetInfoReply(reply)
+	return vals, "", err
+}
+
+// request sends a command to tor, and waits for the reply.
+func (b *torBackend) request(raw []byte) ([]string, error) {
+	replyChan := make(chan []string, 1)
+
+	b.pendingLock.Lock()
+	if _, err := b.torConn.Write(raw); err != nil {
+		b.pendingLock.Unlock()
+		return nil, err
+	}
+	b.pending = append(b.pending, replyChan)
+	b.pendingLock.Unlock()
+
+	select {
+	case reply := <-replyChan:
+		return reply, nil
+	case <-b.relayDone:
+		return nil, errBackendClosed
+	}
+}
+
+func (b *torBackend) popPending() chan []string {
+	b.pendingLock.Lock()
+	defer b.pendingLock.Unlock()
+
+	if len(b.pending) == 0 {
+		return nil
+	}
+	replyChan := b.pending[0]
+	b.pending = b.pending[1:]
+	return replyChan
+}
+
 func (b *torBackend) RelayTorToApp() {
 	defer b.Term()
 	defer b.s.Done()
 	defer b.s.appConn.Close()
+	defer close(b.relayDone)
 
 	rd := bufio.NewReader(b.torConn)
 	for {
-		line, err := rd.ReadBytes('\n')
+		reply, err := readReply(rd)
 		if err != nil {
 			b.s.errChan <- err
 			break
 		}
-		if _, err = b.s.appConnWrite(true, line); err != nil {
+
+		// Asynchronous events (6xx) are not responses to commands, and are
+		// relayed as is.  Everything else is handed to the command that is
+		// waiting for it.
+		if reply[0][0] != '6' {
+			if replyChan := b.popPending(); replyChan != nil {
+				replyChan <- reply
+				continue
+			}
+			log.Printf("ERR/tor: Unsolicited reply from tor: %s", strings.TrimSpace(reply[0]))
+			continue
+		}
+		if _, err = b.s.appConnWrite(true, []byte(strings.Join(reply, ""))); err != nil {
 			b.s.errChan <- err
 			break
 		}
@@ -83,5 +205,5 @@ func (b *torBackend) RelayTorToApp() {
 }
 
 func newTorBackend(session *session) sessionBackend {
-	return &torBackend{s: session}
+	return &torBackend{s: session, relayDone: make(chan struct{})}
 }
@@ -0,0 +1,301 @@
+/*
+ * managed.go - Managed Tor child process.
+ *
+ * To the extent possible under law, Yawning Angel has waived all copyright and
+ * related or neighboring rights to or-ctl-filter, using the creative commons
+ * "cc0" public domain dedication. See LICENSE or
+ * <http://creativecommons.org/publicdomain/zero/1.0/> for full details.
+ */
+
+package tor
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/yawning/bulb"
+	"github.com/yawning/or-ctl-filter/config"
+)
+
+const (
+	// The default torrc template, used if one is not specified in the config.
+	defaultTorrcTemplate = `# Generated by or-ctl-filter, do not edit.
+DataDirectory {{.DataDirectory}}
+ControlSocket {{.ControlSocket}}
+CookieAuthentication 1
+CookieAuthFile {{.CookieAuthFile}}
+SocksPort {{.SOCKSPort}}
+`
+
+	controlPollInterval   = 100 * time.Millisecond
+	controlStartTimeout   = 30 * time.Second
+	bootstrapPollInterval = 500 * time.Millisecond
+
+	minRestartBackoff = 1 * time.Second
+	maxRestartBackoff = 5 * time.Minute
+
+	// If the child survives for this long, it is considered to be stable, and
+	// the restart backoff is reset.
+	stableRunTime = 2 * time.Minute
+)
+
+var errChildExited = errors.New("tor exited")
+
+type torrcParams struct {
+	DataDirectory  string
+	ControlSocket  string
+	CookieAuthFile string
+	SOCKSPort      string
+}
+
+// controlConn is the subset of *bulb.Conn used to manage the child.
+type controlConn interface {
+	Authenticate(password string) error
+	Request(fmt string, args ...interface{}) (*bulb.Response, error)
+	Close() error
+}
+
+type managedTor struct {
+	cfg *config.Config
+
+	// dial connects to the child's control port, and sleep waits out the
+	// restart backoff.  The tests replace these to drive a fake tor.
+	dial  func(network, addr string) (controlConn, error)
+	sleep func(time.Duration)
+}
+
+// InitManagedTor generates a torrc, launches the managed tor child process,
+// and waits till it has bootstrapped.  The child is restarted (with backoff)
+// if it ever exits.
+func InitManagedTor(cfg *config.Config) error {
+	m := &managedTor{cfg: cfg, dial: dialControl, sleep: time.Sleep}
+	if err := m.writeTorrc(); err != nil {
+		return err
+	}
+
+	readyChan := make(chan error, 1)
+	go m.supervise(readyChan)
+	return <-readyChan
+}
+
+func (m *managedTor) writeTorrc() error {
+	mCfg := &m.cfg.Tor.Managed
+
+	if err := os.MkdirAll(mCfg.DataDirectory, 0700); err != nil {
+		return fmt.Errorf("Failed to create Managed Tor DataDirectory: %v", err)
+	}
+	if err := os.Chmod(mCfg.DataDirectory, 0700); err != nil {
+		return fmt.Errorf("Failed to set Managed Tor DataDirectory permissions: %v", err)
+	}
+
+	tmplStr := defaultTorrcTemplate
+	if mCfg.TorrcTemplate != "" {
+		b, err := ioutil.ReadFile(mCfg.TorrcTemplate)
+		if err != nil {
+			return fmt.Errorf("Failed to read torrc template: %v", err)
+		}
+		tmplStr = string(b)
+	}
+	tmpl, err := template.New("torrc").Parse(tmplStr)
+	if err != nil {
+		return fmt.Errorf("Failed to parse torrc template: %v", err)
+	}
+
+	socksNet, socksAddr := m.cfg.Tor.SOCKSNetAddr()
+	params := &torrcParams{
+		DataDirectory:  mCfg.DataDirectory,
+		ControlSocket:  mCfg.ControlSocketPath(),
+		CookieAuthFile: mCfg.CookieAuthFilePath(),
+		SOCKSPort:      socksAddr,
+	}
+	if socksNet == "unix" {
+		params.SOCKSPort = "unix:" + socksAddr
+	}
+
+	f, err := os.OpenFile(mCfg.TorrcPath(), os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return fmt.Errorf("Failed to create torrc: %v", err)
+	}
+	defer f.Close()
+	if err = tmpl.Execute(f, params); err != nil {
+		return fmt.Errorf("Failed to generate torrc: %v", err)
+	}
+
+	return nil
+}
+
+func (m *managedTor) supervise(readyChan chan error) {
+	backoff := minRestartBackoff
+	for {
+		startTime := time.Now()
+		err := m.run(func() {
+			if readyChan != nil {
+				readyChan <- nil
+				readyChan = nil
+			}
+		})
+		if readyChan != nil {
+			// The initial launch failed, let the caller deal with it.
+			readyChan <- err
+			return
+		}
+		log.Printf("ERR/tor: Managed tor failed: %v", err)
+
+		if time.Since(startTime) > stableRunTime {
+			backoff = minRestartBackoff
+		}
+		log.Printf("INFO/tor: Restarting managed tor in %v", backoff)
+		m.sleep(backoff)
+		if backoff *= 2; backoff > maxRestartBackoff {
+			backoff = maxRestartBackoff
+		}
+	}
+}
+
+// run launches the tor child, and blocks till it exits.  onReady is called
+// once the child has bootstrapped.
+func (m *managedTor) run(onReady func()) error {
+	mCfg := &m.cfg.Tor.Managed
+
+	// Remove the stale control socket so that it is possible to tell when
+	// the new instance is ready to accept connections.
+	os.Remove(mCfg.ControlSocketPath())
+
+	outRd, outWr := io.Pipe()
+	cmd := exec.Command(mCfg.Binary, "-f", mCfg.TorrcPath())
+	cmd.Stdout = outWr
+	cmd.Stderr = outWr
+	if err := cmd.Start(); err != nil {
+		outWr.Close()
+		return fmt.Errorf("Failed to launch tor: %v", err)
+	}
+	log.Printf("INFO/tor: Launched managed tor (PID: %d)", cmd.Process.Pid)
+	go logChildOutput(outRd)
+
+	waitChan := make(chan error, 1)
+	go func() {
+		err := cmd.Wait()
+		outWr.Close()
+		waitChan <- err
+	}()
+
+	ctrlConn, err := m.takeOwnership(waitChan)
+	if err != nil {
+		cmd.Process.Kill()
+		<-waitChan
+		return err
+	}
+
+	// The control connection MUST be kept open for the lifetime of the child,
+	// since tor will exit as soon as it is closed.
+	defer ctrlConn.Close()
+
+	if err = waitBootstrap(ctrlConn, waitChan, time.Duration(mCfg.BootstrapTimeout)*time.Second); err != nil {
+		cmd.Process.Kill()
+		<-waitChan
+		return err
+	}
+	log.Printf("INFO/tor: Managed tor bootstrapped")
+	onReady()
+
+	if err = <-waitChan; err == nil {
+		err = errChildExited
+	}
+	return err
+}
+
+func (m *managedTor) takeOwnership(waitChan chan error) (controlConn, error) {
+	// Wait for the control socket to come up.
+	var ctrlConn controlConn
+	deadline := time.Now().Add(controlStartTimeout)
+	for {
+		var err error
+		if ctrlConn, err = m.dial(m.cfg.Tor.ControlNetAddr()); err == nil {
+			break
+		} else if time.Now().After(deadline) {
+			return nil, fmt.Errorf("Failed to connect to managed tor control port: %v", err)
+		}
+
+		select {
+		case err = <-waitChan:
+			waitChan <- err
+			return nil, errChildExited
+		case <-time.After(controlPollInterval):
+		}
+	}
+
+	// Authenticate, and make tor exit when the control connection is closed.
+	if err := ctrlConn.Authenticate(""); err != nil {
+		ctrlConn.Close()
+		return nil, fmt.Errorf("Failed to authenticate with managed tor: %v", err)
+	}
+	if _, err := ctrlConn.Request("TAKEOWNERSHIP"); err != nil {
+		ctrlConn.Close()
+		return nil, fmt.Errorf("Failed to take ownership of managed tor: %v", err)
+	}
+
+	return ctrlConn, nil
+}
+
+func waitBootstrap(ctrlConn controlConn, waitChan chan error, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for {
+		progress, err := getBootstrapProgress(ctrlConn)
+		if err != nil {
+			return err
+		} else if progress >= 100 {
+			return nil
+		} else if time.Now().After(deadline) {
+			return fmt.Errorf("Managed tor failed to bootstrap in time (%d%%)", progress)
+		}
+
+		select {
+		case err = <-waitChan:
+			waitChan <- err
+			return errChildExited
+		case <-time.After(bootstrapPollInterval):
+		}
+	}
+}
+
+func getBootstrapProgress(ctrlConn controlConn) (int, error) {
+	const progressPrefix = "PROGRESS="
+
+	resp, err := ctrlConn.Request("GETINFO status/bootstrap-phase")
+	if err != nil {
+		return 0, fmt.Errorf("Failed to query bootstrap status: %v", err)
+	}
+	for _, line := range resp.Data {
+		for _, v := range strings.Split(line, " ") {
+			if strings.HasPrefix(v, progressPrefix) {
+				return strconv.Atoi(strings.TrimPrefix(v, progressPrefix))
+			}
+		}
+	}
+	return 0, errors.New("Malformed bootstrap status")
+}
+
+func dialControl(network, addr string) (controlConn, error) {
+	conn, err := bulb.Dial(network, addr)
+	if err != nil {
+		return nil, err
+	}
+	return conn, nil
+}
+
+func logChildOutput(rd io.Reader) {
+	scanner := bufio.NewScanner(rd)
+	for scanner.Scan() {
+		log.Printf("DEBUG/tor: [Managed]: %s", scanner.Text())
+	}
+}
@@ -0,0 +1,246 @@
+/*
+ * managed_test.go - Managed Tor child process tests.
+ *
+ * To the extent possible under law, Yawning Angel has waived all copyright and
+ * related or neighboring rights to or-ctl-filter, using the creative commons
+ * "cc0" public domain dedication. See LICENSE or
+ * <http://creativecommons.org/publicdomain/zero/1.0/> for full details.
+ */
+
+package tor
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/yawning/bulb"
+	"github.com/yawning/or-ctl-filter/config"
+)
+
+// fakeTorEnv is set in the environment of the test binary when it is
+// launched as a fake tor.
+const fakeTorEnv = "OR_CTL_FILTER_FAKE_TOR"
+
+func TestMain(m *testing.M) {
+	if os.Getenv(fakeTorEnv) != "" {
+		fakeTorMain()
+		return
+	}
+	os.Exit(m.Run())
+}
+
+// fakeTorMain pretends to be tor, launched as "tor -f <torrc>".  It serves
+// the ControlSocket from the torrc, reports bootstrap progress in steps of
+// 50% for each GETINFO, and exits shortly after it has bootstrapped.
+func fakeTorMain() {
+	if len(os.Args) != 3 || os.Args[1] != "-f" {
+		fmt.Fprintf(os.Stderr, "unexpected arguments: %v\n", os.Args)
+		os.Exit(2)
+	}
+	b, err := ioutil.ReadFile(os.Args[2])
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to read torrc: %v\n", err)
+		os.Exit(2)
+	}
+	var ctrlPath string
+	for _, l := range strings.Split(string(b), "\n") {
+		if strings.HasPrefix(l, "ControlSocket ") {
+			ctrlPath = strings.TrimPrefix(l, "ControlSocket ")
+		}
+	}
+
+	ln, err := net.Listen("unix", ctrlPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to listen: %v\n", err)
+		os.Exit(2)
+	}
+	conn, err := ln.Accept()
+	if err != nil {
+		os.Exit(2)
+	}
+
+	progress := 0
+	rd := bufio.NewReader(conn)
+	for {
+		line, err := rd.ReadString('\n')
+		if err != nil {
+			// Like tor after TAKEOWNERSHIP, exit when the controller leaves.
+			os.Exit(0)
+		}
+		if !strings.HasPrefix(line, "GETINFO status/bootstrap-phase") {
+			fmt.Fprintf(conn, "250 OK\r\n")
+			continue
+		}
+
+		fmt.Fprintf(conn, "250-status/bootstrap-phase=NOTICE BOOTSTRAP PROGRESS=%d TAG=x SUMMARY=\"x\"\r\n250 OK\r\n", progress)
+		if progress == 100 {
+			go func() {
+				time.Sleep(50 * time.Millisecond)
+				os.Exit(1)
+			}()
+		}
+		progress += 50
+	}
+}
+
+// testControlConn is a minimal control port client for the fake tor.
+type testControlConn struct {
+	conn net.Conn
+	rd   *bufio.Reader
+
+	stats *fakeTorStats
+}
+
+func (c *testControlConn) Authenticate(password string) error {
+	_, err := c.Request("AUTHENTICATE")
+	return err
+}
+
+func (c *testControlConn) Request(format string, args ...interface{}) (*bulb.Response, error) {
+	req := fmt.Sprintf(format, args...)
+	if strings.HasPrefix(req, "GETINFO") {
+		c.stats.Lock()
+		c.stats.nrPolls++
+		c.stats.Unlock()
+	}
+	if _, err := fmt.Fprintf(c.conn, "%s\r\n", req); err != nil {
+		return nil, err
+	}
+
+	resp := new(bulb.Response)
+	for {
+		line, err := c.rd.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		line = strings.TrimRight(line, "\r\n")
+		if len(line) < 4 {
+			return nil, errors.New("malformed reply: " + line)
+		} else if line[3] == ' ' {
+			if !strings.HasPrefix(line, "250") {
+				return nil, errors.New(line)
+			}
+			return resp, nil
+		}
+		resp.Data = append(resp.Data, line[4:])
+	}
+}
+
+func (c *testControlConn) Close() error {
+	return c.conn.Close()
+}
+
+type fakeTorStats struct {
+	sync.Mutex
+	nrLaunches int
+	nrPolls    int
+	backoffs   []time.Duration
+}
+
+func TestManagedTor(t *testing.T) {
+	const nrRestarts = 3
+
+	dir, err := ioutil.TempDir("", "managed_test")
+	if err != nil {
+		t.Fatalf("Failed to create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	cfgPath := filepath.Join(dir, "config.toml")
+	cfgStr := fmt.Sprintf(`FilteredAddress = "tcp://127.0.0.1:0"
+SOCKSAddress = "tcp://127.0.0.1:0"
+[Tor]
+Enable = true
+SOCKSAddress = "tcp://127.0.0.1:9050"
+[Tor.Managed]
+Enable = true
+Binary = %q
+DataDirectory = %q
+BootstrapTimeout = 10
+`, os.Args[0], filepath.Join(dir, "tor"))
+	if err = ioutil.WriteFile(cfgPath, []byte(cfgStr), 0600); err != nil {
+		t.Fatalf("Failed to write config: %v", err)
+	}
+	cfg, err := config.Load(cfgPath)
+	if err != nil {
+		t.Fatalf("Failed to load config: %v", err)
+	}
+
+	os.Setenv(fakeTorEnv, "1")
+	defer os.Unsetenv(fakeTorEnv)
+
+	stats := new(fakeTorStats)
+	doneChan := make(chan struct{})
+	m := &managedTor{
+		cfg: cfg,
+		dial: func(network, addr string) (controlConn, error) {
+			conn, err := net.Dial(network, addr)
+			if err != nil {
+				return nil, err
+			}
+			stats.Lock()
+			stats.nrLaunches++
+			stats.Unlock()
+			return &testControlConn{conn: conn, rd: bufio.NewReader(conn), stats: stats}, nil
+		},
+		sleep: func(d time.Duration) {
+			stats.Lock()
+			stats.backoffs = append(stats.backoffs, d)
+			n := len(stats.backoffs)
+			stats.Unlock()
+			if n == nrRestarts {
+				// Stop supervising.
+				close(doneChan)
+				runtime.Goexit()
+			}
+		},
+	}
+	if err = m.writeTorrc(); err != nil {
+		t.Fatalf("writeTorrc() failed: %v", err)
+	}
+
+	// The initial launch must bootstrap.
+	readyChan := make(chan error, 1)
+	go m.supervise(readyChan)
+	select {
+	case err = <-readyChan:
+		if err != nil {
+			t.Fatalf("Initial launch failed: %v", err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatalf("Timed out waiting for the initial launch")
+	}
+
+	// The fake tor exits after bootstrapping, and is restarted with an
+	// exponential backoff.
+	select {
+	case <-doneChan:
+	case <-time.After(10 * time.Second):
+		t.Fatalf("Timed out waiting for restarts")
+	}
+
+	stats.Lock()
+	defer stats.Unlock()
+	if stats.nrLaunches != nrRestarts {
+		t.Errorf("Launched %d times, expected %d", stats.nrLaunches, nrRestarts)
+	}
+	if stats.nrPolls != 3*nrRestarts {
+		t.Errorf("Polled bootstrap progress %d times, expected %d", stats.nrPolls, 3*nrRestarts)
+	}
+	expected := []time.Duration{minRestartBackoff, 2 * minRestartBackoff, 4 * minRestartBackoff}
+	for i, d := range stats.backoffs {
+		if d != expected[i] {
+			t.Errorf("Restart %d backoff was %v, expected %v", i+1, d, expected[i])
+		}
+	}
+}
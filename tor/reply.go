@@ -0,0 +1,103 @@
+/*
+ * reply.go - Tor control port reply parsing/formatting.
+ *
+ * To the extent possible under law, Yawning Angel has waived all copyright and
+ * related or neighboring rights to or-ctl-filter, using the creative commons
+ * "cc0" public domain dedication. See LICENSE or
+ * <http://creativecommons.org/publicdomain/zero/1.0/> for full details.
+ */
+
+package tor
+
+import (
+	"bufio"
+	"errors"
+	"strings"
+)
+
+var errMalformedReply = errors.New("malformed control port reply")
+
+// readReply reads a complete control port reply, including any data sections,
+// and returns the raw lines (with line terminators).
+func readReply(rd *bufio.Reader) ([]string, error) {
+	var lines []string
+	inData := false
+	for {
+		line, err := rd.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		lines = append(lines, line)
+
+		if inData {
+			if strings.TrimRight(line, "\r\n") == "." {
+				inData = false
+			}
+			continue
+		}
+		if len(line) < 4 {
+			return nil, errMalformedReply
+		}
+		switch line[3] {
+		case ' ':
+			return lines, nil
+		case '-':
+		case '+':
+			inData = true
+		default:
+			return nil, errMalformedReply
+		}
+	}
+}
+
+// parseGetInfoReply parses a successful GETINFO reply into key/value pairs.
+// Values from data replies have their lines joined with "\n".
+func parseGetInfoReply(reply []string) (map[string]string, error) {
+	vals := make(map[string]string)
+	for i := 0; i < len(reply); i++ {
+		l := strings.TrimRight(reply[i], "\r\n")
+		if len(l) < 4 {
+			return nil, errMalformedReply
+		} else if l[3] == ' ' {
+			break
+		}
+
+		kv := l[4:]
+		idx := strings.IndexByte(kv, '=')
+		if idx < 0 {
+			return nil, errMalformedReply
+		}
+		k, v := kv[:idx], kv[idx+1:]
+		if l[3] == '+' {
+			var data []string
+			for i++; i < len(reply); i++ {
+				dl := strings.TrimRight(reply[i], "\r\n")
+				if dl == "." {
+					break
+				}
+				data = append(data, strings.TrimPrefix(dl, "."))
+			}
+			v = strings.Join(data, "\n")
+		}
+		vals[k] = v
+	}
+	return vals, nil
+}
+
+// formatGetInfoValue formats a single GETINFO key/value pair as a mid-reply
+// line, or as a data reply if the value spans multiple lines.
+func formatGetInfoValue(key, value string) string {
+	if !strings.Contains(value, "\n") {
+		return "250-" + key + "=" + value + "\r\n"
+	}
+
+	// Data replies are dot-encoded, and terminated by a line with a single ".".
+	respStr := "250+" + key + "=\r\n"
+	for _, l := range strings.Split(value, "\n") {
+		if strings.HasPrefix(l, ".") {
+			l = "." + l
+		}
+		respStr += l + "\r\n"
+	}
+	return respStr + ".\r\n"
+}
@@ -0,0 +1,174 @@
+/*
+ * scenario.go - Stub control port backend scenario.
+ *
+ * To the extent possible under law, Yawning Angel has waived all copyright and
+ * related or neighboring rights to or-ctl-filter, using the creative commons
+ * "cc0" public domain dedication. See LICENSE or
+ * <http://creativecommons.org/publicdomain/zero/1.0/> for full details.
+ */
+
+package tor
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/BurntSushi/toml"
+)
+
+const defaultStubVersion = "0.2.7.1-alpha"
+
+// bootstrapStep is a single step of the scripted bootstrap progression.
+type bootstrapStep struct {
+	// Delay is the time in milliseconds after the previous step (or the
+	// scenario being loaded) at which this step is reached.
+	Delay    int
+	Progress int
+	Tag      string
+	Summary  string
+
+	at time.Time
+}
+
+func (b *bootstrapStep) phase() string {
+	return fmt.Sprintf("NOTICE BOOTSTRAP PROGRESS=%d TAG=%s SUMMARY=%s", b.Progress, b.Tag, strconv.Quote(b.Summary))
+}
+
+// fakeCircuit is a scripted circuit, reported via "circuit-status".
+type fakeCircuit struct {
+	ID      int
+	Status  string
+	Path    []string
+	Purpose string
+}
+
+func (c *fakeCircuit) String() string {
+	s := strconv.Itoa(c.ID) + " " + c.Status
+	if len(c.Path) > 0 {
+		s += " " + strings.Join(c.Path, ",")
+	}
+	if c.Purpose != "" {
+		s += " PURPOSE=" + c.Purpose
+	}
+	return s
+}
+
+// fakeStream is a scripted stream, reported via "stream-status".
+type fakeStream struct {
+	ID      int
+	Status  string
+	Circuit int
+	Target  string
+}
+
+func (s *fakeStream) String() string {
+	return fmt.Sprintf("%d %s %d %s", s.ID, s.Status, s.Circuit, s.Target)
+}
+
+// injectedError is a scripted error reply.
+type injectedError struct {
+	// Command is matched against the prefix of the client's command line,
+	// after the command has been upper cased.
+	Command string
+	Reply   string
+
+	// Count is the number of times the error is injected, with 0 meaning
+	// "every time".
+	Count int
+
+	nrInjected int
+}
+
+// scenario is the script that drives the stub control port backend.
+type scenario struct {
+	Version   string
+	Bootstrap []*bootstrapStep
+	Circuit   []*fakeCircuit
+	Stream    []*fakeStream
+	Error     []*injectedError
+
+	sync.Mutex
+}
+
+func loadScenario(path string) (*scenario, error) {
+	sc := new(scenario)
+	if path != "" {
+		if _, err := toml.DecodeFile(path, sc); err != nil {
+			return nil, fmt.Errorf("Failed to parse stub scenario: %v", err)
+		}
+	}
+	if sc.Version == "" {
+		sc.Version = defaultStubVersion
+	}
+
+	at := time.Now()
+	for _, b := range sc.Bootstrap {
+		if b.Progress < 0 || b.Progress > 100 {
+			return nil, fmt.Errorf("Invalid stub scenario bootstrap progress: %d", b.Progress)
+		}
+		at = at.Add(time.Duration(b.Delay) * time.Millisecond)
+		b.at = at
+	}
+	for _, e := range sc.Error {
+		if e.Command == "" || !isErrorReply(e.Reply) {
+			return nil, fmt.Errorf("Invalid stub scenario error: '%s' -> '%s'", e.Command, e.Reply)
+		}
+		e.Command = strings.ToUpper(e.Command)
+	}
+
+	return sc, nil
+}
+
+// isErrorReply returns true iff the reply is a single line control port error
+// reply (4xx/5xx).
+func isErrorReply(reply string) bool {
+	if len(reply) < 4 || reply[3] != ' ' {
+		return false
+	}
+	code, err := strconv.Atoi(reply[:3])
+	return err == nil && code >= 400 && code <= 599
+}
+
+// bootstrapStatus returns the current bootstrap step, or nil if the scenario
+// is fully bootstrapped.
+func (sc *scenario) bootstrapStatus() *bootstrapStep {
+	now := time.Now()
+	var cur *bootstrapStep
+	for _, b := range sc.Bootstrap {
+		if b.at.After(now) {
+			break
+		}
+		cur = b
+	}
+	if cur == nil && len(sc.Bootstrap) > 0 {
+		// Bootstrapping hasn't started yet.
+		return &bootstrapStep{Tag: "starting", Summary: "Starting"}
+	} else if cur != nil && cur.Progress < 100 {
+		return cur
+	}
+	return nil
+}
+
+// injectError returns the scripted error reply for a command line, if any.
+func (sc *scenario) injectError(cmdLine string) (string, bool) {
+	sc.Lock()
+	defer sc.Unlock()
+
+	cmdLine = strings.ToUpper(cmdLine)
+	for _, e := range sc.Error {
+		if !strings.HasPrefix(cmdLine, e.Command) {
+			continue
+		}
+		if e.Count > 0 {
+			if e.nrInjected >= e.Count {
+				continue
+			}
+			e.nrInjected++
+		}
+		return e.Reply + "\r\n", true
+	}
+	return "", false
+}
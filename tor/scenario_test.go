@@ -0,0 +1,189 @@
+/*
+ * scenario_test.go - Stub control port backend scenario tests.
+ *
+ * To the extent possible under law, Yawning Angel has waived all copyright and
+ * related or neighboring rights to or-ctl-filter, using the creative commons
+ * "cc0" public domain dedication. See LICENSE or
+ * <http://creativecommons.org/publicdomain/zero/1.0/> for full details.
+ */
+
+package tor
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+const testScenario = `Version = "0.4.8.10"
+
+[[Bootstrap]]
+Delay = 100
+Progress = 50
+Tag = "loading_descriptors"
+Summary = "Loading relay descriptors"
+
+[[Bootstrap]]
+Delay = 100
+Progress = 100
+Tag = "done"
+Summary = "Done"
+
+[[Stream]]
+ID = 1
+Status = "SUCCEEDED"
+Circuit = 2
+Target = "example.com:443"
+
+[[Error]]
+Command = "getinfo version"
+Reply = "551 Internal error"
+Count = 1
+
+[[Error]]
+Command = "SIGNAL NEWNYM"
+Reply = "552 Rate limited"
+`
+
+func loadTestScenario(t *testing.T, scenarioStr string) (*scenario, error) {
+	dir, err := ioutil.TempDir("", "scenario_test")
+	if err != nil {
+		t.Fatalf("Failed to create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "scenario.toml")
+	if err = ioutil.WriteFile(path, []byte(scenarioStr), 0600); err != nil {
+		t.Fatalf("Failed to write scenario: %v", err)
+	}
+	return loadScenario(path)
+}
+
+func TestLoadScenario(t *testing.T) {
+	sc, err := loadScenario("")
+	if err != nil {
+		t.Fatalf("loadScenario(\"\") failed: %v", err)
+	}
+	if sc.Version != defaultStubVersion || sc.bootstrapStatus() != nil {
+		t.Errorf("Empty scenario is not bootstrapped with the default version")
+	}
+
+	if sc, err = loadTestScenario(t, testScenario); err != nil {
+		t.Fatalf("loadScenario() failed: %v", err)
+	}
+	if sc.Version != "0.4.8.10" || len(sc.Bootstrap) != 2 || len(sc.Stream) != 1 || len(sc.Error) != 2 {
+		t.Errorf("loadScenario() = %+v, not the scenario", sc)
+	}
+	if sc.Error[0].Command != "GETINFO VERSION" {
+		t.Errorf("Error command '%s' was not upper cased", sc.Error[0].Command)
+	}
+	if !sc.Bootstrap[1].at.After(sc.Bootstrap[0].at) {
+		t.Errorf("Bootstrap step delays are not cumulative")
+	}
+
+	for _, invalid := range []string{
+		"[[Bootstrap]]\nProgress = 101\n",
+		"[[Bootstrap]]\nProgress = -1\n",
+		"[[Error]]\nCommand = \"GETINFO\"\nReply = \"250 OK\"\n",
+		"[[Error]]\nCommand = \"GETINFO\"\nReply = \"551-Multi line\"\n",
+		"[[Error]]\nReply = \"551 Internal error\"\n",
+		"Version = [ ]\n",
+	} {
+		if _, err = loadTestScenario(t, invalid); err == nil {
+			t.Errorf("loadScenario('%s') succeeded, expected failure", invalid)
+		}
+	}
+}
+
+func TestScenarioBootstrapStatus(t *testing.T) {
+	sc, err := loadTestScenario(t, "[[Bootstrap]]\nDelay = 0\nProgress = 10\nTag = \"conn\"\nSummary = \"Connecting\"\n\n[[Bootstrap]]\nDelay = 3600000\nProgress = 100\nTag = \"done\"\nSummary = \"Done\"\n")
+	if err != nil {
+		t.Fatalf("loadScenario() failed: %v", err)
+	}
+	if step := sc.bootstrapStatus(); step == nil || step.Progress != 10 {
+		t.Errorf("bootstrapStatus() = %+v, expected the first step", step)
+	} else if phase := step.phase(); phase != `NOTICE BOOTSTRAP PROGRESS=10 TAG=conn SUMMARY="Connecting"` {
+		t.Errorf("phase() = '%s'", phase)
+	}
+
+	// Before the first step, bootstrapping has not started.
+	if sc, err = loadTestScenario(t, "[[Bootstrap]]\nDelay = 3600000\nProgress = 100\n"); err != nil {
+		t.Fatalf("loadScenario() failed: %v", err)
+	}
+	if step := sc.bootstrapStatus(); step == nil || step.Progress != 0 || step.Tag != "starting" {
+		t.Errorf("bootstrapStatus() = %+v, expected the starting step", step)
+	}
+
+	// Once the last step is reached, the scenario is bootstrapped.
+	if sc, err = loadTestScenario(t, "[[Bootstrap]]\nProgress = 100\n"); err != nil {
+		t.Fatalf("loadScenario() failed: %v", err)
+	}
+	if step := sc.bootstrapStatus(); step != nil {
+		t.Errorf("bootstrapStatus() = %+v, expected nil", step)
+	}
+}
+
+func TestScenarioInjectError(t *testing.T) {
+	sc, err := loadTestScenario(t, testScenario)
+	if err != nil {
+		t.Fatalf("loadScenario() failed: %v", err)
+	}
+	for _, tc := range []struct {
+		cmdLine  string
+		expected string
+	}{
+		// Count = 1 only injects the error once.
+		{"GETINFO version", "551 Internal error\r\n"},
+		{"GETINFO version", ""},
+
+		// Count = 0 injects the error every time, matching the prefix of
+		// the command line, regardless of case.
+		{"signal newnym\r\n", "552 Rate limited\r\n"},
+		{"SIGNAL NEWNYM\r\n", "552 Rate limited\r\n"},
+		{"SIGNAL HUP\r\n", ""},
+	} {
+		resp, ok := sc.injectError(tc.cmdLine)
+		if ok != (tc.expected != "") || resp != tc.expected {
+			t.Errorf("injectError('%s') = '%s', expected '%s'", tc.cmdLine, resp, tc.expected)
+		}
+	}
+}
+
+func TestStubBackendScenario(t *testing.T) {
+	cfg := loadTestConfig(t, "")
+	sc, err := loadTestScenario(t, testScenario)
+	if err != nil {
+		t.Fatalf("loadScenario() failed: %v", err)
+	}
+	c := newTestClient(t, cfg, newTestStubBackend(sc))
+	defer c.conn.Close()
+
+	for _, tc := range []struct {
+		cmd      string
+		expected string
+	}{
+		{"GETINFO status/bootstrap-phase", "250-status/bootstrap-phase=NOTICE BOOTSTRAP PROGRESS=0 TAG=starting SUMMARY=\"Starting\"\r\n" + responseOk},
+		{"GETINFO version", "551 Internal error\r\n"},
+		{"GETINFO version", "250-version=0.4.8.10\r\n" + responseOk},
+		{"SIGNAL NEWNYM", "552 Rate limited\r\n"},
+		{"SETEVENTS STATUS_CLIENT", responseOk},
+	} {
+		if reply := c.request(tc.cmd); reply != tc.expected {
+			t.Errorf("'%s' = '%s', expected '%s'", tc.cmd, reply, tc.expected)
+		}
+	}
+
+	// The bootstrap progression is replayed as events.
+	for _, expected := range []string{
+		"650 STATUS_CLIENT NOTICE BOOTSTRAP PROGRESS=50 TAG=loading_descriptors SUMMARY=\"Loading relay descriptors\"\r\n",
+		"650 STATUS_CLIENT NOTICE BOOTSTRAP PROGRESS=100 TAG=done SUMMARY=\"Done\"\r\n",
+	} {
+		if ev := c.readReply(); ev != expected {
+			t.Errorf("Event = '%s', expected '%s'", ev, expected)
+		}
+	}
+	if reply := c.request("GETINFO status/bootstrap-phase"); reply != "250-status/bootstrap-phase="+bootstrapDone+"\r\n"+responseOk {
+		t.Errorf("Bootstrap phase after the progression = '%s'", reply)
+	}
+}
@@ -20,8 +20,11 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 
+	"github.com/yawning/or-ctl-filter/audit"
 	"github.com/yawning/or-ctl-filter/config"
+	"github.com/yawning/or-ctl-filter/proxy"
 )
 
 const (
@@ -31,6 +34,7 @@ const (
 	cmdQuit          = "QUIT"
 	cmdGetInfo       = "GETINFO"
 	cmdSignal        = "SIGNAL"
+	cmdSetEvents     = "SETEVENTS"
 
 	responseOk = "250 OK\r\n"
 
@@ -38,8 +42,13 @@ const (
 	errUnrecognizedCommand    = "510 Unrecognized command\r\n"
 )
 
+var sessionCounter uint64
+
 type session struct {
-	cfg *config.Config
+	id      uint64
+	cfg     *config.Config
+	ws      *config.Workstation
+	profile *config.ControlProfile
 
 	appConn          net.Conn
 	appConnReader    *bufio.Reader
@@ -58,23 +67,52 @@ type sessionBackend interface {
 
 	TorVersion() string
 
-	OnNewnym([]byte) error
+	// OnNewnym passes a NEWNYM to the backend.  The audit record is logged
+	// once the backend's reply is known.
+	OnNewnym(raw []byte, r *audit.Record) error
+
+	// Forward passes a command that was allowed by the filter policy to the
+	// backend, which is responsible for sending the response, and logging
+	// the audit record with the reply code.
+	Forward(splitCmd []string, raw []byte, r *audit.Record) error
+
+	// GetInfo queries the backend for GETINFO keys that were allowed by the
+	// filter policy.  If the backend rejects the query, the error response
+	// is returned instead of the values, for the filter to relay.
+	GetInfo(keys []string) (map[string]string, string, error)
 
 	RelayTorToApp()
 }
 
 // InitCtlListener initializes the control port listener.
 func InitCtlListener(cfg *config.Config, wg *sync.WaitGroup) {
+	if !cfg.Tor.Enable {
+		var err error
+		if stubScenario, err = loadScenario(cfg.Stub.Scenario); err != nil {
+			log.Fatalf("ERR/tor: %v", err)
+		}
+	}
+
 	ln, err := net.Listen(cfg.FilteredNetAddr())
 	if err != nil {
 		log.Fatalf("ERR/tor: Failed to listen on the control address: %v", err)
 	}
 
 	wg.Add(1)
-	go filterAcceptLoop(cfg, ln, wg)
+	go filterAcceptLoop(cfg, ln, false, wg)
+
+	if cfg.Gateway.Enable {
+		gwLn, err := net.Listen(cfg.Gateway.FilteredNetAddr())
+		if err != nil {
+			log.Fatalf("ERR/tor: Failed to listen on the gateway control address: %v", err)
+		}
+
+		wg.Add(1)
+		go filterAcceptLoop(cfg, gwLn, true, wg)
+	}
 }
 
-func filterAcceptLoop(cfg *config.Config, ln net.Listener, wg *sync.WaitGroup) error {
+func filterAcceptLoop(cfg *config.Config, ln net.Listener, isGateway bool, wg *sync.WaitGroup) error {
 	defer wg.Done()
 	defer ln.Close()
 
@@ -85,22 +123,39 @@ func filterAcceptLoop(cfg *config.Config, ln net.Listener, wg *sync.WaitGroup) e
 				log.Printf("ERR/tor: Failed to Accept(): %v", err)
 				return err
 			}
+			continue
+		}
+
+		// Gateway connections must come from a known workstation.
+		var ws *config.Workstation
+		if isGateway {
+			if ws = cfg.Gateway.Lookup(conn.RemoteAddr()); ws == nil {
+				log.Printf("ERR/tor: Rejecting ctrl connection from unknown workstation: %v", conn.RemoteAddr())
+				conn.Close()
+				continue
+			}
 		}
 
 		// Create the appropriate session instance.
-		s := newSession(cfg, conn)
+		s := newSession(cfg, ws, conn)
 		go s.sessionWorker()
 	}
 }
 
-func newSession(cfg *config.Config, conn net.Conn) *session {
+func newSession(cfg *config.Config, ws *config.Workstation, conn net.Conn) *session {
 	s := &session{
+		id:            atomic.AddUint64(&sessionCounter, 1),
 		cfg:           cfg,
+		ws:            ws,
+		profile:       cfg.DefaultControlProfile(),
 		appConn:       conn,
 		appConnReader: bufio.NewReader(conn),
 		isPreAuth:     true,
 		errChan:       make(chan error, 2),
 	}
+	if ws != nil {
+		s.profile = ws.ControlProfile()
+	}
 	return s
 }
 
@@ -108,7 +163,11 @@ func (s *session) sessionWorker() {
 	defer s.appConn.Close()
 
 	clientAddr := s.appConn.RemoteAddr()
-	log.Printf("INFO/tor: New ctrl connection from: %s", clientAddr)
+	if s.ws != nil {
+		log.Printf("INFO/tor: New ctrl connection from: %s (%s)", clientAddr, s.ws.Name)
+	} else {
+		log.Printf("INFO/tor: New ctrl connection from: %s", clientAddr)
+	}
 
 	// Initialize the appropriate backend.
 	if s.cfg.Tor.Enable {
@@ -155,6 +214,7 @@ func (s *session) processPreAuth() error {
 		switch cmd {
 		case cmdProtocolInfo:
 			if sentProtocolInfo {
+				s.audit(splitCmd, audit.DecisionReject, "preauth/protocolinfo-repeated", errAuthenticationRequired)
 				s.sendErrAuthenticationRequired()
 				return errors.New("Client already sent PROTOCOLINFO already")
 			}
@@ -163,22 +223,25 @@ func (s *session) processPreAuth() error {
 				return err
 			}
 		case cmdAuthenticate:
+			s.audit(splitCmd, audit.DecisionSpoof, "preauth/authenticate", responseOk)
 			_, err = s.appConnWrite(false, []byte(responseOk))
 			s.isPreAuth = false
 			return err
 		case cmdAuthChallenge:
 			// WTF?  We should never see this since PROTOCOLINFO lies about the
 			// supported authentication types.
+			s.audit(splitCmd, audit.DecisionReject, "preauth/authchallenge", errUnrecognizedCommand)
 			s.sendErrUnrecognizedCommand()
 			return errors.New("Client sent AUTHCHALLENGE, when not supported")
 		case cmdQuit:
+			s.audit(splitCmd, audit.DecisionSpoof, "preauth/quit", "")
 			return errors.New("Client requested connection close")
 		default:
+			s.audit(splitCmd, audit.DecisionReject, "preauth/default-deny", errAuthenticationRequired)
 			s.sendErrAuthenticationRequired()
 			return fmt.Errorf("Invalid app command: '%s'", cmd)
 		}
 	}
-	return nil
 }
 
 func (s *session) proxyAndFilerApp() {
@@ -200,8 +263,11 @@ func (s *session) proxyAndFilerApp() {
 			err = s.onCmdGetInfo(splitCmd, raw)
 		case cmdSignal:
 			err = s.onCmdSignal(splitCmd, raw)
+		case cmdSetEvents:
+			err = s.onCmdSetEvents(splitCmd, raw)
 		default:
 			log.Printf("Filtering command: [%s]", cmd)
+			s.audit(splitCmd, audit.DecisionReject, "default-deny", errUnrecognizedCommand)
 			err = s.sendErrUnrecognizedCommand()
 		}
 		if err != nil {
@@ -222,14 +288,16 @@ func (s *session) sendErrUnrecognizedCommand() error {
 	return err
 }
 
-func (s *session) sendErrUnexpectedArgCount(cmd string, expected, actual int) error {
+func (s *session) sendErrUnexpectedArgCount(splitCmd []string, expected int) error {
 	var err error
 	var respStr string
-	if expected > actual {
+	cmd := strings.ToUpper(splitCmd[0])
+	if expected < len(splitCmd) {
 		respStr = "512 Too many arguments to " + cmd + "\r\n"
 	} else {
 		respStr = "512 Missing argument to " + cmd + "\r\n"
 	}
+	s.audit(splitCmd, audit.DecisionReject, "syntax/arg-count", respStr)
 	_, err = s.appConnWrite(false, []byte(respStr))
 	return err
 }
@@ -240,51 +308,168 @@ func (s *session) onCmdProtocolInfo(splitCmd []string) error {
 		if _, err := strconv.ParseInt(v, 10, 32); err != nil {
 			log.Printf("PROTOCOLINFO received with invalid arg")
 			respStr := "513 No such version \"" + v + "\"\r\n"
+			s.audit(splitCmd, audit.DecisionReject, "protocolinfo/bad-version", respStr)
 			_, err := s.appConnWrite(false, []byte(respStr))
 			return err
 		}
 	}
 	torVersion := s.backend.TorVersion()
 	respStr := "250-PROTOCOLINFO 1\r\n250-AUTH METHODS=NULL,HASHEDPASSWORD\r\n250-VERSION Tor=\"" + torVersion + "\"\r\n" + responseOk
+	s.audit(splitCmd, audit.DecisionSpoof, "protocolinfo", respStr)
 	_, err := s.appConnWrite(false, []byte(respStr))
 	return err
 }
 
 func (s *session) onCmdGetInfo(splitCmd []string, raw []byte) error {
 	const argGetInfoSocks = "net/listeners/socks"
-	if len(splitCmd) != 2 {
-		return s.sendErrUnexpectedArgCount(cmdGetInfo, 2, len(splitCmd))
-	} else if splitCmd[1] != argGetInfoSocks {
-		log.Printf("Filtering GETINFO: [%s]", splitCmd[1])
-		respStr := "552 Unrecognized key \"" + splitCmd[1] + "\"\r\n"
-		_, err := s.appConnWrite(false, []byte(respStr))
-		return err
-	} else {
-		log.Printf("Spoofing GETINFO: [%s]", splitCmd[1])
-		_, socksAddr := s.cfg.SOCKSNetAddr()
-		respStr := "250-" + argGetInfoSocks + "=\"" + socksAddr + "\"\r\n" + responseOk
-		_, err := s.appConnWrite(false, []byte(respStr))
-		return err
+
+	var keys []string
+	for _, k := range splitCmd[1:] {
+		if k != "" {
+			keys = append(keys, k)
+		}
+	}
+	if len(keys) == 0 {
+		return s.sendErrUnexpectedArgCount(splitCmd, 2)
+	}
+
+	// Like tor, any key that is not allowed fails the entire command, with
+	// the error for the first bad key.
+	var passKeys []string
+	for _, k := range keys {
+		if !s.profile.AllowsGetInfo(k) {
+			log.Printf("Filtering GETINFO: [%s]", k)
+			respStr := "552 Unrecognized key \"" + k + "\"\r\n"
+			s.audit(splitCmd, audit.DecisionReject, "getinfo/not-allowed", respStr)
+			_, err := s.appConnWrite(false, []byte(respStr))
+			return err
+		}
+		if k != argGetInfoSocks {
+			passKeys = append(passKeys, k)
+		}
+	}
+
+	// Query the backend for the keys that are not spoofed.
+	rule := "getinfo/" + strings.Join(keys, ",")
+	vals := make(map[string]string)
+	if len(passKeys) > 0 {
+		var errResp string
+		var err error
+		if vals, errResp, err = s.backend.GetInfo(passKeys); err != nil {
+			return err
+		} else if errResp != "" {
+			s.audit(splitCmd, audit.DecisionPass, rule, errResp)
+			_, err = s.appConnWrite(true, []byte(errResp))
+			return err
+		}
 	}
+
+	// Build the combined response, in the order that the keys were requested.
+	var respStr string
+	for _, k := range keys {
+		if k == argGetInfoSocks {
+			log.Printf("Spoofing GETINFO: [%s]", k)
+			_, socksAddr := s.cfg.SOCKSNetAddr()
+			if s.ws != nil {
+				_, socksAddr = s.cfg.Gateway.SOCKSNetAddr()
+			}
+			respStr += formatGetInfoValue(k, "\""+socksAddr+"\"")
+			continue
+		}
+		v, ok := vals[k]
+		if !ok {
+			log.Printf("ERR/tor: Backend GETINFO response missing key: [%s]", k)
+			respStr = "551 Internal error\r\n"
+			s.audit(splitCmd, audit.DecisionPass, rule, respStr)
+			_, err := s.appConnWrite(false, []byte(respStr))
+			return err
+		}
+		respStr += formatGetInfoValue(k, v)
+	}
+	respStr += responseOk
+
+	decision := audit.DecisionPass
+	if len(passKeys) == 0 {
+		decision = audit.DecisionSpoof
+	}
+	s.audit(splitCmd, decision, rule, respStr)
+	_, err := s.appConnWrite(false, []byte(respStr))
+	return err
 }
 
 func (s *session) onCmdSignal(splitCmd []string, raw []byte) error {
 	const argSignalNewnym = "NEWNYM"
 	if len(splitCmd) != 2 {
-		return s.sendErrUnexpectedArgCount(cmdSignal, 2, len(splitCmd))
-	} else if splitCmd[1] != argSignalNewnym {
+		return s.sendErrUnexpectedArgCount(splitCmd, 2)
+	} else if splitCmd[1] != argSignalNewnym || !s.profile.AllowsSignal(splitCmd[1]) {
 		log.Printf("Filtering SIGNAL: [%s]", splitCmd[1])
 		respStr := "552 Unrecognized signal code \"" + splitCmd[1] + "\"\r\n"
+		s.audit(splitCmd, audit.DecisionReject, "signal/not-allowed", respStr)
 		_, err := s.appConnWrite(false, []byte(respStr))
 		return err
 	} else {
-		if s.cfg.Tor.SuppressNewnym {
+		switch s.profile.NewnymScope {
+		case config.NewnymScopeNone:
 			log.Printf("Filtering SIGNAL: NEWNYM")
+			s.audit(splitCmd, audit.DecisionSpoof, "signal/newnym:"+config.NewnymScopeNone, responseOk)
 			_, err := s.appConnWrite(false, []byte(responseOk))
 			return err
+		case config.NewnymScopeWorkstation:
+			// Workstation scoped NEWNYM is only meaningful for gateway
+			// clients, everyone else gets the global behavior.
+			if s.ws != nil {
+				log.Printf("Scoping SIGNAL: NEWNYM to workstation '%s'", s.ws.Name)
+				s.ws.Newnym()
+				proxy.ForgetVirtualAddrs(s.ws)
+				s.audit(splitCmd, audit.DecisionSpoof, "signal/newnym:"+config.NewnymScopeWorkstation, responseOk)
+				_, err := s.appConnWrite(false, []byte(responseOk))
+				return err
+			}
+		}
+		proxy.ForgetVirtualAddrs(nil)
+		return s.backend.OnNewnym(raw, s.newAuditRecord(splitCmd, audit.DecisionPass, "signal/newnym:"+config.NewnymScopeGlobal))
+	}
+}
+
+func (s *session) onCmdSetEvents(splitCmd []string, raw []byte) error {
+	// Note: "SETEVENTS" with no arguments unsubscribes from all events, and is
+	// always allowed.
+	for _, ev := range splitCmd[1:] {
+		if !s.profile.AllowsEvent(strings.ToUpper(ev)) {
+			log.Printf("Filtering SETEVENTS: [%s]", ev)
+			respStr := "552 Unrecognized event \"" + ev + "\"\r\n"
+			s.audit(splitCmd, audit.DecisionReject, "setevents/not-allowed", respStr)
+			_, err := s.appConnWrite(false, []byte(respStr))
+			return err
 		}
-		return s.backend.OnNewnym(raw)
 	}
+	return s.backend.Forward(splitCmd, raw, s.newAuditRecord(splitCmd, audit.DecisionPass, "setevents"))
+}
+
+// audit records the policy decision made for a client command.  resp is the
+// reply sent to the client.
+func (s *session) audit(splitCmd []string, decision audit.Decision, rule, resp string) {
+	r := s.newAuditRecord(splitCmd, decision, rule)
+	r.ReplyCode = audit.ReplyCode(resp)
+	audit.Log(r)
+}
+
+// newAuditRecord returns the audit record for a client command, without the
+// reply code.  It is used as is for commands passed to the backend, which
+// logs the record once the reply is known.
+func (s *session) newAuditRecord(splitCmd []string, decision audit.Decision, rule string) *audit.Record {
+	r := &audit.Record{
+		Session:  s.id,
+		Peer:     s.appConn.RemoteAddr().String(),
+		Command:  splitCmd[0],
+		Args:     splitCmd[1:],
+		Decision: decision,
+		Rule:     rule,
+	}
+	if s.ws != nil {
+		r.Workstation = s.ws.Name
+	}
+	return r
 }
 
 func (s *session) appConnWrite(fromServer bool, b []byte) (int, error) {
@@ -319,5 +504,25 @@ func (s *session) appConnReadLine() (cmd string, splitCmd []string, rawLine []by
 
 	splitCmd = strings.Split(string(trimmedLine), " ")
 	cmd = strings.ToUpper(strings.TrimSpace(splitCmd[0]))
+
+	// Multi-line commands ("+" prefix) are followed by a data block that is
+	// terminated by a line with a single ".".  The data is part of the
+	// command (and may be sensitive), so it is neither logged nor parsed as
+	// further commands.
+	if strings.HasPrefix(cmd, "+") {
+		nrLines := 0
+		for {
+			var line []byte
+			if line, err = s.appConnReader.ReadBytes('\n'); err != nil {
+				return
+			}
+			rawLine = append(rawLine, line...)
+			if string(bytes.TrimSpace(line)) == "." {
+				break
+			}
+			nrLines++
+		}
+		log.Printf("DEBUG/tor: %s [%d data lines]", prefix, nrLines)
+	}
 	return
 }
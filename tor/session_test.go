@@ -0,0 +1,311 @@
+/*
+ * session_test.go - Tor control port session tests.
+ *
+ * To the extent possible under law, Yawning Angel has waived all copyright and
+ * related or neighboring rights to or-ctl-filter, using the creative commons
+ * "cc0" public domain dedication. See LICENSE or
+ * <http://creativecommons.org/publicdomain/zero/1.0/> for full details.
+ */
+
+package tor
+
+import (
+	"bufio"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/yawning/bulb"
+	"github.com/yawning/or-ctl-filter/config"
+)
+
+const testConfigBase = `FilteredAddress = "tcp://127.0.0.1:0"
+SOCKSAddress = "tcp://127.0.0.1:9150"
+UnsafeAllowDirect = true
+
+[Profile.default]
+GetInfo = [ "net/listeners/socks", "version", "circuit-status", "status/bootstrap-phase", "config-file" ]
+Signals = [ "NEWNYM" ]
+Events = [ "STATUS_CLIENT" ]
+`
+
+// loadTestConfig loads a configuration consisting of testConfigBase and
+// extra.
+func loadTestConfig(t *testing.T, extra string) *config.Config {
+	dir, err := ioutil.TempDir("", "session_test")
+	if err != nil {
+		t.Fatalf("Failed to create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "config.toml")
+	if err = ioutil.WriteFile(path, []byte(testConfigBase+extra), 0600); err != nil {
+		t.Fatalf("Failed to write config: %v", err)
+	}
+	cfg, err := config.Load(path)
+	if err != nil {
+		t.Fatalf("Failed to load config: %v", err)
+	}
+	return cfg
+}
+
+// testClient is a control port client connected to a post-authentication
+// session.
+type testClient struct {
+	t    *testing.T
+	conn net.Conn
+	rd   *bufio.Reader
+}
+
+// connPair returns both ends of a loopback TCP connection, which unlike
+// net.Pipe, buffers writes so that commands can be pipelined.
+func connPair(t *testing.T) (net.Conn, net.Conn) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer ln.Close()
+
+	a, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatalf("Failed to dial: %v", err)
+	}
+	b, err := ln.Accept()
+	if err != nil {
+		t.Fatalf("Failed to accept: %v", err)
+	}
+	return a, b
+}
+
+func newTestClient(t *testing.T, cfg *config.Config, newBackend func(*session) sessionBackend) *testClient {
+	clientConn, filterConn := connPair(t)
+	s := newSession(cfg, nil, filterConn)
+	s.backend = newBackend(s)
+	s.isPreAuth = false
+
+	s.Add(2)
+	go s.backend.RelayTorToApp()
+	go s.proxyAndFilerApp()
+
+	return &testClient{t: t, conn: clientConn, rd: bufio.NewReader(clientConn)}
+}
+
+func (c *testClient) send(cmd string) {
+	c.conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := c.conn.Write([]byte(cmd + "\r\n")); err != nil {
+		c.t.Fatalf("Failed to send '%s': %v", cmd, err)
+	}
+}
+
+func (c *testClient) readReply() string {
+	c.conn.SetDeadline(time.Now().Add(5 * time.Second))
+	reply, err := readReply(c.rd)
+	if err != nil {
+		c.t.Fatalf("Failed to read reply: %v", err)
+	}
+	return strings.Join(reply, "")
+}
+
+func (c *testClient) request(cmd string) string {
+	c.send(cmd)
+	return c.readReply()
+}
+
+func newTestStubBackend(sc *scenario) func(*session) sessionBackend {
+	return func(s *session) sessionBackend {
+		return &stubBackend{s: s, sc: sc, closeChan: make(chan struct{})}
+	}
+}
+
+// fakeTor answers the commands that the tor backend sends to it, from a table
+// of replies, and sends an event before every reply.
+func fakeTor(conn net.Conn, replies map[string]string) {
+	rd := bufio.NewReader(conn)
+	for {
+		line, err := rd.ReadString('\n')
+		if err != nil {
+			return
+		}
+		line = strings.TrimRight(line, "\r\n")
+		reply, ok := replies[line]
+		if !ok {
+			reply = errUnrecognizedCommand
+		}
+
+		// Delay the reply, so that a filter that does not wait for tor
+		// would answer the client's next command first.
+		time.Sleep(20 * time.Millisecond)
+		conn.Write([]byte("650 STATUS_CLIENT NOTICE CIRCUIT_ESTABLISHED\r\n" + reply))
+	}
+}
+
+func TestTorBackendPassthrough(t *testing.T) {
+	cfg := loadTestConfig(t, "")
+
+	torConn, fakeTorConn := connPair(t)
+	defer fakeTorConn.Close()
+	go fakeTor(fakeTorConn, map[string]string{
+		"SETEVENTS STATUS_CLIENT": responseOk,
+		"GETINFO version":         "250-version=0.4.8.10\r\n250 OK\r\n",
+		"GETINFO circuit-status":  "250+circuit-status=\r\n1 BUILT\r\n..2 BUILT\r\n.\r\n250 OK\r\n",
+		"GETINFO config-file":     "551 Internal error\r\n",
+	})
+	c := newTestClient(t, cfg, func(s *session) sessionBackend {
+		return &torBackend{
+			s:         s,
+			torConn:   torConn,
+			protoInfo: &bulb.ProtocolInfo{TorVersion: "0.4.8.10"},
+			relayDone: make(chan struct{}),
+		}
+	})
+	defer c.conn.Close()
+
+	const event = "650 STATUS_CLIENT NOTICE CIRCUIT_ESTABLISHED\r\n"
+	const socksReply = "250-net/listeners/socks=\"127.0.0.1:9150\"\r\n" + responseOk
+
+	// Pipeline a passed through command and a spoofed one.  tor's reply must
+	// come first, and events are relayed as is.
+	c.send("SETEVENTS STATUS_CLIENT")
+	c.send("GETINFO net/listeners/socks")
+	for i, expected := range []string{event, responseOk, socksReply} {
+		if reply := c.readReply(); reply != expected {
+			t.Errorf("Pipelined reply %d = '%s', expected '%s'", i, reply, expected)
+		}
+	}
+
+	for _, tc := range []struct {
+		cmd      string
+		expected string
+	}{
+		{"GETINFO version net/listeners/socks", "250-version=0.4.8.10\r\n" + socksReply},
+		{"GETINFO circuit-status", "250+circuit-status=\r\n1 BUILT\r\n..2 BUILT\r\n.\r\n" + responseOk},
+		{"GETINFO config-file", "551 Internal error\r\n"},
+		{"GETINFO status/bootstrap-phase info/names", "552 Unrecognized key \"info/names\"\r\n"},
+		{"SETEVENTS BW", "552 Unrecognized event \"BW\"\r\n"},
+	} {
+		c.send(tc.cmd)
+		reply := c.readReply()
+		if reply == event {
+			reply = c.readReply()
+		}
+		if reply != tc.expected {
+			t.Errorf("'%s' = '%s', expected '%s'", tc.cmd, reply, tc.expected)
+		}
+	}
+}
+
+func TestGetInfo(t *testing.T) {
+	cfg := loadTestConfig(t, "")
+	sc, err := loadScenario("")
+	if err != nil {
+		t.Fatalf("loadScenario() failed: %v", err)
+	}
+	sc.Circuit = []*fakeCircuit{
+		{ID: 1, Status: "BUILT", Path: []string{"$A~a", "$B~b"}},
+		{ID: 2, Status: "LAUNCHED"},
+	}
+	c := newTestClient(t, cfg, newTestStubBackend(sc))
+	defer c.conn.Close()
+
+	const socksLine = "250-net/listeners/socks=\"127.0.0.1:9150\"\r\n"
+	for _, tc := range []struct {
+		cmd      string
+		expected string
+	}{
+		// Spoofed, passed, and mixed keys, answered in the requested order.
+		{"GETINFO net/listeners/socks", socksLine + responseOk},
+		{"GETINFO version", "250-version=" + defaultStubVersion + "\r\n" + responseOk},
+		{"GETINFO version net/listeners/socks", "250-version=" + defaultStubVersion + "\r\n" + socksLine + responseOk},
+		{"GETINFO net/listeners/socks  version", socksLine + "250-version=" + defaultStubVersion + "\r\n" + responseOk},
+		{"GETINFO circuit-status", "250+circuit-status=\r\n1 BUILT $A~a,$B~b\r\n2 LAUNCHED\r\n.\r\n" + responseOk},
+
+		// Any key that is not allowed fails the command, with the first
+		// bad key.
+		{"GETINFO version info/names address", "552 Unrecognized key \"info/names\"\r\n"},
+		{"GETINFO address net/listeners/socks", "552 Unrecognized key \"address\"\r\n"},
+
+		// Keys that are allowed, but that the backend does not know.
+		{"GETINFO version config-file", "552 Unrecognized key \"config-file\"\r\n"},
+
+		// Argument count errors.
+		{"GETINFO", "512 Missing argument to GETINFO\r\n"},
+		{"GETINFO ", "512 Missing argument to GETINFO\r\n"},
+		{"SIGNAL", "512 Missing argument to SIGNAL\r\n"},
+		{"SIGNAL NEWNYM NEWNYM", "512 Too many arguments to SIGNAL\r\n"},
+
+		{"SIGNAL HUP", "552 Unrecognized signal code \"HUP\"\r\n"},
+		{"SETCONF SocksPort=0", errUnrecognizedCommand},
+	} {
+		if reply := c.request(tc.cmd); reply != tc.expected {
+			t.Errorf("'%s' = '%s', expected '%s'", tc.cmd, reply, tc.expected)
+		}
+	}
+}
+
+func TestGetInfoValue(t *testing.T) {
+	for _, tc := range []struct {
+		key, value string
+		expected   string
+	}{
+		{"version", "0.4.8.10", "250-version=0.4.8.10\r\n"},
+		{"version", "", "250-version=\r\n"},
+		{"circuit-status", "1 BUILT\n2 BUILT", "250+circuit-status=\r\n1 BUILT\r\n2 BUILT\r\n.\r\n"},
+		{"config-text", ".hidden\n.", "250+config-text=\r\n..hidden\r\n..\r\n.\r\n"},
+	} {
+		formatted := formatGetInfoValue(tc.key, tc.value)
+		if formatted != tc.expected {
+			t.Errorf("formatGetInfoValue(%s, '%s') = '%s', expected '%s'", tc.key, tc.value, formatted, tc.expected)
+		}
+
+		// Parsing the reply must give back the value.
+		reply, err := readReply(bufio.NewReader(strings.NewReader(formatted + responseOk)))
+		if err != nil {
+			t.Fatalf("readReply('%s') failed: %v", formatted, err)
+		}
+		vals, err := parseGetInfoReply(reply)
+		if err != nil {
+			t.Fatalf("parseGetInfoReply('%s') failed: %v", formatted, err)
+		}
+		if v, ok := vals[tc.key]; !ok || v != tc.value {
+			t.Errorf("parseGetInfoReply('%s') = '%s', expected '%s'", formatted, v, tc.value)
+		}
+	}
+}
+
+func TestReadReply(t *testing.T) {
+	for _, tc := range []struct {
+		raw     string
+		nrLines int
+		ok      bool
+	}{
+		{responseOk, 1, true},
+		{"250-a=b\r\n250-c=d\r\n250 OK\r\n", 3, true},
+		{"250+a=\r\n250 OK\r\n.\r\n250 OK\r\n", 4, true},
+		{"650 STATUS_CLIENT NOTICE CIRCUIT_ESTABLISHED\r\n", 1, true},
+		{"25\r\n", 0, false},
+		{"250*OK\r\n", 0, false},
+		{"250-a=b\r\n", 0, false},
+	} {
+		reply, err := readReply(bufio.NewReader(strings.NewReader(tc.raw)))
+		if !tc.ok {
+			if err == nil {
+				t.Errorf("readReply('%s') succeeded, expected failure", tc.raw)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("readReply('%s') failed: %v", tc.raw, err)
+		} else if len(reply) != tc.nrLines {
+			t.Errorf("readReply('%s') = %d lines, expected %d", tc.raw, len(reply), tc.nrLines)
+		}
+	}
+
+	// Mid-reply lines that are not key=value pairs are malformed.
+	if _, err := parseGetInfoReply([]string{"250-version\r\n", responseOk}); err != errMalformedReply {
+		t.Errorf("parseGetInfoReply() with no value = %v, expected errMalformedReply", err)
+	}
+}